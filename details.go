@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func formatSeconds(seconds float64) string {
+	d := (time.Duration(seconds) * time.Second).Round(time.Second)
+	h := d / time.Hour
+	d -= h * time.Hour
+	m := d / time.Minute
+	d -= m * time.Minute
+	s := d / time.Second
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
+
+func printActivityDetails(a *strava.DetailedActivity) {
+	fmt.Printf("%s (%s, %s)\n", a.Name, a.Date().Format("01/02/2006 15:04"), a.Type)
+	fmt.Printf("  distance:       %s\n", a.DistanceString())
+	fmt.Printf("  moving time:    %s (elapsed %s)\n", a.MovingTimeString(), formatSeconds(a.ElapsedTime))
+	fmt.Printf("  pace:           %s /mi\n", a.PacePerMile())
+	fmt.Printf("  elevation gain: %.0f m\n", a.TotalElevationGain)
+	if a.HasHeartrate {
+		fmt.Printf("  heart rate:     %.0f avg, %.0f max\n", a.AverageHeartrate, a.MaxHeartrate)
+	}
+	if a.Calories > 0 {
+		fmt.Printf("  calories:       %.0f\n", a.Calories)
+	}
+	if a.DeviceName != "" {
+		fmt.Printf("  device:         %s\n", a.DeviceName)
+	}
+	if a.Gear != nil {
+		fmt.Printf("  gear:           %s\n", a.Gear.Name)
+	}
+	if route := a.Route(); len(route) > 0 {
+		start := route.Start()
+		fmt.Printf("  route:          %s from %.5f,%.5f\n", route.Shape(), start[0], start[1])
+	}
+	if a.Description != "" {
+		fmt.Printf("  description:    %s\n", strings.ReplaceAll(a.Description, "\n", "\n                  "))
+	}
+
+	if len(a.SplitsStandard) > 0 {
+		fmt.Printf("\nsplits:\n")
+		for _, split := range a.SplitsStandard {
+			pace := float64(split.MovingTime) / (split.Distance / metersPerMile)
+			fmt.Printf("  %3d  %s /mi  %+5.0f m", split.Split, formatSeconds(pace), split.ElevationDifference)
+			if split.AverageHeartrate > 0 {
+				fmt.Printf("  %3.0f bpm", split.AverageHeartrate)
+			}
+			fmt.Println()
+		}
+	}
+
+	if len(a.BestEfforts) > 0 {
+		fmt.Printf("\nbest efforts:\n")
+		for _, effort := range a.BestEfforts {
+			pr := ""
+			if effort.PrRank > 0 {
+				pr = fmt.Sprintf(" (PR #%d)", effort.PrRank)
+			}
+			fmt.Printf("  %-15s %s%s\n", effort.Name, formatSeconds(float64(effort.ElapsedTime)), pr)
+		}
+	}
+}
+
+// printBestEfforts prints the fastest of each of Strava's best effort
+// distances (400m, 1 mile, 5k, ...) across all of the activities
+func printBestEfforts(activities []strava.DetailedActivity) {
+	type best struct {
+		effort   strava.BestEffort
+		activity *strava.DetailedActivity
+	}
+
+	fastest := map[string]best{}
+	for i, activity := range activities {
+		for _, effort := range activity.BestEfforts {
+			if b, ok := fastest[effort.Name]; !ok || effort.ElapsedTime < b.effort.ElapsedTime {
+				fastest[effort.Name] = best{effort, &activities[i]}
+			}
+		}
+	}
+
+	var bests []best
+	for _, b := range fastest {
+		bests = append(bests, b)
+	}
+	sort.Slice(bests, func(i, j int) bool {
+		return bests[i].effort.Distance < bests[j].effort.Distance
+	})
+
+	for _, b := range bests {
+		fmt.Printf(
+			"best effort: %-15s %s (%s, %s)\n",
+			b.effort.Name,
+			formatSeconds(float64(b.effort.ElapsedTime)),
+			b.activity.Date().Format("2006-01-02"),
+			b.activity.Name,
+		)
+	}
+}
+
+func printRevisions(revisions []strava.ActivityRevision) {
+	if len(revisions) == 0 {
+		return
+	}
+	fmt.Printf("\nprevious versions:\n")
+	for _, r := range revisions {
+		a := r.Activity
+		fmt.Printf("  replaced %s: %s, %s, %s, type=%d\n", r.ReplacedAt.Local().Format("01/02/2006 15:04"), a.Name, a.Type, a.DistanceString(), a.WorkoutType)
+	}
+}
+
+func printEdits(edits []strava.ActivityEditRecord) {
+	if len(edits) == 0 {
+		return
+	}
+	fmt.Printf("\nedits:\n")
+	for _, e := range edits {
+		fmt.Printf("  %s: %s (was %s)\n", e.EditedAt.Local().Format("01/02/2006 15:04"), e.Edit, e.Previous)
+	}
+}
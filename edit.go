@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/scottfrazer/running/strava"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// optionalString is a flag value that remembers whether it was given, so
+// an explicitly empty value (e.g. clearing a description) can be told
+// apart from a missing flag
+type optionalString struct {
+	value *string
+}
+
+func (o *optionalString) Set(s string) error {
+	o.value = &s
+	return nil
+}
+
+func (o *optionalString) String() string {
+	if o.value == nil {
+		return ""
+	}
+	return *o.value
+}
+
+// editFlags are the flags of the edit command: the changes to make, and a
+// filter selecting the activities to make them to when no id is given
+type editFlags struct {
+	id          *int64
+	name        *string
+	workoutType *int
+	gear        *string
+	description *optionalString
+	dryRun      *bool
+	filter      *filterFlags
+}
+
+func addEditFlags(cmd *kingpin.CmdClause) *editFlags {
+	f := &editFlags{
+		id:          cmd.Arg("id", "Activity id; omit it to edit every activity matching the --match-* flags").Int64(),
+		name:        cmd.Flag("name", "New name").String(),
+		workoutType: cmd.Flag("workout-type", "New Strava workout type (0=default, 1=race, 2=long run, 3=workout)").Default("-1").Int(),
+		gear:        cmd.Flag("gear", "New gear, by id or name; \"none\" removes it").String(),
+		description: &optionalString{},
+	}
+	cmd.Flag("description", "New description; an empty one removes it").SetValue(f.description)
+	f.dryRun = cmd.Flag("dry-run", "List the activities that would be edited without changing them").Bool()
+	f.filter = addPrefixedFilterFlags(cmd, "match-")
+	return f
+}
+
+// stravaGearId matches Strava's gear ids: g for shoes, b for bikes
+var stravaGearId = regexp.MustCompile(`^[bg]\d+$`)
+
+func (f *editFlags) Edit(store strava.DataStore) (strava.ActivityEdit, error) {
+	edit := strava.ActivityEdit{Description: f.description.value}
+	if *f.name != "" {
+		edit.Name = f.name
+	}
+	if *f.workoutType >= 0 {
+		edit.WorkoutType = f.workoutType
+	}
+	if *f.gear != "" {
+		gearId := *f.gear
+		if gearId != "none" {
+			gear, err := strava.FindGear(store, gearId)
+			if err != nil {
+				return edit, err
+			}
+			if gear != nil {
+				gearId = gear.Id
+			} else if !stravaGearId.MatchString(gearId) {
+				return edit, fmt.Errorf("no stored activity uses gear %q; give its Strava id (e.g. g1234567) instead", gearId)
+			}
+		}
+		edit.GearId = &gearId
+	}
+	if edit.IsEmpty() {
+		return edit, fmt.Errorf("nothing to change; use --name, --workout-type, --gear or --description")
+	}
+	return edit, nil
+}
+
+// editActivities makes the edit to the activity given by id or, without
+// one, to every activity matching the filter.  Editing every activity
+// needs at least one filter flag, so a forgotten id doesn't re-tag the
+// whole history.
+func editActivities(ctx context.Context, client func() *strava.StravaClient, store strava.DataStore, flags *editFlags) {
+	edit, err := flags.Edit(store)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if *flags.id != 0 {
+		if *flags.dryRun {
+			fmt.Printf("would edit activity %d: %s\n", *flags.id, edit)
+			return
+		}
+		changes, err := client().EditActivity(ctx, store, *flags.id, edit)
+		check(err)
+		if changes.IsEmpty() {
+			fmt.Printf("activity %d already has those values\n", *flags.id)
+		} else {
+			fmt.Printf("edited activity %d: %s\n", *flags.id, changes)
+		}
+		return
+	}
+
+	filter, err := flags.filter.Filter()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if isEmptyFilter(filter) {
+		log.Fatalf("give an activity id, or --match-* flags to select the activities to edit")
+	}
+	if *flags.dryRun {
+		activities, err := store.Load(filter)
+		check(err)
+		for _, a := range activities {
+			fmt.Printf("would edit %d: %s, %s -- %s\n", a.Id, a.Date().Format("01/02/2006"), a.DistanceString(), a.Name)
+		}
+		fmt.Printf("%d activities match; the edit is %s\n", len(activities), edit)
+		return
+	}
+	edited, err := client().EditActivities(ctx, store, filter, edit)
+	fmt.Printf("edited %d activities\n", edited)
+	check(err)
+}
+
+func isEmptyFilter(f strava.ActivityFilter) bool {
+	return len(f.Types) == 0 && f.After.IsZero() && f.Before.IsZero() && f.MinDistance == 0 && f.MaxDistance == 0 &&
+		f.WorkoutType == nil && f.IsRace == nil && f.NameContains == "" && !f.HasPolyline && f.Limit == 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/tcx"
+)
+
+// loadActivityFile loads a stored activity with its laps and streams, for
+// encoding as a file
+func loadActivityFile(store strava.DataStore, id int64) *strava.ActivityFile {
+	activity, err := store.GetActivity(id)
+	check(err)
+	if activity == nil {
+		log.Fatalf("no activity %d", id)
+	}
+	file := &strava.ActivityFile{Activity: strava.DetailedActivity{SummaryActivity: *activity}}
+
+	details, err := store.GetDetails(id)
+	check(err)
+	if details != nil {
+		file.Activity = *details
+	}
+	file.Laps, err = store.GetLaps(id)
+	check(err)
+	file.Streams, err = store.GetStreams(id)
+	check(err)
+	if file.Streams == nil {
+		log.Fatalf("no streams stored for activity %d; run `running streams backfill` to fetch them", id)
+	}
+	return file
+}
+
+// exportActivity writes a stored activity with its laps and streams to a
+// file using one of the format packages' Encode functions
+func exportActivity(store strava.DataStore, id int64, format, output string, encode func(io.Writer, *strava.ActivityFile) error) {
+	file := loadActivityFile(store, id)
+	if output == "" {
+		output = fmt.Sprintf("%d.%s", id, format)
+	}
+	f, err := os.Create(output)
+	check(err)
+	defer f.Close()
+	check(encode(f, file))
+	fmt.Printf("wrote %s\n", output)
+}
+
+// uploadActivities uploads local activities, given by id, and GPX, TCX or
+// FIT files to Strava.  Local activities are sent as TCX, which keeps their
+// laps, and replaced by the Strava activities they become; uploaded files
+// are synced like any other new activity.
+func uploadActivities(ctx context.Context, client *strava.StravaClient, store strava.DataStore, args []string) {
+	for _, arg := range args {
+		if info, err := os.Stat(arg); err == nil && !info.IsDir() {
+			data, err := os.ReadFile(arg)
+			check(err)
+			id, err := client.UploadActivityFile(ctx, store, arg, data)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			fmt.Printf("uploaded %s as https://www.strava.com/activities/%d\n", arg, id)
+			continue
+		}
+
+		localId, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			log.Fatalf("%s is neither a file nor an activity id", arg)
+		}
+		var buf bytes.Buffer
+		check(tcx.Encode(&buf, loadActivityFile(store, localId)))
+		id, err := client.UploadActivity(ctx, store, localId, fmt.Sprintf("running%d.tcx", localId), buf.Bytes())
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("uploaded activity %d as https://www.strava.com/activities/%d\n", localId, id)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const metersPerMile = 1609.344
+
+// filterFlags are the command line flags shared by every command that
+// selects a set of activities
+type filterFlags struct {
+	types        *[]string
+	after        *string
+	before       *string
+	minMiles     *float64
+	maxMiles     *float64
+	workoutType  *int
+	racesOnly    *bool
+	excludeRaces *bool
+	name         *string
+	hasMap       *bool
+	limit        *int
+	offset       *int
+	sort         *string
+}
+
+func addFilterFlags(cmd *kingpin.CmdClause) *filterFlags {
+	return addPrefixedFilterFlags(cmd, "")
+}
+
+// addPrefixedFilterFlags adds the filter flags with a prefix on their names,
+// for commands whose own flags would clash with them
+func addPrefixedFilterFlags(cmd *kingpin.CmdClause, prefix string) *filterFlags {
+	flag := func(name, help string) *kingpin.FlagClause {
+		return cmd.Flag(prefix+name, help)
+	}
+	return &filterFlags{
+		types:        flag("type", "Only include activities of this type (Run, Ride, ...); may be repeated").Strings(),
+		after:        flag("after", "Only include activities on or after this date (YYYY-MM-DD)").String(),
+		before:       flag("before", "Only include activities before this date (YYYY-MM-DD)").String(),
+		minMiles:     flag("min-miles", "Minimum distance in miles").Float64(),
+		maxMiles:     flag("max-miles", "Maximum distance in miles").Float64(),
+		workoutType:  flag("workout-type", "Only include this Strava workout type (0=default, 1=race, 2=long run, 3=workout)").Default("-1").Int(),
+		racesOnly:    flag("races-only", "Only include races").Bool(),
+		excludeRaces: flag("exclude-races", "Exclude races").Bool(),
+		name:         flag("name", "Only include activities whose name contains this text").String(),
+		hasMap:       flag("has-map", "Only include activities with a GPS route").Bool(),
+		limit:        flag("limit", "Maximum number of activities").Int(),
+		offset:       flag("offset", "Number of activities to skip").Int(),
+		sort:         flag("sort", "Sort order").Default("newest").Enum("newest", "oldest", "longest", "shortest"),
+	}
+}
+
+func (f *filterFlags) Filter() (strava.ActivityFilter, error) {
+	filter := strava.ActivityFilter{
+		Types:        *f.types,
+		MinDistance:  *f.minMiles * metersPerMile,
+		MaxDistance:  *f.maxMiles * metersPerMile,
+		NameContains: *f.name,
+		HasPolyline:  *f.hasMap,
+		Limit:        *f.limit,
+		Offset:       *f.offset,
+	}
+
+	for _, d := range []struct {
+		value string
+		into  *time.Time
+	}{{*f.after, &filter.After}, {*f.before, &filter.Before}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", d.value)
+		if err != nil {
+			return filter, fmt.Errorf("invalid date %q (expected YYYY-MM-DD)", d.value)
+		}
+		*d.into = t
+	}
+
+	if *f.workoutType >= 0 {
+		filter.WorkoutType = f.workoutType
+	}
+
+	if *f.racesOnly && *f.excludeRaces {
+		return filter, fmt.Errorf("--races-only and --exclude-races are mutually exclusive")
+	} else if *f.racesOnly || *f.excludeRaces {
+		isRace := *f.racesOnly
+		filter.IsRace = &isRace
+	}
+
+	switch *f.sort {
+	case "oldest":
+		filter.Sort = strava.OldestFirst
+	case "longest":
+		filter.Sort = strava.LongestFirst
+	case "shortest":
+		filter.Sort = strava.ShortestFirst
+	default:
+		filter.Sort = strava.NewestFirst
+	}
+
+	return filter, nil
+}
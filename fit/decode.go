@@ -0,0 +1,424 @@
+package fit
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// message is a decoded data message: the valid values of its fields by
+// field number, and of its developer fields by name.  Numeric values are
+// raw, before scale and offset are applied.
+type message struct {
+	num       uint16
+	fields    map[uint8]float64
+	strings   map[uint8]string
+	developer map[string]float64
+}
+
+type fieldDef struct {
+	num      uint8
+	size     uint8
+	baseType uint8
+}
+
+type developerFieldDef struct {
+	num   uint8
+	size  uint8
+	index uint8 // developer data index
+}
+
+type definition struct {
+	order     binary.ByteOrder
+	num       uint16
+	fields    []fieldDef
+	developer []developerFieldDef
+}
+
+// developerField is what a field_description message says about a
+// developer field
+type developerField struct {
+	name     string
+	baseType uint8
+	scale    float64
+	offset   float64
+}
+
+type developerKey struct {
+	index, num uint8
+}
+
+// decoder reads the records of a FIT file, tracking the state records
+// depend on: local message definitions, developer field descriptions and
+// the last timestamp for compressed timestamp headers.
+type decoder struct {
+	r             *bufio.Reader
+	crc           uint16
+	remaining     uint32 // bytes of records left to read
+	definitions   [16]*definition
+	developer     map[developerKey]developerField
+	lastTimestamp uint32
+}
+
+// fitEpoch is the Unix time of FIT's epoch, 1989-12-31 00:00:00 UTC
+const fitEpoch = 631065600
+
+const (
+	fieldTimestamp       = 253
+	mesgFieldDescription = 206
+)
+
+func (d *decoder) read(buf []byte) error {
+	if uint32(len(buf)) > d.remaining {
+		return fmt.Errorf("record extends past the end of the data")
+	}
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return err
+	}
+	d.remaining -= uint32(len(buf))
+	d.crc = crc16(d.crc, buf)
+	return nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	var b [1]byte
+	err := d.read(b[:])
+	return b[0], err
+}
+
+// decodeMessages reads a whole FIT file and returns its data messages in
+// order.  The header and file CRCs are checked when present.
+func decodeMessages(r io.Reader) ([]message, error) {
+	d := &decoder{r: bufio.NewReader(r), developer: map[developerKey]developerField{}}
+
+	size, err := d.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if size[0] < 12 {
+		return nil, fmt.Errorf("invalid header size %d", size[0])
+	}
+	header := make([]byte, size[0])
+	if _, err := io.ReadFull(d.r, header); err != nil {
+		return nil, err
+	}
+	if string(header[8:12]) != ".FIT" {
+		return nil, errors.New("not a FIT file")
+	}
+	d.remaining = binary.LittleEndian.Uint32(header[4:8])
+	if len(header) >= 14 {
+		if want := binary.LittleEndian.Uint16(header[12:14]); want != 0 && want != crc16(0, header[:12]) {
+			return nil, errors.New("header CRC mismatch")
+		}
+	}
+	d.crc = crc16(0, header)
+
+	var messages []message
+	for d.remaining > 0 {
+		m, err := d.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			messages = append(messages, *m)
+		}
+	}
+
+	var crc [2]byte
+	if _, err := io.ReadFull(d.r, crc[:]); err != nil {
+		return nil, fmt.Errorf("missing file CRC: %v", err)
+	}
+	if binary.LittleEndian.Uint16(crc[:]) != d.crc {
+		return nil, errors.New("file CRC mismatch")
+	}
+	return messages, nil
+}
+
+// readRecord reads a definition or data message.  Definitions update the
+// decoder and return nil.
+func (d *decoder) readRecord() (*message, error) {
+	header, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if header&0x80 != 0 {
+		// Compressed timestamp header: a 5 bit offset from the last
+		// timestamp, which rolls over every 32 seconds
+		local := (header >> 5) & 0x03
+		offset := uint32(header & 0x1f)
+		timestamp := d.lastTimestamp&^0x1f + offset
+		if offset < d.lastTimestamp&0x1f {
+			timestamp += 0x20
+		}
+		d.lastTimestamp = timestamp
+		m, err := d.readData(local)
+		if err != nil {
+			return nil, err
+		}
+		m.fields[fieldTimestamp] = float64(timestamp)
+		return m, nil
+	}
+
+	local := header & 0x0f
+	if header&0x40 != 0 {
+		return nil, d.readDefinition(local, header&0x20 != 0)
+	}
+	m, err := d.readData(local)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp, ok := m.fields[fieldTimestamp]; ok {
+		d.lastTimestamp = uint32(timestamp)
+	}
+	if m.num == mesgFieldDescription {
+		d.describeDeveloperField(m)
+	}
+	return m, nil
+}
+
+func (d *decoder) readDefinition(local uint8, hasDeveloperFields bool) error {
+	fixed := make([]byte, 5)
+	if err := d.read(fixed); err != nil {
+		return err
+	}
+	def := &definition{order: binary.LittleEndian}
+	if fixed[1] == 1 {
+		def.order = binary.BigEndian
+	}
+	def.num = def.order.Uint16(fixed[2:4])
+
+	fields := make([]byte, 3*int(fixed[4]))
+	if err := d.read(fields); err != nil {
+		return err
+	}
+	for i := 0; i < len(fields); i += 3 {
+		def.fields = append(def.fields, fieldDef{fields[i], fields[i+1], fields[i+2]})
+	}
+
+	if hasDeveloperFields {
+		n, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		fields := make([]byte, 3*int(n))
+		if err := d.read(fields); err != nil {
+			return err
+		}
+		for i := 0; i < len(fields); i += 3 {
+			def.developer = append(def.developer, developerFieldDef{fields[i], fields[i+1], fields[i+2]})
+		}
+	}
+
+	d.definitions[local] = def
+	return nil
+}
+
+func (d *decoder) readData(local uint8) (*message, error) {
+	def := d.definitions[local]
+	if def == nil {
+		return nil, fmt.Errorf("data message for undefined local message type %d", local)
+	}
+
+	m := &message{
+		num:       def.num,
+		fields:    map[uint8]float64{},
+		strings:   map[uint8]string{},
+		developer: map[string]float64{},
+	}
+	for _, f := range def.fields {
+		buf := make([]byte, f.size)
+		if err := d.read(buf); err != nil {
+			return nil, err
+		}
+		if f.baseType&0x1f == baseString {
+			if s := decodeString(buf); s != "" {
+				m.strings[f.num] = s
+			}
+		} else if v, ok := decodeValue(buf, f.baseType, def.order); ok {
+			m.fields[f.num] = v
+		}
+	}
+
+	for _, f := range def.developer {
+		buf := make([]byte, f.size)
+		if err := d.read(buf); err != nil {
+			return nil, err
+		}
+		desc, ok := d.developer[developerKey{f.index, f.num}]
+		if !ok || desc.baseType&0x1f == baseString {
+			continue
+		}
+		if v, ok := decodeValue(buf, desc.baseType, def.order); ok {
+			m.developer[desc.name] = v/desc.scale - desc.offset
+		}
+	}
+	return m, nil
+}
+
+// describeDeveloperField records a field_description message so later data
+// messages can decode the developer field it describes
+func (d *decoder) describeDeveloperField(m *message) {
+	index, ok1 := m.fields[0]
+	num, ok2 := m.fields[1]
+	baseType, ok3 := m.fields[2]
+	if !ok1 || !ok2 || !ok3 {
+		return
+	}
+	field := developerField{
+		name:     m.strings[3],
+		baseType: uint8(baseType),
+		scale:    1,
+	}
+	if field.name == "" {
+		field.name = fmt.Sprintf("developer_%d_%d", uint8(index), uint8(num))
+	}
+	if scale, ok := m.fields[6]; ok && scale != 0 {
+		field.scale = scale
+	}
+	if offset, ok := m.fields[7]; ok {
+		field.offset = offset
+	}
+	d.developer[developerKey{uint8(index), uint8(num)}] = field
+}
+
+// Base type numbers, without the endianness bit
+const (
+	baseEnum    = 0x00
+	baseSint8   = 0x01
+	baseUint8   = 0x02
+	baseSint16  = 0x03
+	baseUint16  = 0x04
+	baseSint32  = 0x05
+	baseUint32  = 0x06
+	baseString  = 0x07
+	baseFloat32 = 0x08
+	baseFloat64 = 0x09
+	baseUint8z  = 0x0a
+	baseUint16z = 0x0b
+	baseUint32z = 0x0c
+	baseByte    = 0x0d
+	baseSint64  = 0x0e
+	baseUint64  = 0x0f
+	baseUint64z = 0x10
+)
+
+// decodeValue decodes the first element of a field.  ok is false if the
+// value is the base type's invalid value (i.e. the field isn't set) or the
+// field is too short for its type.
+func decodeValue(buf []byte, baseType uint8, order binary.ByteOrder) (float64, bool) {
+	switch baseType & 0x1f {
+	case baseEnum, baseUint8, baseByte:
+		if len(buf) < 1 || buf[0] == 0xff {
+			return 0, false
+		}
+		return float64(buf[0]), true
+	case baseUint8z:
+		if len(buf) < 1 || buf[0] == 0 {
+			return 0, false
+		}
+		return float64(buf[0]), true
+	case baseSint8:
+		if len(buf) < 1 || buf[0] == 0x7f {
+			return 0, false
+		}
+		return float64(int8(buf[0])), true
+	case baseSint16:
+		if len(buf) < 2 {
+			return 0, false
+		}
+		v := order.Uint16(buf)
+		return float64(int16(v)), v != 0x7fff
+	case baseUint16:
+		if len(buf) < 2 {
+			return 0, false
+		}
+		v := order.Uint16(buf)
+		return float64(v), v != 0xffff
+	case baseUint16z:
+		if len(buf) < 2 {
+			return 0, false
+		}
+		v := order.Uint16(buf)
+		return float64(v), v != 0
+	case baseSint32:
+		if len(buf) < 4 {
+			return 0, false
+		}
+		v := order.Uint32(buf)
+		return float64(int32(v)), v != 0x7fffffff
+	case baseUint32:
+		if len(buf) < 4 {
+			return 0, false
+		}
+		v := order.Uint32(buf)
+		return float64(v), v != 0xffffffff
+	case baseUint32z:
+		if len(buf) < 4 {
+			return 0, false
+		}
+		v := order.Uint32(buf)
+		return float64(v), v != 0
+	case baseFloat32:
+		if len(buf) < 4 {
+			return 0, false
+		}
+		v := order.Uint32(buf)
+		return float64(math.Float32frombits(v)), v != 0xffffffff
+	case baseFloat64:
+		if len(buf) < 8 {
+			return 0, false
+		}
+		v := order.Uint64(buf)
+		return math.Float64frombits(v), v != 0xffffffffffffffff
+	case baseSint64:
+		if len(buf) < 8 {
+			return 0, false
+		}
+		v := order.Uint64(buf)
+		return float64(int64(v)), v != 0x7fffffffffffffff
+	case baseUint64:
+		if len(buf) < 8 {
+			return 0, false
+		}
+		v := order.Uint64(buf)
+		return float64(v), v != 0xffffffffffffffff
+	case baseUint64z:
+		if len(buf) < 8 {
+			return 0, false
+		}
+		v := order.Uint64(buf)
+		return float64(v), v != 0
+	}
+	return 0, false
+}
+
+func decodeString(buf []byte) string {
+	for i, b := range buf {
+		if b == 0 {
+			return string(buf[:i])
+		}
+	}
+	return string(buf)
+}
+
+var crcTable = [16]uint16{
+	0x0000, 0xcc01, 0xd801, 0x1400, 0xf001, 0x3c00, 0x2800, 0xe401,
+	0xa001, 0x6c00, 0x7800, 0xb401, 0x5000, 0x9c01, 0x8801, 0x4400,
+}
+
+// crc16 is the CRC used by FIT headers and files
+func crc16(crc uint16, data []byte) uint16 {
+	for _, b := range data {
+		tmp := crcTable[crc&0xf]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ crcTable[b&0xf]
+		tmp = crcTable[crc&0xf]
+		crc = (crc >> 4) & 0x0fff
+		crc = crc ^ tmp ^ crcTable[(b>>4)&0xf]
+	}
+	return crc
+}
@@ -0,0 +1,401 @@
+// Package fit is a decoder for Garmin's Flexible and Interoperable Data
+// Transfer (FIT) activity files, as written by most GPS watches.  It reads
+// the file_id, session, lap and record messages, including developer
+// fields, and skips everything else.  Importing the package registers its
+// decoder for ".fit" files with strava.DecodeFile.
+package fit
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func init() {
+	strava.RegisterFileDecoder(".fit", Decode)
+}
+
+// Global message numbers
+const (
+	mesgFileId  = 0
+	mesgSession = 18
+	mesgLap     = 19
+	mesgRecord  = 20
+)
+
+// Sports, from the FIT profile's sport enum
+const (
+	SportGeneric  = 0
+	SportRunning  = 1
+	SportCycling  = 2
+	SportSwimming = 5
+	SportWalking  = 11
+	SportHiking   = 17
+)
+
+var sports = map[uint8]string{
+	SportRunning:  "Run",
+	SportCycling:  "Ride",
+	SportSwimming: "Swim",
+	SportWalking:  "Walk",
+	SportHiking:   "Hike",
+}
+
+var manufacturers = map[uint16]string{
+	1:   "Garmin",
+	23:  "Suunto",
+	32:  "Wahoo Fitness",
+	89:  "Tacx",
+	255: "Development",
+	265: "Strava",
+	294: "COROS",
+}
+
+// File is the decoded content of a FIT activity file
+type File struct {
+	FileId   FileId
+	Sessions []Session
+	Laps     []Lap
+	Records  []Record
+}
+
+type FileId struct {
+	Type         uint8
+	Manufacturer uint16
+	Product      uint16
+	SerialNumber uint32
+	TimeCreated  time.Time
+	ProductName  string
+}
+
+// Summary holds the totals common to session and lap messages, in meters,
+// seconds and meters per second.  Values the file doesn't have are zero.
+type Summary struct {
+	StartTime        time.Time
+	Timestamp        time.Time // end time
+	TotalElapsedTime float64
+	TotalTimerTime   float64 // excludes pauses
+	TotalDistance    float64
+	TotalCalories    float64
+	TotalAscent      float64
+	AvgSpeed         float64
+	MaxSpeed         float64
+	AvgHeartRate     float64
+	MaxHeartRate     float64
+	AvgCadence       float64
+}
+
+type Session struct {
+	Summary
+	Sport uint8
+}
+
+type Lap struct {
+	Summary
+}
+
+// Record is a single point of an activity.  Fields the record doesn't have
+// are nil.  Developer holds developer fields (e.g. running power from a
+// foot pod) by their field name.
+type Record struct {
+	Timestamp time.Time
+	Lat       *float64 // degrees
+	Lng       *float64 // degrees
+	Altitude  *float64 // meters
+	Distance  *float64 // meters
+	Speed     *float64 // meters per second
+	HeartRate *float64
+	Cadence   *float64
+	Developer map[string]float64
+}
+
+// Parse decodes a FIT file
+func Parse(r io.Reader) (*File, error) {
+	messages, err := decodeMessages(r)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &File{}
+	for _, m := range messages {
+		switch m.num {
+		case mesgFileId:
+			file.FileId = FileId{
+				Type:         uint8(m.fields[0]),
+				Manufacturer: uint16(m.fields[1]),
+				Product:      uint16(m.fields[2]),
+				SerialNumber: uint32(m.fields[3]),
+				TimeCreated:  m.time(4),
+				ProductName:  m.strings[8],
+			}
+		case mesgSession:
+			file.Sessions = append(file.Sessions, Session{
+				Summary: m.summary(summaryFields{7, 8, 9, 11, 22, 14, 15, 16, 17, 18, 124, 125}),
+				Sport:   uint8(m.fields[5]),
+			})
+		case mesgLap:
+			file.Laps = append(file.Laps, Lap{
+				Summary: m.summary(summaryFields{7, 8, 9, 11, 21, 13, 14, 15, 16, 17, 110, 111}),
+			})
+		case mesgRecord:
+			file.Records = append(file.Records, m.record())
+		}
+	}
+	return file, nil
+}
+
+func (m message) time(field uint8) time.Time {
+	v, ok := m.fields[field]
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(v)+fitEpoch, 0).UTC()
+}
+
+// scaled returns a field's value with the profile's scale and offset
+// applied, or nil if the message doesn't have it
+func (m message) scaled(field uint8, scale, offset float64) *float64 {
+	v, ok := m.fields[field]
+	if !ok {
+		return nil
+	}
+	v = v/scale - offset
+	return &v
+}
+
+func (m message) value(field uint8, scale float64) float64 {
+	if v := m.scaled(field, scale, 0); v != nil {
+		return *v
+	}
+	return 0
+}
+
+// summaryFields are the field numbers of the summary fields, which differ
+// between sessions and laps
+type summaryFields struct {
+	elapsedTime, timerTime, distance, calories, ascent      uint8
+	avgSpeed, maxSpeed, avgHeartRate, maxHeartRate, cadence uint8
+	enhancedAvgSpeed, enhancedMaxSpeed                      uint8
+}
+
+func (m message) summary(f summaryFields) Summary {
+	s := Summary{
+		StartTime:        m.time(2),
+		Timestamp:        m.time(fieldTimestamp),
+		TotalElapsedTime: m.value(f.elapsedTime, 1000),
+		TotalTimerTime:   m.value(f.timerTime, 1000),
+		TotalDistance:    m.value(f.distance, 100),
+		TotalCalories:    m.value(f.calories, 1),
+		TotalAscent:      m.value(f.ascent, 1),
+		AvgSpeed:         m.value(f.avgSpeed, 1000),
+		MaxSpeed:         m.value(f.maxSpeed, 1000),
+		AvgHeartRate:     m.value(f.avgHeartRate, 1),
+		MaxHeartRate:     m.value(f.maxHeartRate, 1),
+		AvgCadence:       m.value(f.cadence, 1),
+	}
+	// The enhanced fields are 32 bit versions for fast activities
+	if v := m.value(f.enhancedAvgSpeed, 1000); v > 0 {
+		s.AvgSpeed = v
+	}
+	if v := m.value(f.enhancedMaxSpeed, 1000); v > 0 {
+		s.MaxSpeed = v
+	}
+	return s
+}
+
+// semicircles converts FIT's 32 bit angles to degrees
+const semicircles = 180 / float64(1<<31)
+
+func (m message) record() Record {
+	r := Record{
+		Timestamp: m.time(fieldTimestamp),
+		Lat:       m.scaled(0, 1/semicircles, 0),
+		Lng:       m.scaled(1, 1/semicircles, 0),
+		Altitude:  m.scaled(2, 5, 500),
+		HeartRate: m.scaled(3, 1, 0),
+		Cadence:   m.scaled(4, 1, 0),
+		Distance:  m.scaled(5, 100, 0),
+		Speed:     m.scaled(6, 1000, 0),
+	}
+	if v := m.scaled(73, 1000, 0); v != nil {
+		r.Speed = v
+	}
+	if v := m.scaled(78, 5, 500); v != nil {
+		r.Altitude = v
+	}
+	if len(m.developer) > 0 {
+		r.Developer = m.developer
+	}
+	return r
+}
+
+// DeviceName describes the device that recorded the file, e.g. "Garmin
+// Forerunner 955" or "Garmin 4024"
+func (f *File) DeviceName() string {
+	name := manufacturers[f.FileId.Manufacturer]
+	if f.FileId.ProductName != "" {
+		name = strings.TrimSpace(name + " " + f.FileId.ProductName)
+	} else if name != "" && f.FileId.Product != 0 {
+		name = fmt.Sprintf("%s %d", name, f.FileId.Product)
+	}
+	return name
+}
+
+// Decode reads a FIT activity file into an activity with its laps and
+// streams.  The activity's totals come from the first session message
+// where present and are otherwise computed from the records.  Times are in
+// UTC.
+func Decode(r io.Reader) (*strava.ActivityFile, error) {
+	f, err := Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for _, record := range f.Records {
+		if !record.Timestamp.IsZero() {
+			records = append(records, record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.Before(records[j].Timestamp)
+	})
+
+	file := &strava.ActivityFile{Streams: &strava.Streams{}}
+	a := &file.Activity
+	a.Type = "Workout"
+	a.DeviceName = f.DeviceName()
+
+	var start time.Time
+	if len(f.Sessions) > 0 {
+		session := f.Sessions[0]
+		start = session.StartTime
+		if sport, ok := sports[session.Sport]; ok {
+			a.Type = sport
+		}
+		a.Distance = session.TotalDistance
+		a.MovingTime = session.TotalTimerTime
+		a.ElapsedTime = session.TotalElapsedTime
+		a.Calories = session.TotalCalories
+		a.TotalElevationGain = session.TotalAscent
+		a.AverageSpeed = session.AvgSpeed
+		a.MaxSpeed = session.MaxSpeed
+		a.AverageHeartrate = session.AvgHeartRate
+		a.MaxHeartrate = session.MaxHeartRate
+		a.AverageCadence = session.AvgCadence
+		a.HasHeartrate = session.AvgHeartRate > 0
+	}
+	if start.IsZero() && len(records) > 0 {
+		start = records[0].Timestamp
+	}
+	if start.IsZero() {
+		start = f.FileId.TimeCreated
+	}
+	if start.IsZero() {
+		return nil, fmt.Errorf("no start time")
+	}
+	a.DateString = start.Format("2006-01-02T15:04:05Z")
+
+	readRecords(file.Streams, start, records)
+
+	for i, l := range f.Laps {
+		lap := strava.ActivityLap{
+			Name:               fmt.Sprintf("Lap %d", i+1),
+			StartDate:          l.StartTime,
+			StartDateLocal:     l.StartTime,
+			ElapsedTime:        int32(math.Round(l.TotalElapsedTime)),
+			MovingTime:         int32(math.Round(l.TotalTimerTime)),
+			Distance:           l.TotalDistance,
+			TotalElevationGain: l.TotalAscent,
+			AverageSpeed:       l.AvgSpeed,
+			MaxSpeed:           l.MaxSpeed,
+			AverageCadence:     l.AvgCadence,
+			AverageHeartrate:   l.AvgHeartRate,
+			MaxHeartrate:       l.MaxHeartRate,
+			Calories:           l.TotalCalories,
+			LapIndex:           int32(i + 1),
+			Split:              int32(i + 1),
+		}
+
+		// A lap's points are the records from its start up to the next
+		// lap's start
+		end := time.Time{}
+		if i+1 < len(f.Laps) {
+			end = f.Laps[i+1].StartTime
+		}
+		first := sort.Search(len(records), func(j int) bool { return !records[j].Timestamp.Before(l.StartTime) })
+		last := len(records)
+		if !end.IsZero() {
+			last = sort.Search(len(records), func(j int) bool { return !records[j].Timestamp.Before(end) })
+		}
+		lap.StartIndex, lap.EndIndex = int32(first), int32(last-1)
+		file.Laps = append(file.Laps, lap)
+	}
+
+	file.Summarize()
+	return file, nil
+}
+
+// readRecords turns record messages into streams timed from start.  Fields
+// a watch didn't fill in arrive as their type's invalid value and are nil
+// here; they're common, e.g. heart rate before the strap connects or
+// position under trees, so a gap repeats the last value (or, at the start,
+// the first one) to keep one entry per record.
+func readRecords(s *strava.Streams, start time.Time, records []Record) {
+	first := func(get func(Record) *float64) (float64, bool) {
+		for _, r := range records {
+			if v := get(r); v != nil {
+				return *v, true
+			}
+		}
+		return 0, false
+	}
+	streams := []struct {
+		get  func(Record) *float64
+		into func(float64)
+	}{
+		{func(r Record) *float64 { return r.Altitude }, func(v float64) { s.Altitude = append(s.Altitude, v) }},
+		{func(r Record) *float64 { return r.Distance }, func(v float64) { s.Distance = append(s.Distance, v) }},
+		{func(r Record) *float64 { return r.Speed }, func(v float64) { s.Velocity = append(s.Velocity, v) }},
+		{func(r Record) *float64 { return r.HeartRate }, func(v float64) { s.Heartrate = append(s.Heartrate, int32(v)) }},
+		{func(r Record) *float64 { return r.Cadence }, func(v float64) { s.Cadence = append(s.Cadence, int32(v)) }},
+	}
+	values := make([]float64, len(streams))
+	present := make([]bool, len(streams))
+	for i, stream := range streams {
+		values[i], present[i] = first(stream.get)
+	}
+
+	var position [2]float64
+	hasPosition := false
+	for _, r := range records {
+		if r.Lat != nil && r.Lng != nil {
+			position, hasPosition = [2]float64{*r.Lat, *r.Lng}, true
+			break
+		}
+	}
+
+	for _, r := range records {
+		s.Time = append(s.Time, int32(r.Timestamp.Sub(start).Seconds()))
+		if hasPosition {
+			if r.Lat != nil && r.Lng != nil {
+				position = [2]float64{*r.Lat, *r.Lng}
+			}
+			s.LatLng = append(s.LatLng, position)
+		}
+		for i, stream := range streams {
+			if !present[i] {
+				continue
+			}
+			if v := stream.get(r); v != nil {
+				values[i] = *v
+			}
+			stream.into(values[i])
+		}
+	}
+}
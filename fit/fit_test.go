@@ -0,0 +1,256 @@
+package fit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// builder writes FIT files for tests
+type builder struct {
+	data bytes.Buffer
+}
+
+type field struct {
+	num, baseType uint8
+	value         interface{} // uint8, uint16, uint32, int32 or string
+}
+
+func (f field) bytes(order binary.ByteOrder) []byte {
+	var buf bytes.Buffer
+	switch v := f.value.(type) {
+	case string:
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	default:
+		binary.Write(&buf, order, v)
+	}
+	return buf.Bytes()
+}
+
+func (b *builder) define(local uint8, global uint16, order binary.ByteOrder, fields []field, developer [][3]uint8) {
+	header := 0x40 | local
+	if len(developer) > 0 {
+		header |= 0x20
+	}
+	b.data.WriteByte(header)
+	arch := byte(0)
+	if order == binary.BigEndian {
+		arch = 1
+	}
+	b.data.Write([]byte{0, arch})
+	binary.Write(&b.data, order, global)
+	b.data.WriteByte(byte(len(fields)))
+	for _, f := range fields {
+		b.data.Write([]byte{f.num, byte(len(f.bytes(order))), f.baseType})
+	}
+	if len(developer) > 0 {
+		b.data.WriteByte(byte(len(developer)))
+		for _, d := range developer {
+			b.data.Write(d[:])
+		}
+	}
+}
+
+func (b *builder) write(header uint8, order binary.ByteOrder, fields []field, developer ...[]byte) {
+	b.data.WriteByte(header)
+	for _, f := range fields {
+		b.data.Write(f.bytes(order))
+	}
+	for _, d := range developer {
+		b.data.Write(d)
+	}
+}
+
+func (b *builder) bytes() []byte {
+	header := []byte{14, 0x20, 0x54, 0x08, 0, 0, 0, 0, '.', 'F', 'I', 'T', 0, 0}
+	binary.LittleEndian.PutUint32(header[4:8], uint32(b.data.Len()))
+	binary.LittleEndian.PutUint16(header[12:14], crc16(0, header[:12]))
+	file := append(header, b.data.Bytes()...)
+	crc := make([]byte, 2)
+	binary.LittleEndian.PutUint16(crc, crc16(0, file))
+	return append(file, crc...)
+}
+
+var start = time.Date(2022, 5, 7, 13, 0, 0, 0, time.UTC)
+
+func fitTime(t time.Time) uint32 {
+	return uint32(t.Unix() - fitEpoch)
+}
+
+func semicircle(degrees float64) int32 {
+	return int32(math.Round(degrees / semicircles))
+}
+
+func testFile() []byte {
+	le := binary.LittleEndian
+	b := &builder{}
+
+	fileId := []field{
+		{0, 0x00, uint8(4)},
+		{1, 0x84, uint16(1)},
+		{2, 0x84, uint16(4024)},
+		{3, 0x8c, uint32(3412345678)},
+		{4, 0x86, fitTime(start)},
+	}
+	b.define(0, mesgFileId, le, fileId, nil)
+	b.write(0, le, fileId)
+
+	// A developer field for running power, as a Stryd foot pod writes it
+	description := []field{
+		{0, 0x02, uint8(0)},
+		{1, 0x02, uint8(7)},
+		{2, 0x02, uint8(0x84)},
+		{3, 0x07, "Power"},
+	}
+	b.define(1, mesgFieldDescription, le, description, nil)
+	b.write(1, le, description)
+
+	// Records, big endian to check the architecture byte is honored
+	be := binary.BigEndian
+	record := func(seconds int, lat, lng float64, distance uint32, hr uint8, power uint16) []field {
+		return []field{
+			{fieldTimestamp, 0x86, fitTime(start.Add(time.Duration(seconds) * time.Second))},
+			{0, 0x85, semicircle(lat)},
+			{1, 0x85, semicircle(lng)},
+			{2, 0x84, uint16((40 + 500) * 5)},
+			{3, 0x02, hr},
+			{4, 0x02, uint8(85)},
+			{5, 0x86, distance},
+		}
+	}
+	power := func(watts uint16) []byte {
+		buf := make([]byte, 2)
+		binary.BigEndian.PutUint16(buf, watts)
+		return buf
+	}
+	b.define(2, mesgRecord, be, record(0, 0, 0, 0, 0, 0), [][3]uint8{{7, 2, 0}})
+	b.write(2, be, record(0, 42.3370, -71.1500, 0, 120, 0), power(210))
+	b.write(2, be, record(10, 42.3375, -71.1500, 5500, 0xff, 0), power(0xffff))
+	b.write(2, be, record(20, 42.3380, -71.1500, 11100, 131, 0), power(240))
+
+	// A record with a compressed timestamp header: local type 3, 10
+	// seconds after the last timestamp
+	b.define(3, mesgRecord, le, []field{{3, 0x02, uint8(0)}, {5, 0x86, uint32(0)}}, nil)
+	last := fitTime(start.Add(20 * time.Second))
+	offset := uint8((last + 10) & 0x1f)
+	b.write(0x80|3<<5|offset, le, []field{{3, 0x02, uint8(140)}, {5, 0x86, uint32(16600)}})
+
+	lap := func(lapStart time.Time, distance uint32, hr uint8) []field {
+		return []field{
+			{fieldTimestamp, 0x86, fitTime(lapStart.Add(20 * time.Second))},
+			{2, 0x86, fitTime(lapStart)},
+			{7, 0x86, uint32(20000)},
+			{8, 0x86, uint32(20000)},
+			{9, 0x86, distance},
+			{11, 0x84, uint16(4)},
+			{15, 0x02, hr},
+			{16, 0x02, hr + 5},
+		}
+	}
+	b.define(4, mesgLap, le, lap(start, 0, 0), nil)
+	b.write(4, le, lap(start, 11100, 125))
+	b.write(4, le, lap(start.Add(20*time.Second), 5500, 140))
+
+	session := []field{
+		{fieldTimestamp, 0x86, fitTime(start.Add(30 * time.Second))},
+		{2, 0x86, fitTime(start)},
+		{5, 0x00, uint8(SportRunning)},
+		{7, 0x86, uint32(30000)},
+		{8, 0x86, uint32(30000)},
+		{9, 0x86, uint32(16600)},
+		{11, 0x84, uint16(8)},
+		{16, 0x02, uint8(130)},
+		{17, 0x02, uint8(140)},
+	}
+	b.define(5, mesgSession, le, session, nil)
+	b.write(5, le, session)
+
+	return b.bytes()
+}
+
+func TestParse(t *testing.T) {
+	f, err := Parse(bytes.NewReader(testFile()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.FileId.Manufacturer != 1 || f.FileId.Product != 4024 || !f.FileId.TimeCreated.Equal(start) {
+		t.Errorf("unexpected file id: %+v", f.FileId)
+	}
+	if f.DeviceName() != "Garmin 4024" {
+		t.Errorf("unexpected device name %q", f.DeviceName())
+	}
+	if len(f.Records) != 4 || len(f.Laps) != 2 || len(f.Sessions) != 1 {
+		t.Fatalf("expected 4 records, 2 laps and a session, got %d, %d, %d", len(f.Records), len(f.Laps), len(f.Sessions))
+	}
+
+	r := f.Records[0]
+	if math.Abs(*r.Lat-42.3370) > 1e-6 || math.Abs(*r.Lng+71.1500) > 1e-6 || *r.Altitude != 40 || *r.HeartRate != 120 {
+		t.Errorf("unexpected record: lat=%v lng=%v alt=%v hr=%v", *r.Lat, *r.Lng, *r.Altitude, *r.HeartRate)
+	}
+	if r.Developer["Power"] != 210 {
+		t.Errorf("expected the developer power field, got %v", r.Developer)
+	}
+	if f.Records[1].HeartRate != nil {
+		t.Errorf("expected an invalid heart rate to be missing, got %v", *f.Records[1].HeartRate)
+	}
+	if _, ok := f.Records[1].Developer["Power"]; ok {
+		t.Error("expected an invalid developer field to be missing")
+	}
+	if want := start.Add(30 * time.Second); !f.Records[3].Timestamp.Equal(want) {
+		t.Errorf("expected the compressed timestamp to be %s, got %s", want, f.Records[3].Timestamp)
+	}
+
+	s := f.Sessions[0]
+	if s.Sport != SportRunning || s.TotalDistance != 166 || s.TotalTimerTime != 30 || s.MaxHeartRate != 140 {
+		t.Errorf("unexpected session: %+v", s)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	file, err := Decode(bytes.NewReader(testFile()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := file.Activity
+	if a.Type != "Run" || a.DateString != "2022-05-07T13:00:00Z" || a.Distance != 166 || a.MovingTime != 30 || a.Calories != 8 {
+		t.Errorf("unexpected activity: %+v", a)
+	}
+	if a.Map.Polyline == "" {
+		t.Error("expected a polyline")
+	}
+
+	s := file.Streams
+	if s.Len() != 4 || len(s.LatLng) != 4 || len(s.Heartrate) != 4 || len(s.Distance) != 4 {
+		t.Fatalf("expected 4 points in every stream, got %+v", s)
+	}
+	if s.Time[3] != 30 || s.Heartrate[1] != 120 || s.LatLng[3] != s.LatLng[2] {
+		t.Errorf("unexpected streams: %+v", s)
+	}
+
+	if len(file.Laps) != 2 {
+		t.Fatalf("expected 2 laps, got %d", len(file.Laps))
+	}
+	if l := file.Laps[0]; l.StartIndex != 0 || l.EndIndex != 1 || l.Distance != 111 || l.AverageHeartrate != 125 || l.Calories != 4 {
+		t.Errorf("unexpected first lap: %+v", l)
+	}
+	if l := file.Laps[1]; l.StartIndex != 2 || l.EndIndex != 3 || l.ElapsedTime != 20 {
+		t.Errorf("unexpected second lap: %+v", l)
+	}
+}
+
+func TestCorruptFile(t *testing.T) {
+	data := testFile()
+	data[len(data)/2] ^= 0xff
+	if _, err := Parse(bytes.NewReader(data)); err == nil {
+		t.Error("expected an error for a corrupt file")
+	}
+
+	if _, err := Parse(bytes.NewReader(data[:len(data)-10])); err == nil {
+		t.Error("expected an error for a truncated file")
+	}
+}
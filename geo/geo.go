@@ -0,0 +1,103 @@
+// Package geo has the geometry used on activity routes: Google's encoded
+// polyline format, distances on the Earth's surface, and the shape of a
+// route (see Route)
+package geo
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// LatLng is a [latitude, longitude] pair in degrees, the same layout as
+// strava.Streams.LatLng
+type LatLng = [2]float64
+
+// earthRadius is the mean radius of the Earth in meters
+const earthRadius = 6371008.8
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Distance is the great circle (haversine) distance between two points in
+// meters
+func Distance(a, b LatLng) float64 {
+	lat1, lat2 := radians(a[0]), radians(b[0])
+	dLat := lat2 - lat1
+	dLng := radians(b[1] - a[1])
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(math.Min(1, h)))
+}
+
+// Encode encodes points in Google's polyline format with 5 decimal places,
+// the format of Strava's summary_polyline
+func Encode(points []LatLng) string {
+	var b strings.Builder
+	var prevLat, prevLng int64
+	for _, p := range points {
+		lat := int64(math.Round(p[0] * 1e5))
+		lng := int64(math.Round(p[1] * 1e5))
+		encodeValue(&b, lat-prevLat)
+		encodeValue(&b, lng-prevLng)
+		prevLat, prevLng = lat, lng
+	}
+	return b.String()
+}
+
+func encodeValue(b *strings.Builder, v int64) {
+	v <<= 1
+	if v < 0 {
+		v = ^v
+	}
+	for v >= 0x20 {
+		b.WriteByte(byte((0x20 | (v & 0x1f)) + 63))
+		v >>= 5
+	}
+	b.WriteByte(byte(v + 63))
+}
+
+// Decode decodes a Google encoded polyline
+func Decode(polyline string) ([]LatLng, error) {
+	points := []LatLng{}
+	var lat, lng int64
+	for i := 0; i < len(polyline); {
+		dLat, n, err := decodeValue(polyline[i:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid polyline at offset %d: %v", i, err)
+		}
+		i += n
+		dLng, n, err := decodeValue(polyline[i:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid polyline at offset %d: %v", i, err)
+		}
+		i += n
+		lat += dLat
+		lng += dLng
+		points = append(points, LatLng{float64(lat) / 1e5, float64(lng) / 1e5})
+	}
+	return points, nil
+}
+
+// decodeValue decodes one value from the start of s, returning it and the
+// number of bytes it used
+func decodeValue(s string) (int64, int, error) {
+	var v int64
+	for i := 0; i < len(s); i++ {
+		c := int64(s[i]) - 63
+		if c < 0 || c > 0x3f {
+			return 0, 0, fmt.Errorf("unexpected character %q", s[i])
+		}
+		if i >= 12 {
+			return 0, 0, fmt.Errorf("value too long")
+		}
+		v |= (c & 0x1f) << (5 * uint(i))
+		if c < 0x20 {
+			if v&1 != 0 {
+				return ^(v >> 1), i + 1, nil
+			}
+			return v >> 1, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("truncated value")
+}
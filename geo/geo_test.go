@@ -0,0 +1,246 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+// Google's example from the polyline format documentation
+const examplePolyline = "_p~iF~ps|U_ulLnnqC_mqNvxq`@"
+
+var examplePoints = []LatLng{{38.5, -120.2}, {40.7, -120.95}, {43.252, -126.453}}
+
+func TestDecode(t *testing.T) {
+	points, err := Decode(examplePolyline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != len(examplePoints) {
+		t.Fatalf("expected %d points, got %d", len(examplePoints), len(points))
+	}
+	for i, p := range points {
+		if math.Abs(p[0]-examplePoints[i][0]) > 1e-9 || math.Abs(p[1]-examplePoints[i][1]) > 1e-9 {
+			t.Errorf("point %d: expected %v, got %v", i, examplePoints[i], p)
+		}
+	}
+
+	if Encode(points) != examplePolyline {
+		t.Errorf("expected decoding and encoding to round trip, got %q", Encode(points))
+	}
+
+	if points, err := Decode(""); err != nil || len(points) != 0 {
+		t.Errorf("expected no points for an empty polyline, got %v, %v", points, err)
+	}
+	for _, bad := range []string{"_p~iF~ps|U_", "_p~iF ps|U", "_p~iF"} {
+		if _, err := Decode(bad); err == nil {
+			t.Errorf("expected an error decoding %q", bad)
+		}
+	}
+}
+
+// offset returns the point the given number of meters east and north of
+// origin
+func offset(origin LatLng, east, north float64) LatLng {
+	return LatLng{
+		origin[0] + north/earthRadius*180/math.Pi,
+		origin[1] + east/(earthRadius*math.Cos(radians(origin[0])))*180/math.Pi,
+	}
+}
+
+var boston = LatLng{42.3601, -71.0589}
+
+// path returns a route through the given (east, north) offsets from
+// boston, with a point every 10 meters
+func path(corners ...[2]float64) Route {
+	route := Route{offset(boston, corners[0][0], corners[0][1])}
+	for i := 1; i < len(corners); i++ {
+		a, b := corners[i-1], corners[i]
+		n := int(math.Ceil(math.Hypot(b[0]-a[0], b[1]-a[1]) / 10))
+		for k := 1; k <= n; k++ {
+			t := float64(k) / float64(n)
+			route = append(route, offset(boston, a[0]+t*(b[0]-a[0]), a[1]+t*(b[1]-a[1])))
+		}
+	}
+	return route
+}
+
+func TestDistance(t *testing.T) {
+	// A degree of latitude is about 111.2 km
+	if d := Distance(LatLng{42, -71}, LatLng{43, -71}); math.Abs(d-111195) > 10 {
+		t.Errorf("expected a degree of latitude to be 111195 m, got %.0f", d)
+	}
+	if d := Distance(boston, offset(boston, 300, 400)); math.Abs(d-500) > 0.5 {
+		t.Errorf("expected 500 m, got %.2f", d)
+	}
+	if d := path([2]float64{0, 0}, [2]float64{1000, 0}, [2]float64{1000, 1000}).Length(); math.Abs(d-2000) > 1 {
+		t.Errorf("expected a 2000 m route, got %.2f", d)
+	}
+}
+
+func TestBoundsAndCentroid(t *testing.T) {
+	route := Route{{42.1, -71.3}, {42.5, -71.1}, {42.3, -70.9}}
+	b := route.Bounds()
+	if b.Min != (LatLng{42.1, -71.3}) || b.Max != (LatLng{42.5, -70.9}) {
+		t.Errorf("unexpected bounds %+v", b)
+	}
+	if c := b.Center(); math.Abs(c[0]-42.3) > 1e-9 || math.Abs(c[1]+71.1) > 1e-9 {
+		t.Errorf("unexpected center %v", c)
+	}
+	if !b.Contains(LatLng{42.2, -71}) || b.Contains(LatLng{42.2, -70}) {
+		t.Error("unexpected Contains")
+	}
+	if !Route(nil).Bounds().IsEmpty() {
+		t.Error("expected an empty route to have empty bounds")
+	}
+	if u := b.Union(BoundingBox{}); u != b {
+		t.Errorf("expected a union with an empty box to be the same box, got %+v", u)
+	}
+
+	if c := (Route{{10, 179}, {10, -179}}).Centroid(); math.Abs(math.Abs(c[1])-180) > 1e-9 || math.Abs(c[0]-10) > 0.01 {
+		t.Errorf("expected the centroid across the antimeridian to be on it, got %v", c)
+	}
+	if c := path([2]float64{-500, -500}, [2]float64{500, 500}).Centroid(); Distance(c, boston) > 1 {
+		t.Errorf("expected the centroid of a symmetric route to be its middle, got %v", c)
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	// An L with a few meters of GPS wobble on each leg
+	route := path([2]float64{0, 0}, [2]float64{500, 3}, [2]float64{1000, 0}, [2]float64{1000, 1000})
+	simplified := route.Simplify(10)
+	if len(simplified) != 3 {
+		t.Fatalf("expected the start, corner and end, got %d points", len(simplified))
+	}
+	if Distance(simplified[1], offset(boston, 1000, 0)) > 1 {
+		t.Errorf("expected the corner to be kept, got %v", simplified[1])
+	}
+	if len(route.Simplify(1)) != 4 {
+		t.Errorf("expected a tight tolerance to keep the wobble, got %d points", len(route.Simplify(1)))
+	}
+}
+
+func TestResample(t *testing.T) {
+	route := path([2]float64{0, 0}, [2]float64{1000, 0}, [2]float64{1000, 1000})
+	resampled := route.Resample(5)
+	if len(resampled) != 5 || resampled.Start() != route.Start() || resampled.End() != route.End() {
+		t.Fatalf("expected 5 points from start to end, got %v", resampled)
+	}
+	for i := 1; i < len(resampled); i++ {
+		if d := Distance(resampled[i-1], resampled[i]); math.Abs(d-500) > 1 {
+			t.Errorf("expected points 500 m apart, got %.2f", d)
+		}
+	}
+}
+
+func TestShape(t *testing.T) {
+	// 10 laps of a 400 m circle, which repeat the route rather than retrace it
+	var track Route
+	for lap := 0; lap < 10; lap++ {
+		for i := 0; i < 40; i++ {
+			angle := 2 * math.Pi * float64(i) / 40
+			track = append(track, offset(boston, 63.66*math.Sin(angle), 63.66*(1-math.Cos(angle))))
+		}
+	}
+	track = append(track, track[0])
+
+	for _, test := range []struct {
+		name  string
+		route Route
+		shape Shape
+	}{
+		{"out and back", path([2]float64{0, 0}, [2]float64{2500, 0}, [2]float64{2500, 15}, [2]float64{0, 15}), OutAndBack},
+		{"out and back with a turn", path([2]float64{0, 0}, [2]float64{2000, 0}, [2]float64{2000, 2000}, [2]float64{2020, 2000}, [2]float64{2020, 0}, [2]float64{0, 0}), OutAndBack},
+		{"loop", path([2]float64{0, 0}, [2]float64{1250, 0}, [2]float64{1250, 1250}, [2]float64{0, 1250}, [2]float64{0, 0}), Loop},
+		{"track", track, Loop},
+		{"lollipop", path([2]float64{0, 0}, [2]float64{1000, 0}, [2]float64{1000, 1500}, [2]float64{3000, 1500}, [2]float64{3000, 0}, [2]float64{1000, 0}, [2]float64{0, 0}), Loop},
+		{"point to point", path([2]float64{0, 0}, [2]float64{5000, 2000}), PointToPoint},
+		{"too short", path([2]float64{0, 0}, [2]float64{50, 0}, [2]float64{0, 0}), UnknownShape},
+	} {
+		if shape := test.route.Shape(); shape != test.shape {
+			t.Errorf("%s: expected %s, got %s", test.name, test.shape, shape)
+		}
+	}
+}
+
+func TestMercator(t *testing.T) {
+	if x, y := Mercator(LatLng{0, 0}); x != 0.5 || y != 0.5 {
+		t.Errorf("expected null island in the middle of the world, got %f, %f", x, y)
+	}
+	// Boston is in tile 4958/6059 at zoom 14
+	x, y := Mercator(boston)
+	if tx, ty := int(x*(1<<14)), int(y*(1<<14)); tx != 4958 || ty != 6059 {
+		t.Errorf("expected tile 4958/6059, got %d/%d", tx, ty)
+	}
+	if p := InverseMercator(x, y); Distance(p, boston) > 0.01 {
+		t.Errorf("expected the inverse to round trip, got %v", p)
+	}
+}
+
+func TestFitViewport(t *testing.T) {
+	route := path([2]float64{0, 0}, [2]float64{2000, 0}, [2]float64{2000, 1000})
+	v := FitViewport(route.Bounds(), 400, 400, 20)
+	x0, y0 := v.Pixel(route.Start())
+	x1, y1 := v.Pixel(route.End())
+	// 2 km wide by 1 km high, so the width fills the 360 pixels inside the
+	// padding and the height is centered
+	if math.Abs(x0-20) > 0.01 || math.Abs(x1-380) > 0.01 || math.Abs(y0-290) > 0.01 || math.Abs(y1-110) > 0.01 {
+		t.Errorf("unexpected fit: start at %.2f,%.2f and end at %.2f,%.2f", x0, y0, x1, y1)
+	}
+	if p := v.LatLng(x1, y1); Distance(p, route.End()) > 0.01 {
+		t.Errorf("expected pixels to map back to the same point, got %v", p)
+	}
+	if m := v.MetersPerPixel(boston[0]); math.Abs(m-2000.0/360) > 0.01 {
+		t.Errorf("expected %.3f m per pixel, got %.3f", 2000.0/360, m)
+	}
+}
+
+func TestHeatmap(t *testing.T) {
+	street := path([2]float64{0, 0}, [2]float64{1000, 0})
+	// The same street, back and forth five times, counts once
+	var repeats Route
+	for i := 0; i < 5; i++ {
+		repeats = append(repeats, street...)
+		repeats = append(repeats, street[len(street)-1], street[0])
+	}
+	elsewhere := path([2]float64{0, 500}, [2]float64{1000, 500})
+
+	h := NewHeatmap(FitViewport(path([2]float64{0, 0}, [2]float64{1000, 500}).Bounds(), 110, 60, 5))
+	h.Add(street)
+	h.Add(repeats)
+	h.Add(elsewhere)
+	if h.Routes() != 3 || h.Max() != 2 {
+		t.Fatalf("expected 3 routes and at most 2 through a pixel, got %d and %d", h.Routes(), h.Max())
+	}
+	x, y := h.Pixel(offset(boston, 500, 0))
+	if c := h.Count(int(x), int(y)); c != 2 {
+		t.Errorf("expected the street to be counted twice, got %d", c)
+	}
+	x, y = h.Pixel(offset(boston, 500, 500))
+	if c := h.Count(int(x), int(y)); c != 1 {
+		t.Errorf("expected the other street to be counted once, got %d", c)
+	}
+	x, y = h.Pixel(offset(boston, 500, 250))
+	if c := h.Count(int(x), int(y)); c != 0 {
+		t.Errorf("expected nothing between the streets, got %d", c)
+	}
+
+	hot := h.HotSegments(2)
+	if len(hot) != 1 || hot[0].Count != 2 {
+		t.Fatalf("expected one hot segment followed by 2 routes, got %+v", hot)
+	}
+	meters := h.MetersPerPixel(boston[0])
+	if len(hot[0].Route) != 2 || math.Abs(hot[0].Route.Length()-1000) > 2*meters {
+		t.Errorf("expected the hot segment to be the street, got %v", hot[0].Route)
+	}
+	if all := h.HotSegments(1); len(all) != 2 {
+		t.Errorf("expected both streets to be hot with a count of 1, got %d segments", len(all))
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	offsets := path([2]float64{0, 0}, [2]float64{300, 0}, [2]float64{300, 400}).Offsets()
+	last := offsets[len(offsets)-1]
+	if offsets[0] != [2]float64{0, 0} || math.Abs(last[0]-300) > 0.5 || math.Abs(last[1]-400) > 0.5 {
+		t.Errorf("expected offsets from (0, 0) to (300, 400), got %v to %v", offsets[0], last)
+	}
+}
@@ -0,0 +1,187 @@
+package geo
+
+import (
+	"math"
+	"sort"
+)
+
+// Heatmap counts how many routes pass through each pixel of a viewport.  A
+// route counts once per pixel however often it passes, so ten laps of a
+// track weigh the same as one run along a street.
+type Heatmap struct {
+	Viewport
+	counts []int
+	seen   []int // the last route counted in each pixel
+	routes int
+	// edges counts the routes stepping between two neighbouring pixels,
+	// keyed on the pixels' indexes, lowest first
+	edges map[[2]int]int
+}
+
+func NewHeatmap(viewport Viewport) *Heatmap {
+	n := viewport.Width * viewport.Height
+	return &Heatmap{
+		Viewport: viewport,
+		counts:   make([]int, n),
+		seen:     make([]int, n),
+		edges:    map[[2]int]int{},
+	}
+}
+
+// Add counts a route in every pixel its path crosses.  The parts outside the
+// viewport are ignored.
+func (h *Heatmap) Add(route Route) {
+	h.routes++
+	stepped := map[[2]int]bool{}
+	previous := -1
+	visit := func(x, y float64) {
+		if x < 0 || y < 0 || x >= float64(h.Width) || y >= float64(h.Height) {
+			previous = -1
+			return
+		}
+		pixel := int(y)*h.Width + int(x)
+		if pixel == previous {
+			return
+		}
+		if h.seen[pixel] != h.routes {
+			h.seen[pixel] = h.routes
+			h.counts[pixel]++
+		}
+		if previous >= 0 {
+			edge := [2]int{previous, pixel}
+			if pixel < previous {
+				edge = [2]int{pixel, previous}
+			}
+			if !stepped[edge] {
+				stepped[edge] = true
+				h.edges[edge]++
+			}
+		}
+		previous = pixel
+	}
+
+	for i, p := range route {
+		x, y := h.Pixel(p)
+		if i == 0 {
+			visit(x, y)
+			continue
+		}
+		// Step at most a pixel at a time so consecutive pixels are neighbours
+		px, py := h.Pixel(route[i-1])
+		steps := math.Ceil(math.Max(math.Abs(x-px), math.Abs(y-py)))
+		for s := 1.0; s <= steps; s++ {
+			visit(px+(x-px)*s/steps, py+(y-py)*s/steps)
+		}
+	}
+}
+
+// Routes is the number of routes added
+func (h *Heatmap) Routes() int {
+	return h.routes
+}
+
+// Count is the number of routes through pixel (x, y)
+func (h *Heatmap) Count(x, y int) int {
+	if x < 0 || y < 0 || x >= h.Width || y >= h.Height {
+		return 0
+	}
+	return h.counts[y*h.Width+x]
+}
+
+// Max is the highest count of any pixel
+func (h *Heatmap) Max() int {
+	max := 0
+	for _, c := range h.counts {
+		if c > max {
+			max = c
+		}
+	}
+	return max
+}
+
+// HotSegment is a stretch of path that Count routes follow
+type HotSegment struct {
+	Route Route
+	Count int
+}
+
+// HotSegments returns the paths followed by at least minCount routes,
+// longest first.  Steps between pixels are joined into a segment for as long
+// as the path doesn't branch and the same number of routes follow it, then
+// simplified to within a pixel.
+func (h *Heatmap) HotSegments(minCount int) []HotSegment {
+	neighbours := map[int][]int{}
+	for edge, count := range h.edges {
+		if count >= minCount {
+			neighbours[edge[0]] = append(neighbours[edge[0]], edge[1])
+			neighbours[edge[1]] = append(neighbours[edge[1]], edge[0])
+		}
+	}
+	count := func(a, b int) int {
+		if b < a {
+			a, b = b, a
+		}
+		return h.edges[[2]int{a, b}]
+	}
+	// Segments end where the path branches, stops or changes count
+	isEnd := func(pixel int) bool {
+		n := neighbours[pixel]
+		return len(n) != 2 || count(pixel, n[0]) != count(pixel, n[1])
+	}
+
+	pixels := make([]int, 0, len(neighbours))
+	for pixel := range neighbours {
+		sort.Ints(neighbours[pixel])
+		pixels = append(pixels, pixel)
+	}
+	sort.Ints(pixels)
+
+	var segments []HotSegment
+	walked := map[[2]int]bool{}
+	walk := func(from, to int) {
+		c := count(from, to)
+		path := []int{from}
+		for {
+			walked[[2]int{from, to}], walked[[2]int{to, from}] = true, true
+			path = append(path, to)
+			if isEnd(to) {
+				break
+			}
+			next := neighbours[to][0]
+			if next == from {
+				next = neighbours[to][1]
+			}
+			if walked[[2]int{to, next}] {
+				break // around a loop
+			}
+			from, to = to, next
+		}
+
+		route := make(Route, len(path))
+		for i, pixel := range path {
+			route[i] = h.LatLng(float64(pixel%h.Width)+0.5, float64(pixel/h.Width)+0.5)
+		}
+		segments = append(segments, HotSegment{
+			Route: route.Simplify(h.MetersPerPixel(route[0][0])),
+			Count: c,
+		})
+	}
+	// Walk from the ends first, then whatever is left is loops
+	for _, loops := range []bool{false, true} {
+		for _, pixel := range pixels {
+			if isEnd(pixel) == loops {
+				continue
+			}
+			for _, next := range neighbours[pixel] {
+				if !walked[[2]int{pixel, next}] {
+					walk(pixel, next)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(segments, func(i, j int) bool {
+		return segments[i].Route.Length() > segments[j].Route.Length()
+	})
+	return segments
+}
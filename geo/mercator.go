@@ -0,0 +1,72 @@
+package geo
+
+import "math"
+
+// maxMercatorLatitude is where Web Mercator is cut off so the world is
+// square
+const maxMercatorLatitude = 85.05112878
+
+// Mercator projects a point with Web Mercator, the projection of web map
+// tiles.  x and y are in [0, 1], from the north west corner of the world;
+// at zoom level z, tile (x, y) covers [x, x+1) / 2^z by [y, y+1) / 2^z.
+func Mercator(p LatLng) (x, y float64) {
+	lat := math.Max(-maxMercatorLatitude, math.Min(maxMercatorLatitude, p[0]))
+	sin := math.Sin(radians(lat))
+	x = (p[1] + 180) / 360
+	y = 0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)
+	return x, y
+}
+
+// InverseMercator is the point projected to x and y by Mercator
+func InverseMercator(x, y float64) LatLng {
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*y))) * 180 / math.Pi
+	return LatLng{lat, x*360 - 180}
+}
+
+// minViewportSpan is the smallest span, in Web Mercator units, a Viewport
+// shows, so a route that barely moves (a treadmill with GPS on) isn't scaled
+// up to fill it.  It's about 150 m at the equator.
+const minViewportSpan = 4e-6
+
+// Viewport places Web Mercator on a raster of pixels
+type Viewport struct {
+	Width   int
+	Height  int
+	Scale   float64 // pixels per Mercator unit (the width of the world)
+	OffsetX float64 // pixel position of Mercator x = 0
+	OffsetY float64 // pixel position of Mercator y = 0
+}
+
+// FitViewport returns the viewport of the given size that shows the bounds
+// as large as fits inside the padding, centered
+func FitViewport(bounds BoundingBox, width, height, padding int) Viewport {
+	minX, maxY := Mercator(bounds.Min)
+	maxX, minY := Mercator(bounds.Max)
+	scale := math.Min(
+		float64(width-2*padding)/math.Max(maxX-minX, minViewportSpan),
+		float64(height-2*padding)/math.Max(maxY-minY, minViewportSpan),
+	)
+	return Viewport{
+		Width:   width,
+		Height:  height,
+		Scale:   scale,
+		OffsetX: float64(width)/2 - (minX+maxX)/2*scale,
+		OffsetY: float64(height)/2 - (minY+maxY)/2*scale,
+	}
+}
+
+// Pixel is where p is in the viewport, in pixels from its top left corner
+func (v Viewport) Pixel(p LatLng) (x, y float64) {
+	x, y = Mercator(p)
+	return x*v.Scale + v.OffsetX, y*v.Scale + v.OffsetY
+}
+
+// LatLng is the point at a pixel position in the viewport
+func (v Viewport) LatLng(x, y float64) LatLng {
+	return InverseMercator((x-v.OffsetX)/v.Scale, (y-v.OffsetY)/v.Scale)
+}
+
+// MetersPerPixel is the ground width of a pixel at latitude lat
+func (v Viewport) MetersPerPixel(lat float64) float64 {
+	return 2 * math.Pi * earthRadius * math.Cos(radians(lat)) / v.Scale
+}
@@ -0,0 +1,278 @@
+package geo
+
+import "math"
+
+// Route is the points of an activity's route, in order
+type Route []LatLng
+
+// Start is the first point of the route, or the zero LatLng if it's empty
+func (r Route) Start() LatLng {
+	if len(r) == 0 {
+		return LatLng{}
+	}
+	return r[0]
+}
+
+// End is the last point of the route, or the zero LatLng if it's empty
+func (r Route) End() LatLng {
+	if len(r) == 0 {
+		return LatLng{}
+	}
+	return r[len(r)-1]
+}
+
+// Length is the distance along the route in meters
+func (r Route) Length() float64 {
+	length := 0.0
+	for i := 1; i < len(r); i++ {
+		length += Distance(r[i-1], r[i])
+	}
+	return length
+}
+
+// BoundingBox is the smallest latitude/longitude box containing a set of
+// points.  The zero value is empty.  Boxes don't wrap around the
+// antimeridian.
+type BoundingBox struct {
+	Min LatLng // south west corner
+	Max LatLng // north east corner
+}
+
+func (b BoundingBox) IsEmpty() bool {
+	return b == BoundingBox{}
+}
+
+// Center is the middle of the box
+func (b BoundingBox) Center() LatLng {
+	return LatLng{(b.Min[0] + b.Max[0]) / 2, (b.Min[1] + b.Max[1]) / 2}
+}
+
+func (b BoundingBox) Contains(p LatLng) bool {
+	return !b.IsEmpty() && p[0] >= b.Min[0] && p[0] <= b.Max[0] && p[1] >= b.Min[1] && p[1] <= b.Max[1]
+}
+
+// Extend returns the box grown to contain p
+func (b BoundingBox) Extend(p LatLng) BoundingBox {
+	if b.IsEmpty() {
+		return BoundingBox{p, p}
+	}
+	return BoundingBox{
+		Min: LatLng{math.Min(b.Min[0], p[0]), math.Min(b.Min[1], p[1])},
+		Max: LatLng{math.Max(b.Max[0], p[0]), math.Max(b.Max[1], p[1])},
+	}
+}
+
+// Union returns the smallest box containing both boxes
+func (b BoundingBox) Union(other BoundingBox) BoundingBox {
+	if other.IsEmpty() {
+		return b
+	}
+	return b.Extend(other.Min).Extend(other.Max)
+}
+
+// Bounds is the bounding box of the route
+func (r Route) Bounds() BoundingBox {
+	var b BoundingBox
+	for _, p := range r {
+		b = b.Extend(p)
+	}
+	return b
+}
+
+// Centroid is the mean position of the route's points, averaged on the
+// sphere rather than in degrees so it's right near the poles and the
+// antimeridian too
+func (r Route) Centroid() LatLng {
+	if len(r) == 0 {
+		return LatLng{}
+	}
+	var x, y, z float64
+	for _, p := range r {
+		lat, lng := radians(p[0]), radians(p[1])
+		x += math.Cos(lat) * math.Cos(lng)
+		y += math.Cos(lat) * math.Sin(lng)
+		z += math.Sin(lat)
+	}
+	lat := math.Atan2(z, math.Hypot(x, y))
+	lng := math.Atan2(y, x)
+	return LatLng{lat * 180 / math.Pi, lng * 180 / math.Pi}
+}
+
+// Simplify drops points using the Douglas-Peucker algorithm, keeping the
+// start and end and every point needed so the simplified route stays
+// within tolerance meters of the original
+func (r Route) Simplify(tolerance float64) Route {
+	if len(r) < 3 {
+		return append(Route{}, r...)
+	}
+
+	keep := make([]bool, len(r))
+	keep[0], keep[len(r)-1] = true, true
+	stack := [][2]int{{0, len(r) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+
+		farthest, max := 0, 0.0
+		for i := first + 1; i < last; i++ {
+			if d := segmentDistance(r[i], r[first], r[last]); d > max {
+				farthest, max = i, d
+			}
+		}
+		if max > tolerance {
+			keep[farthest] = true
+			stack = append(stack, [2]int{first, farthest}, [2]int{farthest, last})
+		}
+	}
+
+	simplified := Route{}
+	for i, p := range r {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+// segmentDistance is the distance in meters from p to the segment from a
+// to b, on a plane tangent to the Earth at a.  That's accurate to well
+// under a meter over the length of a run's segments.
+func segmentDistance(p, a, b LatLng) float64 {
+	scale := math.Cos(radians(a[0]))
+	project := func(q LatLng) (float64, float64) {
+		return radians(q[1]-a[1]) * scale * earthRadius, radians(q[0]-a[0]) * earthRadius
+	}
+	px, py := project(p)
+	bx, by := project(b)
+
+	t := 0.0
+	if lengthSquared := bx*bx + by*by; lengthSquared > 0 {
+		t = math.Max(0, math.Min(1, (px*bx+py*by)/lengthSquared))
+	}
+	return math.Hypot(px-t*bx, py-t*by)
+}
+
+// Offsets are the route's points as meters east and north of its start, on a
+// plane tangent to the Earth there, so routes from anywhere can be drawn
+// from a common origin
+func (r Route) Offsets() [][2]float64 {
+	offsets := make([][2]float64, len(r))
+	if len(r) == 0 {
+		return offsets
+	}
+	scale := math.Cos(radians(r[0][0]))
+	for i, p := range r {
+		offsets[i] = [2]float64{
+			radians(p[1]-r[0][1]) * scale * earthRadius,
+			radians(p[0]-r[0][0]) * earthRadius,
+		}
+	}
+	return offsets
+}
+
+// Resample returns n points spaced evenly along the route, including its
+// start and end.  Routes of fewer than two points are returned as they are.
+func (r Route) Resample(n int) Route {
+	if len(r) < 2 || n < 2 {
+		return append(Route{}, r...)
+	}
+	length := r.Length()
+	resampled := Route{r[0]}
+	i, traveled := 1, 0.0 // traveled is the distance to r[i-1]
+	for k := 1; k < n-1; k++ {
+		target := length * float64(k) / float64(n-1)
+		for i < len(r)-1 && traveled+Distance(r[i-1], r[i]) < target {
+			traveled += Distance(r[i-1], r[i])
+			i++
+		}
+		segment := Distance(r[i-1], r[i])
+		t := 0.0
+		if segment > 0 {
+			t = math.Min(1, (target-traveled)/segment)
+		}
+		resampled = append(resampled, LatLng{
+			r[i-1][0] + t*(r[i][0]-r[i-1][0]),
+			r[i-1][1] + t*(r[i][1]-r[i-1][1]),
+		})
+	}
+	return append(resampled, r[len(r)-1])
+}
+
+// Shape is the overall form of a route
+type Shape int
+
+const (
+	UnknownShape Shape = iota // too short to tell
+	PointToPoint              // ends away from the start
+	Loop                      // ends back at the start
+	OutAndBack                // ends back at the start, retracing the way out
+)
+
+func (s Shape) String() string {
+	switch s {
+	case PointToPoint:
+		return "point to point"
+	case Loop:
+		return "loop"
+	case OutAndBack:
+		return "out and back"
+	}
+	return "unknown"
+}
+
+// Thresholds for classifying routes
+const (
+	minShapeLength   = 200.0 // meters; shorter routes are UnknownShape
+	closedDistance   = 250.0 // meters between start and end for a loop...
+	closedFraction   = 0.05  // ...or this fraction of the length, if larger
+	shapeSamples     = 100
+	gpsNoise         = 50.0 // meters two passes over the same path may differ by
+	retracedFraction = 0.8  // of the way back that must follow the way out
+	reversedFraction = 0.8  // of the way back that must follow it backwards
+)
+
+// Shape classifies the route.  A route that ends near its start is a loop
+// unless most of the second half retraces the first half in reverse, as
+// opposed to repeating it (laps of a track) or taking a different way back.
+func (r Route) Shape() Shape {
+	length := r.Length()
+	if len(r) < 2 || length < minShapeLength {
+		return UnknownShape
+	}
+	if Distance(r.Start(), r.End()) > math.Max(closedDistance, closedFraction*length) {
+		return PointToPoint
+	}
+
+	samples := r.Resample(shapeSamples)
+	out, back := samples[:shapeSamples/2], samples[shapeSamples/2:]
+	// The nearest sample on the same path is at most half the spacing away
+	tolerance := gpsNoise + length/float64(shapeSamples-1)/2
+
+	retraced, reversed, pairs := 0, 0, 0
+	previous := -1
+	for _, p := range back {
+		nearest, distance := 0, math.Inf(1)
+		for i, q := range out {
+			if d := Distance(p, q); d < distance {
+				nearest, distance = i, d
+			}
+		}
+		if distance > tolerance {
+			previous = -1
+			continue
+		}
+		retraced++
+		if previous >= 0 {
+			pairs++
+			if nearest <= previous {
+				reversed++
+			}
+		}
+		previous = nearest
+	}
+
+	if float64(retraced) >= retracedFraction*float64(len(back)) && pairs > 0 && float64(reversed) >= reversedFraction*float64(pairs) {
+		return OutAndBack
+	}
+	return Loop
+}
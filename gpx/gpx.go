@@ -0,0 +1,198 @@
+// Package gpx reads and writes GPX 1.1 tracks, including the heart rate and
+// cadence of Garmin's TrackPointExtension.  Importing the package registers
+// its decoder for ".gpx" files with strava.DecodeFile.
+package gpx
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func init() {
+	strava.RegisterFileDecoder(".gpx", Decode)
+}
+
+// Element names are matched without their namespace, so both the GPX 1.1
+// and the gpxtpx (TrackPointExtension v1 and v2) elements are found
+// whatever prefix the file uses
+type gpxFile struct {
+	Creator  string `xml:"creator,attr"`
+	Metadata struct {
+		Name string `xml:"name"`
+	} `xml:"metadata"`
+	Tracks []track `xml:"trk"`
+}
+
+type track struct {
+	Name        string    `xml:"name"`
+	Description string    `xml:"desc"`
+	Type        string    `xml:"type"`
+	Segments    []segment `xml:"trkseg"`
+}
+
+type segment struct {
+	Points []trackPoint `xml:"trkpt"`
+}
+
+type trackPoint struct {
+	Lat       float64   `xml:"lat,attr"`
+	Lon       float64   `xml:"lon,attr"`
+	Elevation *float64  `xml:"ele"`
+	Time      time.Time `xml:"time"`
+	Heartrate *int32    `xml:"extensions>TrackPointExtension>hr"`
+	Cadence   *int32    `xml:"extensions>TrackPointExtension>cad"`
+}
+
+// activityTypes maps the <type> of a track to a Strava activity type.
+// Strava's own GPX export uses the numeric codes.
+var activityTypes = map[string]string{
+	"running": "Run",
+	"run":     "Run",
+	"9":       "Run",
+	"cycling": "Ride",
+	"biking":  "Ride",
+	"ride":    "Ride",
+	"1":       "Ride",
+	"walking": "Walk",
+	"walk":    "Walk",
+	"10":      "Walk",
+	"hiking":  "Hike",
+	"hike":    "Hike",
+	"4":       "Hike",
+}
+
+// Decode reads the tracks of a GPX file as a single activity.  Every track
+// point must have a time; segments and tracks are joined in order.  The
+// start time is in UTC, since GPX doesn't record the local time zone.
+func Decode(r io.Reader) (*strava.ActivityFile, error) {
+	var doc gpxFile
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	var points []trackPoint
+	for _, t := range doc.Tracks {
+		for _, s := range t.Segments {
+			points = append(points, s.Points...)
+		}
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("no track points")
+	}
+
+	file := &strava.ActivityFile{Streams: &strava.Streams{}}
+	a := &file.Activity
+	a.Type = "Run"
+	if len(doc.Tracks) > 0 {
+		a.Name = doc.Tracks[0].Name
+		a.Description = doc.Tracks[0].Description
+		if activityType, ok := activityTypes[strings.ToLower(strings.TrimSpace(doc.Tracks[0].Type))]; ok {
+			a.Type = activityType
+		}
+	}
+	if a.Name == "" {
+		a.Name = doc.Metadata.Name
+	}
+	if !strings.HasPrefix(doc.Creator, "StravaGPX") {
+		a.DeviceName = doc.Creator
+	}
+
+	start := points[0].Time
+	a.DateString = start.UTC().Format("2006-01-02T15:04:05Z")
+
+	s := file.Streams
+	hasElevation, hasHeartrate, hasCadence := false, false, false
+	for _, p := range points {
+		hasElevation = hasElevation || p.Elevation != nil
+		hasHeartrate = hasHeartrate || p.Heartrate != nil
+		hasCadence = hasCadence || p.Cadence != nil
+	}
+
+	// A point missing a value (e.g. a heart rate dropout) repeats the
+	// previous one, so every stream has one entry per point
+	var elevation float64
+	var heartrate, cadence int32
+	for i, p := range points {
+		if p.Time.IsZero() {
+			return nil, fmt.Errorf("track point %d has no time", i+1)
+		}
+		s.Time = append(s.Time, int32(p.Time.Sub(start).Seconds()))
+		s.LatLng = append(s.LatLng, [2]float64{p.Lat, p.Lon})
+		if hasElevation {
+			if p.Elevation != nil {
+				elevation = *p.Elevation
+			}
+			s.Altitude = append(s.Altitude, elevation)
+		}
+		if hasHeartrate {
+			if p.Heartrate != nil {
+				heartrate = *p.Heartrate
+			}
+			s.Heartrate = append(s.Heartrate, heartrate)
+		}
+		if hasCadence {
+			if p.Cadence != nil {
+				cadence = *p.Cadence
+			}
+			s.Cadence = append(s.Cadence, cadence)
+		}
+	}
+
+	file.Summarize()
+	return file, nil
+}
+
+// Encode writes an activity's streams as a GPX 1.1 track, timed in UTC from
+// the activity's StartTime.  The streams must include the route; laps
+// aren't part of GPX and are ignored.
+func Encode(w io.Writer, file *strava.ActivityFile) error {
+	activity, streams := file.Activity, file.Streams
+	if streams == nil || len(streams.LatLng) == 0 {
+		return fmt.Errorf("activity %d has no GPS data", activity.Id)
+	}
+	start := activity.StartTime()
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "%s\n", xml.Header[:len(xml.Header)-1])
+	fmt.Fprintf(b, `<gpx version="1.1" creator="running" xmlns="http://www.topografix.com/GPX/1/1" `+
+		`xmlns:gpxtpx="http://www.garmin.com/xmlschemas/TrackPointExtension/v1">`+"\n")
+	fmt.Fprintf(b, "  <metadata>\n    <time>%s</time>\n  </metadata>\n", start.Format(time.RFC3339))
+	fmt.Fprintf(b, "  <trk>\n    <name>%s</name>\n    <type>%s</type>\n    <trkseg>\n", escape(activity.Name), escape(strings.ToLower(activity.Type)))
+
+	for i, latlng := range streams.LatLng {
+		fmt.Fprintf(b, `      <trkpt lat="%.7f" lon="%.7f">`+"\n", latlng[0], latlng[1])
+		if i < len(streams.Altitude) {
+			fmt.Fprintf(b, "        <ele>%.1f</ele>\n", streams.Altitude[i])
+		}
+		if i < len(streams.Time) {
+			t := start.Add(time.Duration(streams.Time[i]) * time.Second)
+			fmt.Fprintf(b, "        <time>%s</time>\n", t.Format(time.RFC3339))
+		}
+		if i < len(streams.Heartrate) || i < len(streams.Cadence) {
+			fmt.Fprintf(b, "        <extensions>\n          <gpxtpx:TrackPointExtension>\n")
+			if i < len(streams.Heartrate) {
+				fmt.Fprintf(b, "            <gpxtpx:hr>%d</gpxtpx:hr>\n", streams.Heartrate[i])
+			}
+			if i < len(streams.Cadence) {
+				fmt.Fprintf(b, "            <gpxtpx:cad>%d</gpxtpx:cad>\n", streams.Cadence[i])
+			}
+			fmt.Fprintf(b, "          </gpxtpx:TrackPointExtension>\n        </extensions>\n")
+		}
+		fmt.Fprintf(b, "      </trkpt>\n")
+	}
+
+	fmt.Fprintf(b, "    </trkseg>\n  </trk>\n</gpx>\n")
+	return b.Flush()
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
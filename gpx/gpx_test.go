@@ -0,0 +1,111 @@
+package gpx_test
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/scottfrazer/running/gpx"
+	"github.com/scottfrazer/running/strava"
+)
+
+func decodeFixture(t *testing.T, name string) *strava.ActivityFile {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	file, err := gpx.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDecode(t *testing.T) {
+	file := decodeFixture(t, "run.gpx")
+
+	a := file.Activity
+	if a.Name != "Reservoir strides" || a.Description != "Four strides on the dam" || a.Type != "Run" || a.DeviceName != "Garmin Connect" {
+		t.Errorf("unexpected activity: %+v", a.SummaryActivity)
+	}
+	if a.DateString != "2022-05-03T10:15:00Z" || a.ElapsedTime != 30 || a.Map.Polyline == "" {
+		t.Errorf("unexpected summary: start=%s elapsed=%v polyline=%q", a.DateString, a.ElapsedTime, a.Map.Polyline)
+	}
+	if a.Distance < 99 || a.Distance > 101 {
+		t.Errorf("expected about 100 m from the route, got %v", a.Distance)
+	}
+
+	// Segments are joined, and the missing heart rate repeats the one before
+	s := file.Streams
+	want := &strava.Streams{
+		Time:      []int32{0, 10, 20, 30},
+		LatLng:    [][2]float64{{42.33, -71.15}, {42.3303, -71.15}, {42.3306, -71.15}, {42.3309, -71.15}},
+		Altitude:  []float64{40.2, 40.8, 41.4, 41.0},
+		Heartrate: []int32{124, 131, 131, 140},
+		Cadence:   []int32{84, 86, 87, 88},
+	}
+	if !reflect.DeepEqual(s.Time, want.Time) || !reflect.DeepEqual(s.LatLng, want.LatLng) || !reflect.DeepEqual(s.Altitude, want.Altitude) ||
+		!reflect.DeepEqual(s.Heartrate, want.Heartrate) || !reflect.DeepEqual(s.Cadence, want.Cadence) {
+		t.Errorf("unexpected streams:\n got %+v\nwant %+v", s, want)
+	}
+}
+
+func TestDecodeWithoutTimes(t *testing.T) {
+	f, err := os.Open("testdata/no_times.gpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := gpx.Decode(f); err == nil || !strings.Contains(err.Error(), "has no time") {
+		t.Errorf("expected an error for a track without times, got %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	file := decodeFixture(t, "run.gpx")
+
+	var encoded bytes.Buffer
+	if err := gpx.Encode(&encoded, file); err != nil {
+		t.Fatal(err)
+	}
+	again, err := gpx.Decode(bytes.NewReader(encoded.Bytes()))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, encoded.String())
+	}
+
+	// GPX from Encode has no description or device
+	a, b := again.Activity, file.Activity
+	if a.Name != b.Name || a.Type != b.Type || a.DateString != b.DateString || a.Distance != b.Distance || a.MovingTime != b.MovingTime || a.Map != b.Map {
+		t.Errorf("activity changed:\n got %+v\nwant %+v", a.SummaryActivity, b.SummaryActivity)
+	}
+	if !reflect.DeepEqual(again.Streams, file.Streams) {
+		t.Errorf("streams changed:\n got %+v\nwant %+v", again.Streams, file.Streams)
+	}
+}
+
+// TestEncodeInUTC encodes an activity synced from Strava, whose local start
+// time is four hours behind UTC
+func TestEncodeInUTC(t *testing.T) {
+	file := decodeFixture(t, "run.gpx")
+	file.Activity.DateString = "2022-04-18T10:02:14Z"
+	file.Activity.StartDate = "2022-04-18T14:02:14Z"
+
+	var encoded bytes.Buffer
+	if err := gpx.Encode(&encoded, file); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(encoded.String(), "<time>2022-04-18T14:02:44Z</time>") {
+		t.Errorf("expected the last point at 14:02:44 UTC:\n%s", encoded.String())
+	}
+	again, err := gpx.Decode(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Activity.DateString != "2022-04-18T14:02:14Z" {
+		t.Errorf("expected the activity to start at 14:02:14 UTC, got %s", again.Activity.DateString)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"github.com/scottfrazer/running/geo"
+	"github.com/scottfrazer/running/strava"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// heatmapPadding is the pixels kept clear around the routes
+const heatmapPadding = 20
+
+type heatmapFlags struct {
+	filter     *filterFlags
+	output     *string
+	geoJSON    *string
+	width      *int
+	height     *int
+	bounds     *string
+	background *string
+	tiles      *string
+	hot        *int
+}
+
+func addHeatmapFlags(cmd *kingpin.CmdClause) *heatmapFlags {
+	return &heatmapFlags{
+		filter:     addFilterFlags(cmd),
+		output:     cmd.Flag("output", "PNG file to write").Short('o').Default("heatmap.png").String(),
+		geoJSON:    cmd.Flag("geojson", "Also write the hot segments to this GeoJSON file").String(),
+		width:      cmd.Flag("width", "Image width in pixels").Default("2048").Int(),
+		height:     cmd.Flag("height", "Image height in pixels; defaults to the height that fits the routes").Int(),
+		bounds:     cmd.Flag("bounds", "Area to show, as south,west,north,east in degrees; defaults to every route").String(),
+		background: cmd.Flag("background", "Background color").Default("#000000").String(),
+		tiles:      cmd.Flag("tiles", "Directory of cached map tiles ({z}/{x}/{y}.png) to draw under the heat").ExistingDir(),
+		hot:        cmd.Flag("hot", "Activities a segment needs to be hot; defaults to a quarter of the busiest pixel's").Int(),
+	}
+}
+
+// writeHeatmap renders the routes of the activities into one heatmap
+func writeHeatmap(activities []strava.SummaryActivity, flags *heatmapFlags) error {
+	var routes []geo.Route
+	var bounds geo.BoundingBox
+	for i := range activities {
+		if route := activities[i].Route(); len(route) > 0 {
+			routes = append(routes, route)
+			bounds = bounds.Union(route.Bounds())
+		}
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("none of the %d activities have a route", len(activities))
+	}
+	if *flags.bounds != "" {
+		var err error
+		if bounds, err = parseBounds(*flags.bounds); err != nil {
+			return err
+		}
+	}
+	background, err := parseHexColor(*flags.background)
+	if err != nil {
+		return err
+	}
+
+	width, height := *flags.width, *flags.height
+	if height <= 0 {
+		minX, maxY := geo.Mercator(bounds.Min)
+		maxX, minY := geo.Mercator(bounds.Max)
+		aspect := 1.0
+		if maxX > minX {
+			aspect = (maxY - minY) / (maxX - minX)
+		}
+		height = int(math.Ceil(float64(width-2*heatmapPadding)*aspect)) + 2*heatmapPadding
+	}
+	heatmap := geo.NewHeatmap(geo.FitViewport(bounds, width, height, heatmapPadding))
+	for _, route := range routes {
+		heatmap.Add(route)
+	}
+
+	dc := gg.NewContext(width, height)
+	dc.SetColor(background)
+	dc.Clear()
+	if *flags.tiles != "" {
+		drawTiles(dc, *flags.tiles, heatmap.Viewport)
+	}
+	dc.DrawImage(heatImage(heatmap), 0, 0)
+	if err := dc.SavePNG(*flags.output); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s: %d routes, at most %d through one spot\n", *flags.output, heatmap.Routes(), heatmap.Max())
+
+	if *flags.geoJSON != "" {
+		minCount := *flags.hot
+		if minCount <= 0 {
+			minCount = int(math.Max(2, math.Ceil(float64(heatmap.Max())/4)))
+		}
+		segments := heatmap.HotSegments(minCount)
+		if err := writeHotSegments(*flags.geoJSON, segments); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s: %d segments followed by %d or more routes\n", *flags.geoJSON, len(segments), minCount)
+	}
+	return nil
+}
+
+// heatRamp is the color of the heat from the quietest (0) to the busiest (1)
+// pixels
+var heatRamp = []color.NRGBA{
+	{0x80, 0x10, 0x00, 0x90},
+	{0xfc, 0x4c, 0x02, 0xff},
+	{0xff, 0xc8, 0x00, 0xff},
+	{0xff, 0xff, 0xe0, 0xff},
+}
+
+// heatImage colors each pixel by its count on a log scale, so streets run
+// once still show next to the ones run every day.  Pixels no route crosses
+// are transparent.
+func heatImage(heatmap *geo.Heatmap) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, heatmap.Width, heatmap.Height))
+	max := math.Log1p(float64(heatmap.Max()))
+	for y := 0; y < heatmap.Height; y++ {
+		for x := 0; x < heatmap.Width; x++ {
+			count := heatmap.Count(x, y)
+			if count == 0 {
+				continue
+			}
+			t := 1.0
+			if max > math.Log1p(1) {
+				t = (math.Log1p(float64(count)) - math.Log1p(1)) / (max - math.Log1p(1))
+			}
+			img.SetNRGBA(x, y, rampColor(heatRamp, t))
+		}
+	}
+	return img
+}
+
+// rampColor interpolates between evenly spaced colors at t in [0, 1]
+func rampColor(ramp []color.NRGBA, t float64) color.NRGBA {
+	position := t * float64(len(ramp)-1)
+	i := int(math.Min(math.Floor(position), float64(len(ramp)-2)))
+	f := position - float64(i)
+	mix := func(a, b uint8) uint8 {
+		return uint8(math.Round(float64(a) + f*(float64(b)-float64(a))))
+	}
+	a, b := ramp[i], ramp[i+1]
+	return color.NRGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), mix(a.A, b.A)}
+}
+
+// parseBounds parses a south,west,north,east bounding box
+func parseBounds(s string) (geo.BoundingBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return geo.BoundingBox{}, fmt.Errorf("invalid bounds %q (expected south,west,north,east)", s)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		var err error
+		if v[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64); err != nil {
+			return geo.BoundingBox{}, fmt.Errorf("invalid bounds %q (expected south,west,north,east)", s)
+		}
+	}
+	if v[0] >= v[2] || v[1] >= v[3] {
+		return geo.BoundingBox{}, fmt.Errorf("invalid bounds %q (south must be below north and west of east)", s)
+	}
+	return geo.BoundingBox{Min: geo.LatLng{v[0], v[1]}, Max: geo.LatLng{v[2], v[3]}}, nil
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONLineString      `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONLineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"` // [longitude, latitude]
+}
+
+// writeHotSegments writes the segments as GeoJSON line strings, with the
+// number of routes following each as its count property
+func writeHotSegments(path string, segments []geo.HotSegment) error {
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	for _, segment := range segments {
+		line := geoJSONLineString{Type: "LineString"}
+		for _, p := range segment.Route {
+			line.Coordinates = append(line.Coordinates, [2]float64{
+				math.Round(p[1]*1e6) / 1e6,
+				math.Round(p[0]*1e6) / 1e6,
+			})
+		}
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   line,
+			Properties: map[string]interface{}{"count": segment.Count},
+		})
+	}
+	serialized, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, serialized, 0644)
+}
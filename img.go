@@ -5,12 +5,13 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/draw"
+	"io"
 	"math"
 	"os"
 	"os/exec"
+	"strings"
 
-	"github.com/fogleman/gg"
+	"github.com/scottfrazer/running/geo"
 	"github.com/scottfrazer/running/strava"
 )
 
@@ -20,195 +21,203 @@ func ResizePNG(pngPath string, width, height int) []byte {
 	return out
 }
 
-func rectangle(rgba *image.RGBA, topX, topY, bottomX, bottomY, width int, c color.Color) {
-	for j := 0; j < width; j++ {
-		for i := 0; i <= bottomX-topX+(width-1); i++ {
-			rgba.Set(topX+i, topY+j, c)
-			rgba.Set(topX+i, bottomY+j, c)
+// posterMap draws the map of an activity into a w by h tile of a poster at
+// (x, y), or of several activities overlaid
+type posterMap func(r posterRenderer, activities []strava.SummaryActivity, x, y, w, h float64) error
+
+// rasterPosterMap draws the map images at mapPath, e.g. from Google Static
+// Maps, stretched to the tile
+func rasterPosterMap(mapPath func(int64) string) posterMap {
+	return func(r posterRenderer, activities []strava.SummaryActivity, x, y, w, h float64) error {
+		if len(activities) != 1 {
+			return fmt.Errorf("map images can't be overlaid")
+		}
+		imageFile, err := os.ReadFile(mapPath(activities[0].Id))
+		if err != nil {
+			return err
 		}
-		for i := 0; i <= bottomY-topY+(width-1); i++ {
-			rgba.Set(topX+j, topY+i, c)
-			rgba.Set(bottomX+j, topY+i, c)
+		activityMap, _, err := image.Decode(bytes.NewReader(imageFile))
+		if err != nil {
+			return err
 		}
+		r.DrawImage(activityMap, x, y, w, h)
+		return nil
 	}
 }
 
-type TilePoster struct {
-	activities      []strava.SummaryActivity
-	rows            int
-	cols            int
-	width           int
-	height          int
-	borderWidth     int
-	space           int
-	rightLeftMargin int
-	topBottomMargin int
-	mapWidth        int
-	mapHeight       int
-	mapPath         func(int64) string // activity id => string
+// routePosterMap draws each activity's route itself, as vectors where the
+// format has them, in the color routeColor picks if it isn't nil
+func routePosterMap(style RouteMapStyle, routeColor func(*strava.SummaryActivity) color.Color) posterMap {
+	return func(r posterRenderer, activities []strava.SummaryActivity, x, y, w, h float64) error {
+		style := style
+		style.Width, style.Height = int(w), int(h)
+		routes := make([]geo.Route, len(activities))
+		colors := make([]color.Color, len(activities))
+		for i := range activities {
+			routes[i] = activities[i].Route()
+			colors[i] = style.Color
+			if routeColor != nil {
+				colors[i] = routeColor(&activities[i])
+			}
+		}
+		if len(activities) == 1 {
+			style.Color = colors[0]
+			drawRouteMap(r, routes[0], style, x, y)
+			return nil
+		}
+		drawRouteOverlay(r, routes, colors, style, x, y)
+		return nil
+	}
 }
 
-func NewTilePoster(activities []strava.SummaryActivity, ratio float64, mapWidth, mapHeight, borderWidth, space int, mapPath func(int64) string) *TilePoster {
-	var r, c, w, h, margin int
-
-	dimensions := func(c int) (int, int, int) {
-		r := int(math.Ceil(float64(len(activities)) / float64(c)))
-		return r + 1,
-			(c * (mapWidth + (2 * borderWidth))) + ((c + 1) * space),
-			(r+1)*(mapHeight+(2*borderWidth)) + (r * space)
-	}
+// Sizes of the poster's text, in layout units
+const (
+	titleSize    = 1000
+	subtitleSize = 300
+	subtitleGap  = 200  // between the title and subtitle
+	capHeight    = 0.71 // of Roboto as a fraction of the size; close for most fonts
+	lineHeight   = 1.4  // of captions, as a multiple of their size
+)
 
-	for c = 1; ; c++ {
-		// r = len(activities) / c
-		// w = c * (mapWidth + borderWidth)
-		// h = (r + 1) * (mapHeight + borderWidth)
-		r, w, h = dimensions(c)
-		fmt.Printf("newCompute(): r=%d, c=%d, w=%d, h=%d, ratio=%f\n", r, c, w, h, float64(w)/float64(h))
-
-		_, w1, h1 := dimensions(c + 1)
-		if float64(w1)/float64(h1) > ratio {
-			// (w+margin)/h = ratio; solve for `margin`
-			margin = int(ratio*float64(h) - float64(w))
-			w += margin
-			fmt.Printf("margin=%d, w=%d, h=%d, r=%f\n", margin, w, h, float64(w)/float64(h))
-			break
-		}
-	}
+// TilePosterStyle is the look of a TilePoster, apart from its maps
+type TilePosterStyle struct {
+	Title      string
+	Subtitle   string
+	Font       string // TrueType font file
+	Background color.Color
+	Border     color.Color
+	Text       color.Color
+
+	// Captions are the text under (or over the bottom of) each map, by
+	// activity id; a caption may have several lines
+	Captions     map[int64]string
+	CaptionBelow bool
+	CaptionSize  float64
+
+	// Races are framed in RaceColor, and their maps have their RaceBadges
+	// on a band across the top
+	RaceColor  color.Color
+	RaceBorder float64
+	RaceBadges map[int64]string
+}
 
-	return &TilePoster{
-		activities,
-		r,
-		c,
-		w,
-		h,
-		borderWidth,
-		space,
-		margin / 2,
-		0,
-		mapWidth,
-		mapHeight,
-		mapPath,
-	}
+type TilePoster struct {
+	plan        posterPlan
+	borderWidth int
+	style       TilePosterStyle
+	drawMap     posterMap
 }
 
-func (poster *TilePoster) Generate() []byte {
-	var partition [][]strava.SummaryActivity
-	for r := 0; r < poster.rows; r++ {
-		var row []strava.SummaryActivity
-		for c := 0; c < poster.cols; c++ {
-			index := r*poster.cols + c
-			if index >= len(poster.activities) {
-				break
+func NewTilePoster(activities []strava.SummaryActivity, ratio float64, layout posterLayout, mapWidth, mapHeight, borderWidth, space int, style TilePosterStyle, drawMap posterMap) *TilePoster {
+	captionHeight := 0
+	if style.CaptionBelow {
+		lines := 0
+		for _, caption := range style.Captions {
+			if n := strings.Count(caption, "\n") + 1; caption != "" && n > lines {
+				lines = n
 			}
-			row = append(row, poster.activities[index])
 		}
-		if len(row) > 0 {
-			partition = append(partition, row)
+		if lines > 0 {
+			captionHeight = int(math.Ceil((float64(lines)*lineHeight + 0.4) * style.CaptionSize))
 		}
 	}
 
-	fmt.Printf("TilePoster:\n")
-	fmt.Printf("  activites=%d\n", len(poster.activities))
-	fmt.Printf("  rows=%d\n", poster.rows)
-	fmt.Printf("  cols=%d\n", poster.cols)
-	fmt.Printf("  width=%d\n", poster.width)
-	fmt.Printf("  height=%d\n", poster.height)
-	fmt.Printf("  borderWidth=%d\n", poster.borderWidth)
-	fmt.Printf("  space=%d\n", poster.space)
-	fmt.Printf("  rightLeftMargin=%d\n", poster.rightLeftMargin)
-	fmt.Printf("  topBottomMargin=%d\n", poster.topBottomMargin)
-	fmt.Printf("  mapWidth=%d\n", poster.mapWidth)
-	fmt.Printf("  mapHeight=%d\n", poster.mapHeight)
-
-	rgba := image.NewRGBA(image.Rect(0, 0, poster.width, poster.height))
-
-	for i := 0; i < poster.width; i++ {
-		for j := 0; j < poster.height; j++ {
-			rgba.Set(i, j, color.White)
-		}
+	plan := layout.plan(activities, ratio, tileMetrics{
+		mapWidth:      mapWidth,
+		mapHeight:     mapHeight,
+		border:        borderWidth,
+		space:         space,
+		captionHeight: captionHeight,
+		labelSize:     style.CaptionSize,
+	})
+	return &TilePoster{plan, borderWidth, style, drawMap}
+}
+
+// Generate draws the poster in the output's format, scaled to its size
+func (poster *TilePoster) Generate(w io.Writer, out PosterOutput) error {
+	plan := poster.plan
+	renderer, err := newPosterRenderer(out, plan.width, plan.height)
+	if err != nil {
+		return err
 	}
+	renderer.FillRect(0, 0, plan.width, plan.height, poster.style.Background)
 
-	for r, row := range partition {
-		for c, activity := range row {
-			centerAdjust := 0
-			if len(row) < poster.cols {
-				centerAdjust = (poster.cols - len(row)) * (poster.space + poster.mapWidth)
-				centerAdjust /= 2
-			}
+	for _, label := range plan.labels {
+		renderer.DrawText(label.text, label.x, label.y, label.size, poster.style.Font, poster.style.Text)
+	}
 
-			topX := poster.rightLeftMargin + centerAdjust + poster.space + (c * (poster.space + poster.mapWidth))
-			topY := poster.space + (r * (poster.space + poster.mapHeight))
-			bottomX := topX + poster.mapWidth + poster.borderWidth
-			bottomY := topY + poster.mapHeight + poster.borderWidth
-
-			// draw border
-			rectangle(rgba, topX, topY, bottomX, bottomY, poster.borderWidth, color.RGBA{0, 0, 0, 255})
-
-			// load image
-			imageFile, err := os.ReadFile(poster.mapPath(activity.Id))
-			check(err)
-			activityMap, _, err := image.Decode(bytes.NewReader(imageFile))
-			check(err)
-
-			// draw the image within the border
-			draw.Draw(
-				rgba,
-				image.Rect(
-					topX+poster.borderWidth,
-					topY+poster.borderWidth,
-					topX+poster.borderWidth+poster.mapWidth,
-					topY+poster.borderWidth+poster.mapHeight,
-				),
-				activityMap,
-				image.Point{0, 0},
-				draw.Src,
+	border := float64(poster.borderWidth)
+	for _, tile := range plan.tiles {
+		single := len(tile.activities) == 1
+
+		// frame races
+		if single && tile.activities[0].IsRace() && poster.style.RaceBorder > 0 {
+			renderer.FillRect(
+				tile.x-border-poster.style.RaceBorder,
+				tile.y-border-poster.style.RaceBorder,
+				tile.w+2*border+2*poster.style.RaceBorder,
+				tile.h+2*border+2*poster.style.RaceBorder,
+				poster.style.RaceColor,
 			)
 		}
+
+		// draw border
+		renderer.FillRect(tile.x-border, tile.y-border, tile.w+2*border, tile.h+2*border, poster.style.Border)
+
+		// draw the map within the border
+		if err := poster.drawMap(renderer, tile.activities, tile.x, tile.y, tile.w, tile.h); err != nil {
+			if single {
+				return fmt.Errorf("drawing the map of activity %d: %w", tile.activities[0].Id, err)
+			}
+			return fmt.Errorf("drawing the map of %d activities: %w", len(tile.activities), err)
+		}
+
+		if single {
+			poster.drawAnnotations(renderer, tile)
+		}
 	}
 
-	/////////////////////////////////////////////////////
+	if poster.style.Subtitle == "" {
+		renderer.DrawText(poster.style.Title, plan.width/2, plan.titleY, titleSize, poster.style.Font, poster.style.Text)
+	} else {
+		// Center the title and subtitle together, by their cap heights
+		height := capHeight * (titleSize + subtitleSize + subtitleGap)
+		top := plan.titleY - height/2
+		renderer.DrawText(poster.style.Title, plan.width/2, top+capHeight*titleSize/2, titleSize, poster.style.Font, poster.style.Text)
+		renderer.DrawText(poster.style.Subtitle, plan.width/2, top+height-capHeight*subtitleSize/2, subtitleSize, poster.style.Font, poster.style.Text)
+	}
 
-	dc := gg.NewContextForRGBA(rgba)
-	err := dc.LoadFontFace("Roboto-Regular.ttf", 1000)
-	check(err)
-	dc.SetRGB(0, 0, 0)
-	rowHeight := float64(poster.height) / float64(poster.rows)
-	//sw, sh := dc.MeasureString("2020")
-	//fmt.Printf("%fx%f\n", sw, sh)
-	dc.DrawStringAnchored(
-		"2022",
-		float64(poster.width)/2,
-		float64((poster.rows-1)*(poster.mapHeight+2*poster.borderWidth))+(float64(poster.rows)*float64(poster.space))+rowHeight/2.0-(float64(poster.space)*2),
-		0.5,
-		0.5,
-	)
-
-	// fontBytes, err := ioutil.ReadFile("Roboto-Regular.ttf")
-	// check(err)
-	// font, err := freetype.ParseFont(fontBytes)
-	// check(err)
-	// size := 1000.0
-
-	// c := freetype.NewContext()
-	// c.SetDPI(72)
-	// c.SetFont(font)
-	// c.SetFontSize(size)
-	// c.SetClip(rgba.Bounds())
-	// c.SetDst(rgba)
-	// c.SetSrc(image.Black)
-	// fmt.Printf("%v\n", rgba.Bounds())
-
-	// x := (poster.width / 2) + int(c.PointToFixed(size)>>6)
-	// y := (poster.rows - 2) * poster.mapHeight
-	// fmt.Printf("%d, %d\n", x, y)
-	// pt := freetype.Pt(x, y)
-	// _, err = c.DrawString("2020", pt)
-	// check(err)
-	// pt.Y += c.PointToFixed(size * 1.5)
-	/////////////////////////////////////////////////////
-
-	var buf bytes.Buffer
-	dc.EncodePNG(&buf)
-	//png.Encode(&buf, rgba)
-	return buf.Bytes()
+	return renderer.Encode(w)
+}
+
+// drawAnnotations draws an activity's race badge and caption on or around
+// its map
+func (poster *TilePoster) drawAnnotations(renderer posterRenderer, tile posterTile) {
+	activity := tile.activities[0]
+	size := poster.style.CaptionSize
+	centerX := tile.x + tile.w/2
+
+	if badge := poster.style.RaceBadges[activity.Id]; activity.IsRace() && badge != "" {
+		height := (lineHeight + 0.4) * size
+		renderer.FillRect(tile.x, tile.y, tile.w, height, poster.style.RaceColor)
+		renderer.DrawText(badge, centerX, tile.y+height/2, size, poster.style.Font, poster.style.Background)
+	}
+
+	caption := poster.style.Captions[activity.Id]
+	if caption == "" {
+		return
+	}
+	lines := strings.Split(caption, "\n")
+	height := (float64(len(lines))*lineHeight + 0.4) * size
+	top := tile.y + tile.h + float64(poster.borderWidth)
+	if !tile.captionBelow {
+		// On a translucent band of the paper color across the bottom of the map
+		top = tile.y + tile.h - height
+		band := color.NRGBAModel.Convert(poster.style.Background).(color.NRGBA)
+		band.A = 0xcc
+		renderer.FillRect(tile.x, top, tile.w, height, band)
+	}
+	for i, line := range lines {
+		renderer.DrawText(line, centerX, top+(0.2+lineHeight*(float64(i)+0.5))*size, size, poster.style.Font, poster.style.Text)
+	}
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+// posterTile is where a layout puts a map on a poster: the map's rectangle,
+// inside its border, in layout units
+type posterTile struct {
+	activities   []strava.SummaryActivity // overlaid if there are several
+	x, y, w, h   float64
+	captionBelow bool // whether the layout left room for a caption below the map
+}
+
+// posterLabel is text a layout adds to a poster, centered on (x, y)
+type posterLabel struct {
+	text       string
+	x, y, size float64
+}
+
+// posterPlan is a laid out poster, in layout units
+type posterPlan struct {
+	width, height float64
+	tiles         []posterTile
+	labels        []posterLabel
+	titleY        float64 // the center of the title and subtitle
+}
+
+// tileMetrics are the sizes layouts build a poster from, in layout units
+type tileMetrics struct {
+	mapWidth      int // of a map in a uniform layout
+	mapHeight     int
+	border        int
+	space         int
+	captionHeight int // kept below the maps of a uniform layout
+	labelSize     float64
+}
+
+// posterLayout places the maps of activities, oldest first, on a poster of
+// the ratio of width to height
+type posterLayout interface {
+	plan(activities []strava.SummaryActivity, ratio float64, m tileMetrics) posterPlan
+}
+
+func newPosterLayout(name string) (posterLayout, error) {
+	switch name {
+	case "grid":
+		return gridLayout{}, nil
+	case "calendar":
+		return calendarLayout{}, nil
+	case "treemap":
+		return treemapLayout{}, nil
+	case "overlay":
+		return overlayLayout{}, nil
+	}
+	return nil, fmt.Errorf("unknown layout %q (expected grid, calendar, treemap or overlay)", name)
+}
+
+// gridLayout puts the maps in rows, with as many columns as fit the ratio
+// and the last row centered, and the title in a row of its own below
+type gridLayout struct{}
+
+func (gridLayout) plan(activities []strava.SummaryActivity, ratio float64, m tileMetrics) posterPlan {
+	var r, c, w, h, margin int
+
+	dimensions := func(c int) (int, int, int) {
+		r := int(math.Ceil(float64(len(activities)) / float64(c)))
+		return r + 1,
+			(c * (m.mapWidth + (2 * m.border))) + ((c + 1) * m.space),
+			(r+1)*(m.mapHeight+m.captionHeight+(2*m.border)) + (r * m.space)
+	}
+
+	for c = 1; ; c++ {
+		r, w, h = dimensions(c)
+
+		_, w1, h1 := dimensions(c + 1)
+		if float64(w1)/float64(h1) > ratio {
+			// (w+margin)/h = ratio; solve for `margin`
+			margin = int(ratio*float64(h) - float64(w))
+			w += margin
+			break
+		}
+	}
+
+	plan := posterPlan{width: float64(w), height: float64(h)}
+	for i := range activities {
+		row, col := i/c, i%c
+		centerAdjust := 0
+		if inRow := len(activities) - row*c; inRow < c {
+			centerAdjust = (c - inRow) * (m.space + m.mapWidth)
+			centerAdjust /= 2
+		}
+		topX := margin/2 + centerAdjust + m.space + (col * (m.space + m.mapWidth))
+		topY := m.space + (row * (m.space + m.mapHeight + m.captionHeight))
+		plan.tiles = append(plan.tiles, posterTile{
+			activities:   activities[i : i+1],
+			x:            float64(topX + m.border),
+			y:            float64(topY + m.border),
+			w:            float64(m.mapWidth),
+			h:            float64(m.mapHeight),
+			captionBelow: m.captionHeight > 0,
+		})
+	}
+
+	rowHeight := float64(h) / float64(r)
+	plan.titleY = float64((r-1)*(m.mapHeight+m.captionHeight+2*m.border)) + (float64(r) * float64(m.space)) + rowHeight/2.0 - (float64(m.space) * 2)
+	return plan
+}
+
+// calendarLayout puts each day in a cell of a week per row, Monday first,
+// leaving rest days empty.  Days with several activities split their cell.
+type calendarLayout struct{}
+
+func (calendarLayout) plan(activities []strava.SummaryActivity, ratio float64, m tileMetrics) posterPlan {
+	day := func(a *strava.SummaryActivity) time.Time {
+		t := a.Date()
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	first := day(&activities[0])
+	first = first.AddDate(0, 0, -((int(first.Weekday()) + 6) % 7))
+	var days [][]strava.SummaryActivity // since first
+	for i := range activities {
+		n := int(day(&activities[i]).Sub(first).Hours()/24 + 0.5)
+		for len(days) <= n {
+			days = append(days, nil)
+		}
+		days[n] = append(days[n], activities[i])
+	}
+	weeks := (len(days) + 6) / 7
+
+	space, border := float64(m.space), float64(m.border)
+	cellWidth := float64(m.mapWidth + 2*m.border)
+	cellHeight := float64(m.mapHeight + 2*m.border)
+	rowHeight := cellHeight + float64(m.captionHeight)
+	header := 2 * m.labelSize
+
+	gridTop := space + header
+	contentHeight := gridTop + float64(weeks)*(rowHeight+space)
+	plan := posterPlan{
+		width:  7*cellWidth + 8*space,
+		height: contentHeight + cellHeight + space,
+	}
+	left := 0.0
+	if plan.width/plan.height < ratio {
+		left = (ratio*plan.height - plan.width) / 2
+		plan.width = ratio * plan.height
+	} else {
+		plan.height = plan.width / ratio
+	}
+	plan.titleY = (contentHeight + plan.height) / 2
+
+	for i, name := range []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"} {
+		plan.labels = append(plan.labels, posterLabel{
+			text: name,
+			x:    left + space + float64(i)*(cellWidth+space) + cellWidth/2,
+			y:    space + header/2,
+			size: m.labelSize,
+		})
+	}
+
+	for n, activities := range days {
+		if len(activities) == 0 {
+			continue
+		}
+		x := left + space + float64(n%7)*(cellWidth+space)
+		y := gridTop + float64(n/7)*(rowHeight+space)
+		if len(activities) == 1 {
+			plan.tiles = append(plan.tiles, posterTile{
+				activities:   activities,
+				x:            x + border,
+				y:            y + border,
+				w:            float64(m.mapWidth),
+				h:            float64(m.mapHeight),
+				captionBelow: m.captionHeight > 0,
+			})
+			continue
+		}
+		// A square grid of smaller maps, a border apart
+		k := int(math.Ceil(math.Sqrt(float64(len(activities)))))
+		size := (cellWidth+border)/float64(k) - border
+		for i := range activities {
+			plan.tiles = append(plan.tiles, posterTile{
+				activities: activities[i : i+1],
+				x:          x + float64(i%k)*(size+border) + border,
+				y:          y + float64(i/k)*(size+border) + border,
+				w:          size - 2*border,
+				h:          size - 2*border,
+			})
+		}
+	}
+	return plan
+}
+
+// treemapLayout sizes each map by the activity's distance, packing them,
+// longest first, into a rectangle above the title
+type treemapLayout struct{}
+
+// treemapMinShare is the smallest map in a treemap, as a fraction of the
+// average one
+const treemapMinShare = 0.25
+
+func (treemapLayout) plan(activities []strava.SummaryActivity, ratio float64, m tileMetrics) posterPlan {
+	sorted := append([]strava.SummaryActivity(nil), activities...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Distance > sorted[j].Distance
+	})
+
+	space, border := float64(m.space), float64(m.border)
+	titleHeight := float64(m.mapHeight+2*m.border) + space
+	// As much room as the grid gives the same activities: width*(height -
+	// titleHeight) = area, with height = width/ratio
+	area := float64(len(sorted)) * float64(m.mapWidth+2*m.border+m.space) * float64(m.mapHeight+2*m.border+m.space)
+	width := ratio * (titleHeight + math.Sqrt(titleHeight*titleHeight+4*area/ratio)) / 2
+	plan := posterPlan{width: width, height: width / ratio}
+	plan.titleY = plan.height - titleHeight/2
+
+	// Each rectangle has half the space around it, so the maps are a space
+	// apart and from the edge
+	x, y := space/2, space/2
+	w, h := plan.width-space, plan.height-titleHeight-space/2
+
+	// Maps are sized by distance, but short runs get at least a fraction
+	// of the average map so they stay big enough to see
+	mean := 0.0
+	for _, activity := range sorted {
+		mean += activity.Distance / float64(len(sorted))
+	}
+	areas := make([]float64, len(sorted))
+	for i, activity := range sorted {
+		areas[i] = math.Max(activity.Distance, math.Max(treemapMinShare*mean, 1))
+	}
+	total := 0.0
+	for _, a := range areas {
+		total += a
+	}
+	for i := range areas {
+		areas[i] *= w * h / total
+	}
+	for i, rect := range squarify(areas, x, y, w, h) {
+		tile := posterTile{
+			activities: sorted[i : i+1],
+			x:          rect[0] + space/2 + border,
+			y:          rect[1] + space/2 + border,
+			w:          rect[2] - space - 2*border,
+			h:          rect[3] - space - 2*border,
+		}
+		if tile.w <= 0 || tile.h <= 0 {
+			log.Printf("treemap: no room for the map of activity %d (%s, %s)", tile.activities[0].Id, tile.activities[0].Name, tile.activities[0].DistanceString())
+			continue
+		}
+		plan.tiles = append(plan.tiles, tile)
+	}
+	return plan
+}
+
+// squarify divides the rectangle at (x, y) into rectangles of the areas, which
+// are largest first and add up to the rectangle's, keeping them as close to
+// square as it can (Bruls, Huizing and van Wijk's squarified treemap).
+// Rectangles are x, y, width and height.
+func squarify(areas []float64, x, y, w, h float64) [][4]float64 {
+	// worst is the most elongated rectangle of a row of areas along a side
+	worst := func(row []float64, side float64) float64 {
+		sum, min, max := 0.0, math.Inf(1), 0.0
+		for _, a := range row {
+			sum += a
+			min = math.Min(min, a)
+			max = math.Max(max, a)
+		}
+		return math.Max(side*side*max/(sum*sum), sum*sum/(side*side*min))
+	}
+
+	rects := make([][4]float64, 0, len(areas))
+	for len(areas) > 0 {
+		side := math.Min(w, h)
+		n := 1
+		for n < len(areas) && worst(areas[:n+1], side) <= worst(areas[:n], side) {
+			n++
+		}
+		sum := 0.0
+		for _, a := range areas[:n] {
+			sum += a
+		}
+		thickness := sum / side
+		offset := 0.0
+		for _, a := range areas[:n] {
+			length := a / thickness
+			if w >= h {
+				// A column down the left
+				rects = append(rects, [4]float64{x, y + offset, thickness, length})
+			} else {
+				// A row across the top
+				rects = append(rects, [4]float64{x + offset, y, length, thickness})
+			}
+			offset += length
+		}
+		if w >= h {
+			x, w = x+thickness, w-thickness
+		} else {
+			y, h = y+thickness, h-thickness
+		}
+		areas = areas[n:]
+	}
+	return rects
+}
+
+// overlayLayout draws every route in one square map, from a common origin,
+// with the title below
+type overlayLayout struct{}
+
+// overlayTiles is how many uniform maps wide the overlay is
+const overlayTiles = 3
+
+func (overlayLayout) plan(activities []strava.SummaryActivity, ratio float64, m tileMetrics) posterPlan {
+	space, border := float64(m.space), float64(m.border)
+	size := float64(overlayTiles * m.mapWidth)
+	plan := posterPlan{
+		width:  size + 2*border + 2*space,
+		height: size + 2*border + 2*space + float64(m.mapHeight+2*m.border),
+	}
+	left := 0.0
+	if plan.width/plan.height < ratio {
+		left = (ratio*plan.height - plan.width) / 2
+		plan.width = ratio * plan.height
+	} else {
+		plan.height = plan.width / ratio
+	}
+	contentHeight := size + 2*border + 2*space
+	plan.titleY = (contentHeight + plan.height) / 2
+	plan.tiles = []posterTile{{
+		activities: activities,
+		x:          left + space + border,
+		y:          space + border,
+		w:          size,
+		h:          size,
+	}}
+	return plan
+}
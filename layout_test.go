@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func TestSquarify(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		areas      []float64
+		w, h       float64
+		rects      [][4]float64 // if known exactly
+		worstRatio float64      // the most elongated rectangle allowed
+	}{
+		{name: "one", areas: []float64{24}, w: 6, h: 4, rects: [][4]float64{{0, 0, 6, 4}}},
+		{name: "two squares", areas: []float64{4, 4}, w: 4, h: 2, rects: [][4]float64{{0, 0, 2, 2}, {2, 0, 2, 2}}},
+		{name: "stacked in a tall rectangle", areas: []float64{4, 4}, w: 2, h: 4, rects: [][4]float64{{0, 0, 2, 2}, {0, 2, 2, 2}}},
+		// The example from Bruls, Huizing and van Wijk's paper
+		{name: "paper", areas: []float64{6, 6, 4, 3, 2, 2, 1}, w: 6, h: 4, worstRatio: 3},
+		{name: "one long and many short", areas: []float64{50, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5}, w: 10, h: 10, worstRatio: 3},
+	} {
+		rects := squarify(test.areas, 1, 2, test.w, test.h)
+		if len(rects) != len(test.areas) {
+			t.Errorf("%s: expected %d rectangles, got %d", test.name, len(test.areas), len(rects))
+			continue
+		}
+		for i, r := range rects {
+			if test.rects != nil {
+				want := test.rects[i]
+				want[0], want[1] = want[0]+1, want[1]+2
+				for j := range r {
+					if math.Abs(r[j]-want[j]) > 1e-9 {
+						t.Errorf("%s: rectangle %d is %v, expected %v", test.name, i, r, want)
+						break
+					}
+				}
+			}
+			if math.Abs(r[2]*r[3]-test.areas[i]) > 1e-9 {
+				t.Errorf("%s: rectangle %d has area %g, expected %g", test.name, i, r[2]*r[3], test.areas[i])
+			}
+			if r[0] < 1-1e-9 || r[1] < 2-1e-9 || r[0]+r[2] > 1+test.w+1e-9 || r[1]+r[3] > 2+test.h+1e-9 {
+				t.Errorf("%s: rectangle %d (%v) is outside the %gx%g rectangle", test.name, i, r, test.w, test.h)
+			}
+			if ratio := math.Max(r[2]/r[3], r[3]/r[2]); test.worstRatio > 0 && ratio > test.worstRatio {
+				t.Errorf("%s: rectangle %d (%v) is %g times longer than it's wide", test.name, i, r, ratio)
+			}
+			for j := 0; j < i; j++ {
+				o := rects[j]
+				overlapW := math.Min(r[0]+r[2], o[0]+o[2]) - math.Max(r[0], o[0])
+				overlapH := math.Min(r[1]+r[3], o[1]+o[3]) - math.Max(r[1], o[1])
+				if overlapW > 1e-9 && overlapH > 1e-9 {
+					t.Errorf("%s: rectangles %d (%v) and %d (%v) overlap", test.name, j, o, i, r)
+				}
+			}
+		}
+	}
+}
+
+// activitiesOn returns an activity for each date, 2006-01-02 15:04
+func activitiesOn(dates ...string) []strava.SummaryActivity {
+	activities := make([]strava.SummaryActivity, len(dates))
+	for i, date := range dates {
+		t, err := time.Parse("2006-01-02 15:04", date)
+		if err != nil {
+			panic(err)
+		}
+		activities[i] = strava.SummaryActivity{Id: int64(i + 1), DateString: t.Format("2006-01-02T15:04:05Z"), Distance: 5000}
+	}
+	return activities
+}
+
+func TestCalendarLayout(t *testing.T) {
+	m := tileMetrics{mapWidth: 100, mapHeight: 100, border: 5, space: 10, captionHeight: 20, labelSize: 15}
+	cell := 110.0          // the map and its border
+	column := cell + 10    // and the space
+	row := cell + 20 + 10  // and the caption
+	gridTop := 10 + 2*15.0 // below the weekday labels
+	tileX := 10 + 5.0      // of Monday's map in a layout without margins
+	tileY := gridTop + 5   // of the first week's map
+
+	for _, test := range []struct {
+		name       string
+		activities []strava.SummaryActivity
+		// each tile's activity, column and week, and whether it's a whole cell
+		tiles []struct {
+			id          int64
+			column, row int
+			whole       bool
+		}
+		weeks int
+	}{
+		{
+			name:       "weeks start on Monday",
+			activities: activitiesOn("2021-03-03 07:00", "2021-03-07 18:30", "2021-03-08 06:00"), // Wed, Sun, Mon
+			tiles: []struct {
+				id          int64
+				column, row int
+				whole       bool
+			}{{1, 2, 0, true}, {2, 6, 0, true}, {3, 0, 1, true}},
+			weeks: 2,
+		},
+		{
+			name:       "rest weeks stay empty",
+			activities: activitiesOn("2021-03-01 07:00", "2021-03-21 07:00"), // Mon, Sun two weeks later
+			tiles: []struct {
+				id          int64
+				column, row int
+				whole       bool
+			}{{1, 0, 0, true}, {2, 6, 2, true}},
+			weeks: 3,
+		},
+		{
+			name:       "several on a day split the cell",
+			activities: activitiesOn("2021-03-02 06:00", "2021-03-02 12:00", "2021-03-02 18:00"), // Tue
+			tiles: []struct {
+				id          int64
+				column, row int
+				whole       bool
+			}{{1, 1, 0, false}, {2, 1, 0, false}, {3, 1, 0, false}},
+			weeks: 1,
+		},
+	} {
+		// A tall ratio, so the calendar has no margins at the sides
+		plan := calendarLayout{}.plan(test.activities, 0.1, m)
+		if len(plan.labels) != 7 || plan.labels[0].text != "Mon" || plan.labels[6].text != "Sun" {
+			t.Errorf("%s: expected weekday labels from Mon to Sun, got %+v", test.name, plan.labels)
+		}
+		if plan.width != 7*cell+8*10 {
+			t.Errorf("%s: expected 7 days across, %g wide, got %g", test.name, 7*cell+8*10, plan.width)
+		}
+		if weeksEnd := gridTop + float64(test.weeks)*row; plan.titleY != (weeksEnd+plan.height)/2 {
+			t.Errorf("%s: expected the title centered below %d weeks, got it at %g of %g", test.name, test.weeks, plan.titleY, plan.height)
+		}
+		if len(plan.tiles) != len(test.tiles) {
+			t.Errorf("%s: expected %d tiles, got %d", test.name, len(test.tiles), len(plan.tiles))
+			continue
+		}
+		for i, want := range test.tiles {
+			tile := plan.tiles[i]
+			x, y := tileX+float64(want.column)*column, tileY+float64(want.row)*row
+			if tile.activities[0].Id != want.id {
+				t.Errorf("%s: tile %d is activity %d, expected %d", test.name, i, tile.activities[0].Id, want.id)
+			}
+			if want.whole {
+				if tile.x != x || tile.y != y || tile.w != 100 || tile.h != 100 || !tile.captionBelow {
+					t.Errorf("%s: tile %d is %gx%g at (%g, %g), expected the cell at (%g, %g)", test.name, i, tile.w, tile.h, tile.x, tile.y, x, y)
+				}
+				continue
+			}
+			// Split maps stay inside their day's cell, with captions over them
+			if tile.x < x || tile.y < y || tile.x+tile.w > x+100 || tile.y+tile.h > y+100 || tile.w >= 100 || tile.captionBelow {
+				t.Errorf("%s: tile %d is %gx%g at (%g, %g), expected it inside the cell at (%g, %g)", test.name, i, tile.w, tile.h, tile.x, tile.y, x, y)
+			}
+		}
+	}
+}
+
+func TestTreemapKeepsShortActivities(t *testing.T) {
+	activities := activitiesOn("2021-03-01 07:00", "2021-03-02 07:00", "2021-03-03 07:00", "2021-03-04 07:00")
+	activities[0].Distance = 42195
+	activities[1].Distance = 10000
+	activities[2].Distance = 100
+	activities[3].Distance = 0
+	m := tileMetrics{mapWidth: 1280, mapHeight: 1280, border: 3, space: 50}
+
+	plan := treemapLayout{}.plan(activities, 0.75, m)
+	if len(plan.tiles) != len(activities) {
+		t.Fatalf("expected a map for each of the %d activities, got %d", len(activities), len(plan.tiles))
+	}
+	area := func(tile posterTile) float64 { return tile.w * tile.h }
+	for i, tile := range plan.tiles {
+		if want := []int64{1, 2, 3, 4}[i]; tile.activities[0].Id != want {
+			t.Errorf("expected the longest first, tile %d is activity %d", i, tile.activities[0].Id)
+		}
+		if i > 0 && area(tile) > area(plan.tiles[i-1])+1e-6 {
+			t.Errorf("tile %d is larger than the longer activity before it", i)
+		}
+		if tile.w < 200 || tile.h < 200 {
+			t.Errorf("tile %d of activity %d is only %gx%g", i, tile.activities[0].Id, tile.w, tile.h)
+		}
+	}
+}
@@ -2,18 +2,19 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"path"
-	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 
+	_ "github.com/scottfrazer/running/fit" // registers the .fit decoder
+	"github.com/scottfrazer/running/gpx"
 	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/tcx"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -22,95 +23,205 @@ func main() {
 		app    = kingpin.New("running", "Scott's Running Manager")
 		login  = app.Command("login", "Strava login")
 		list   = app.Command("list", "List all runs")
-		load   = app.Command("load", "Load Strava data")
-		poster = app.Command("poster", "Create PNG image of runs within a timeframe")
+		load   = app.Command("load", "Load Strava data").Alias("sync")
+		poster = app.Command("poster", "Create a poster of the route maps of runs within a timeframe")
 		stats  = app.Command("stats", "Stats")
+		show   = app.Command("show", "Show the details of a single activity")
+		showId = show.Arg("id", "Strava activity id").Required().Int64()
+
+		loginNoBrowser = login.Flag("no-browser", "Print the authorize URL and read back the redirect URL instead of opening a browser").Bool()
+
+		loadStreams = load.Flag("streams", "Also fetch point-level streams for new activities").Bool()
+		loadStatus  = load.Flag("status", "Show sync progress and the API rate limit budget without syncing").Bool()
+
+		loadReconcile       = load.Flag("reconcile", "Re-check recent activities against Strava, applying edits and deletions").Bool()
+		loadReconcileAfter  = load.Flag("reconcile-after", "Start of the window to reconcile (YYYY-MM-DD); defaults to 30 days ago").String()
+		loadReconcileBefore = load.Flag("reconcile-before", "End of the window to reconcile (YYYY-MM-DD); defaults to now").String()
+
+		streams         = app.Command("streams", "Activity streams")
+		streamsBackfill = streams.Command("backfill", "Fetch streams for activities that don't have them yet")
+		streamsMax      = streamsBackfill.Flag("max", "Maximum number of activities to fetch streams for").Default("90").Int()
+		streamsFilter   = addFilterFlags(streamsBackfill)
+
+		listFilter  = addFilterFlags(list)
+		posterFlags = addPosterFlags(poster)
+		statsFilter = addFilterFlags(stats)
+
+		heatmap      = app.Command("heatmap", "Create a PNG heatmap of where activities' routes go")
+		heatmapFlags = addHeatmapFlags(heatmap)
+
+		serveWebhook            = app.Command("serve-webhook", "Receive Strava push subscription events and apply them as they arrive")
+		serveWebhookAddr        = serveWebhook.Flag("addr", "Address to listen on").Default(":8080").String()
+		serveWebhookPath        = serveWebhook.Flag("path", "Callback path registered with the subscription").Default("/webhook").String()
+		serveWebhookVerifyToken = serveWebhook.Flag("verify-token", "Token Strava echoes back when validating the subscription; required unless replaying").Envar("STRAVA_WEBHOOK_VERIFY_TOKEN").String()
+		serveWebhookReplay      = serveWebhook.Flag("replay", "Apply recorded events from a JSON lines file and exit instead of serving").ExistingFile()
+
+		importCmd          = app.Command("import", "Import activities from files instead of the Strava API")
+		importStravaExport = importCmd.Command("strava-export", "Import a Strava bulk export archive (export_*.zip)")
+		importExportZip    = importStravaExport.Arg("zip", "Path to the archive").Required().ExistingFile()
+		importExportTZ     = importStravaExport.Flag("tz", "Time zone of the activities' local start times, e.g. America/New_York").Default("Local").String()
+		importGPX          = importCmd.Command("gpx", "Import GPX files as local activities")
+		importGPXFiles     = importGPX.Arg("files", "GPX files").Required().ExistingFiles()
+		importTCX          = importCmd.Command("tcx", "Import TCX files, with their laps, as local activities")
+		importTCXFiles     = importTCX.Arg("files", "TCX files").Required().ExistingFiles()
+		importFIT          = importCmd.Command("fit", "Import FIT files from a watch, skipping activities Strava already has")
+		importFITPaths     = importFIT.Arg("paths", "FIT files, or directories such as GARMIN/Activity to search for them").Required().ExistingFilesOrDirs()
+
+		edit      = app.Command("edit", "Change the name, workout type, gear or description of activities on Strava and in the database")
+		editFlags = addEditFlags(edit)
+
+		upload     = app.Command("upload", "Upload local activities or activity files to Strava")
+		uploadArgs = upload.Arg("activities", "Ids of local activities (after --, since they're negative), or GPX, TCX or FIT files").Required().Strings()
+
+		export       = app.Command("export", "Export stored activities to files")
+		exportGPX    = export.Command("gpx", "Write an activity's streams as a GPX track")
+		exportGPXId  = exportGPX.Arg("id", "Activity id").Required().Int64()
+		exportTCX    = export.Command("tcx", "Write an activity's laps and streams as a TCX file")
+		exportTCXId  = exportTCX.Arg("id", "Activity id").Required().Int64()
+		exportOutput = export.Flag("output", "File to write; defaults to <id>.<format>").Short('o').String()
+
+		db        = app.Command("db", "Database maintenance")
+		dbMigrate = db.Command("migrate", "Apply pending schema migrations")
+		dbStatus  = db.Command("status", "Show applied and pending schema migrations")
+
+		dsn = app.Flag("dsn", "Database to use: a Postgres DSN, or sqlite:<path> for an embedded database").
+			Envar("RUNNING_DSN").
+			Default("dbname=website sslmode=disable").
+			String()
+
+		headless = app.Flag("headless", "Never open a browser; fail if there is no Strava session (for cron)").
+				Envar("RUNNING_HEADLESS").
+				Bool()
 	)
 
+	command := kingpin.MustParse(app.Parse(os.Args[1:]))
+
 	googleMapsKey := os.Getenv("GOOGLE_MAPS_API_KEY")
 	stravaClientId := os.Getenv("STRAVA_CLIENT_ID")
 	stravaSecretKey := os.Getenv("STRAVA_SECRET_KEY")
-	headless := false
 
-	store, err := strava.NewPostgresDataStore("dbname=website sslmode=disable")
+	store, err := strava.NewDataStore(*dsn)
 	check(err)
 
-	var client *strava.StravaClient
-	if session, err := store.GetSession(); err != nil {
-		log.Fatalf("error loading session: %v", err)
-	} else if session == nil {
-		if headless {
-			log.Printf("session is expired (headless mode)")
-			os.Exit(1)
-		} else {
-			client, err = strava.NewStravaClientFromBrowserBasedLogin(stravaClientId, stravaSecretKey, store)
-			check(err)
-		}
-	} else {
-		client, err = strava.NewStravaClientFromSession(*session)
+	switch command {
+	case dbMigrate.FullCommand():
+		check(store.Migrate())
+		fmt.Println("database is up to date")
+		return
+	case dbStatus.FullCommand():
+		migrations, err := store.MigrationStatus()
 		check(err)
+		for _, m := range migrations {
+			status := "pending"
+			if !m.Pending() {
+				status = "applied " + m.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%3d  %-27s  %s\n", m.Version, status, m.Description)
+		}
+		return
 	}
 
-	homeDir, err := os.UserHomeDir()
-	check(err)
-
-	ctx := context.Background()
-
-	/////
-	activitiesBytes, err := os.ReadFile(filepath.Join(os.Getenv("HOME"), ".gorun", "activities.json"))
+	migrations, err := store.MigrationStatus()
 	check(err)
-	activities := []strava.SummaryActivity{}
-	check(json.Unmarshal(activitiesBytes, &activities))
-	check(store.Save(activities))
-
-	lapsDir := filepath.Join(os.Getenv("HOME"), ".gorun", "laps")
+	if strings.HasPrefix(*dsn, "sqlite:") && len(migrations) > 0 && migrations[0].Pending() {
+		// A new embedded database is set up on first use; only existing
+		// ones wait for an explicit `db migrate`
+		check(store.Migrate())
+		migrations, err = store.MigrationStatus()
+		check(err)
+	}
+	for _, m := range migrations {
+		if m.Pending() {
+			log.Fatalf("database schema is out of date (migration %d is pending); run `running db migrate`", m.Version)
+		}
+	}
 
-	err = filepath.Walk(lapsDir, func(path string, info os.FileInfo, err error) error {
+	// Only commands that talk to Strava build a client, so DB-only commands
+	// work without a session (and never open a browser)
+	stravaClient := func() *strava.StravaClient {
+		session, err := store.GetSession()
 		if err != nil {
-			return err
+			log.Fatalf("error loading session: %v", err)
+		}
+		if session == nil {
+			if *headless {
+				log.Fatalf("no Strava session (headless mode); run `running login --no-browser` first")
+			}
+			client, err := strava.NewStravaClientFromBrowserBasedLogin(stravaClientId, stravaSecretKey, store)
+			check(err)
+			return client
 		}
-		fmt.Printf("%s\n", path)
-		activityId, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".json"), 10, 64)
+		client, err := strava.NewStravaClientFromSession(*session, strava.WithSessionStore(store))
 		if err != nil {
-			fmt.Printf("... skip\n")
-			return nil
+			log.Fatalf("error refreshing Strava session: %v; run `running login` again", err)
 		}
+		return client
+	}
 
-		if !info.IsDir() {
-			// Read and parse JSON file
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return err
-			}
+	homeDir, err := os.UserHomeDir()
+	check(err)
 
-			var laps []strava.ActivityLap
-			if err := json.Unmarshal(data, &laps); err != nil {
-				return err
-			}
+	ctx := context.Background()
 
-			check(store.SaveLaps(activityId, laps))
+	loadActivities := func(flags *filterFlags) []strava.SummaryActivity {
+		filter, err := flags.Filter()
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
-		return nil
-	})
-
-	if err != nil {
-		fmt.Println("Error:", err)
-	}
-	/////
-
-	check(client.Sync(ctx, store))
-	activities, err = store.Load(strava.ActivityFilter{})
-	check(err)
-	for _, activity := range activities {
-		fmt.Printf("%+v\n", activity)
+		activities, err := store.Load(filter)
+		check(err)
+		return activities
 	}
 
-	command := kingpin.MustParse(app.Parse(os.Args[1:]))
-
 	switch command {
 	case login.FullCommand():
+		if *headless && !*loginNoBrowser {
+			log.Fatalf("login needs a browser in headless mode; use --no-browser")
+		}
+		if *loginNoBrowser {
+			_, err = strava.NewStravaClientFromManualLogin(stravaClientId, stravaSecretKey, store, os.Stdin, os.Stdout)
+		} else {
+			_, err = strava.NewStravaClientFromBrowserBasedLogin(stravaClientId, stravaSecretKey, store)
+		}
+		check(err)
+		fmt.Println("logged in to Strava")
+
 	case load.FullCommand():
+		opts := strava.SyncOptions{
+			Streams:        *loadStreams,
+			Reconcile:      *loadReconcile,
+			ReconcileAfter: time.Now().AddDate(0, 0, -30),
+		}
+		for _, d := range []struct {
+			value string
+			into  *time.Time
+		}{{*loadReconcileAfter, &opts.ReconcileAfter}, {*loadReconcileBefore, &opts.ReconcileBefore}} {
+			if d.value == "" {
+				continue
+			}
+			t, err := time.Parse("2006-01-02", d.value)
+			if err != nil {
+				log.Fatalf("invalid date %q (expected YYYY-MM-DD)", d.value)
+			}
+			*d.into = t
+		}
+
+		var syncErr error
+		if !*loadStatus {
+			syncErr = stravaClient().Sync(ctx, store, opts)
+			if syncErr != nil {
+				log.Printf("sync failed: %v (the next run resumes where this one stopped)", syncErr)
+			}
+		}
+		status, err := strava.GetSyncStatus(store)
+		check(err)
+		printSyncStatus(status)
+		if syncErr != nil {
+			os.Exit(1)
+		}
 	case stats.FullCommand():
+		activities := loadActivities(statsFilter)
+
 		type streak struct {
 			streakType string // run,rest
 			start      *time.Time
@@ -204,46 +315,103 @@ func main() {
 			)
 		}
 
-	case list.FullCommand():
-		for _, a := range activities {
-			if a.WorkoutType == 1 || true {
-				fmt.Printf("%s : %s, %s, type=%d -- %s\n", a.Date().Format("01/02/2006 15:04:05"), a.DistanceString(), a.MovingTimeString(), a.WorkoutType, a.Name)
-			}
+		statsDetailsFilter, err := statsFilter.Filter()
+		check(err)
+		details, err := store.LoadDetails(statsDetailsFilter)
+		check(err)
+		printBestEfforts(details)
+
+	case streamsBackfill.FullCommand():
+		filter, err := streamsFilter.Filter()
+		if err != nil {
+			log.Fatalf("%v", err)
 		}
-	case poster.FullCommand():
-		var activities2 []strava.SummaryActivity
+		fetched, err := stravaClient().BackfillStreams(ctx, store, filter, *streamsMax)
+		fmt.Printf("fetched streams for %d activities\n", fetched)
+		check(err)
 
-		mapID := "9dc6d0f8e5ac205b" // retro
+	case serveWebhook.FullCommand():
+		handler := strava.NewWebhookHandler(stravaClient(), store, *serveWebhookVerifyToken)
+		if *serveWebhookReplay != "" {
+			events, err := os.Open(*serveWebhookReplay)
+			check(err)
+			defer events.Close()
+			check(handler.Replay(ctx, events))
+			return
+		}
+		if *serveWebhookVerifyToken == "" {
+			log.Fatal("--verify-token (or STRAVA_WEBHOOK_VERIFY_TOKEN) is required to serve the subscription callback")
+		}
+		go handler.Run(ctx)
+		mux := http.NewServeMux()
+		mux.Handle(*serveWebhookPath, handler)
+		log.Printf("listening for Strava events on %s%s", *serveWebhookAddr, *serveWebhookPath)
+		log.Fatal(http.ListenAndServe(*serveWebhookAddr, mux))
+
+	case importStravaExport.FullCommand():
+		zone, err := time.LoadLocation(*importExportTZ)
+		check(err)
+		result, err := strava.ImportExport(store, *importExportZip, zone)
+		if result != nil {
+			fmt.Println(result)
+		}
+		check(err)
 
-		for _, activity := range activities {
-			if !strings.HasPrefix(activity.DateString, "2022") {
-				continue
-			}
-			if len(activity.Map.Polyline) == 0 {
-				continue
-			}
-			activities2 = append(activities2, activity)
-			mapsDir := path.Join(homeDir, ".gorun", "maps")
-			os.MkdirAll(mapsDir, 0755)
-			mapPath := path.Join(mapsDir, fmt.Sprintf("%d_%s.png", activity.Id, mapID))
-			if _, err := os.Stat(mapPath); os.IsNotExist(err) {
-				fmt.Printf("Generating image %s for activity: %s\n", mapPath, activity.Name)
-				pngBytes, err := APIGoogleStaticMaps(googleMapsKey, activity.Map.Polyline, mapID)
-				check(err)
-				err = os.WriteFile(mapPath, pngBytes, 0644)
-				check(err)
-			}
+	case importGPX.FullCommand(), importTCX.FullCommand(), importFIT.FullCommand():
+		files := *importGPXFiles
+		switch command {
+		case importTCX.FullCommand():
+			files = *importTCXFiles
+		case importFIT.FullCommand():
+			files, err = findFiles(*importFITPaths, ".fit", ".fit.gz")
+			check(err)
 		}
+		result, err := strava.ImportFiles(store, files)
+		if result != nil {
+			fmt.Println(result)
+		}
+		check(err)
+
+	case edit.FullCommand():
+		editActivities(ctx, stravaClient, store, editFlags)
+
+	case upload.FullCommand():
+		uploadActivities(ctx, stravaClient(), store, *uploadArgs)
+
+	case exportGPX.FullCommand():
+		exportActivity(store, *exportGPXId, "gpx", *exportOutput, gpx.Encode)
+
+	case exportTCX.FullCommand():
+		exportActivity(store, *exportTCXId, "tcx", *exportOutput, tcx.Encode)
 
-		mapPath := func(activityId int64) string {
-			mapsDir := path.Join(homeDir, ".gorun", "maps")
-			return path.Join(mapsDir, fmt.Sprintf("%d_%s.png", activityId, mapID))
+	case show.FullCommand():
+		details, err := store.GetDetails(*showId)
+		check(err)
+		if details == nil {
+			log.Fatalf("no details stored for activity %d; run `running load` to fetch them", *showId)
 		}
+		printActivityDetails(details)
+		revisions, err := store.GetRevisions(*showId)
+		check(err)
+		printRevisions(revisions)
+		edits, err := store.GetEdits(*showId)
+		check(err)
+		printEdits(edits)
 
-		sort.Sort(strava.SummaryActivityDateSort(activities2))
+	case list.FullCommand():
+		for _, a := range loadActivities(listFilter) {
+			if a.WorkoutType == 1 || true {
+				fmt.Printf("%s : %s, %s, type=%d -- %s\n", a.Date().Format("01/02/2006 15:04:05"), a.DistanceString(), a.MovingTimeString(), a.WorkoutType, a.Name)
+			}
+		}
+	case heatmap.FullCommand():
+		check(writeHeatmap(loadActivities(heatmapFlags.filter), heatmapFlags))
 
-		poster := NewTilePoster(activities2, 18.0/24.0, 1280, 1280, 3, 50, mapPath)
-		os.WriteFile("output.png", poster.Generate(), 0755)
-		fmt.Println("================================")
+	case poster.FullCommand():
+		spec, err := posterFlags.Spec()
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		check(writePoster(loadActivities(posterFlags.filter), spec, googleMapsKey, path.Join(homeDir, ".gorun", "maps")))
 	}
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	_ "image/jpeg" // tiles may be JPEGs
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"github.com/scottfrazer/running/geo"
+)
+
+// RouteMapStyle is how drawRouteMap draws a route
+type RouteMapStyle struct {
+	Width      int
+	Height     int
+	Padding    int     // pixels kept clear around the route
+	Stroke     float64 // line width in pixels
+	Color      color.Color
+	Background color.Color
+	// TileDir is an optional directory of cached map tiles, laid out as
+	// {z}/{x}/{y}.png like most tile servers, drawn under the route.
+	// Missing tiles are left as background.
+	TileDir string
+}
+
+func defaultRouteMapStyle() RouteMapStyle {
+	return RouteMapStyle{
+		Width:      1280,
+		Height:     1280,
+		Padding:    80,
+		Stroke:     6,
+		Color:      color.RGBA{0xfc, 0x4c, 0x02, 0xff}, // Strava orange
+		Background: color.White,
+	}
+}
+
+// drawRouteMap draws a route map of the style's size at (x, y): the route
+// fitted inside the padding and centered, using Web Mercator so it lines up
+// with map tiles.  The route is drawn as a line, so it stays sharp in vector
+// formats.
+func drawRouteMap(r posterRenderer, route geo.Route, style RouteMapStyle, x, y float64) {
+	r.FillRect(x, y, float64(style.Width), float64(style.Height), style.Background)
+	if len(route) == 0 {
+		return
+	}
+
+	viewport := geo.FitViewport(route.Bounds(), style.Width, style.Height, style.Padding)
+	if style.TileDir != "" {
+		dc := gg.NewContext(style.Width, style.Height)
+		drawTiles(dc, style.TileDir, viewport)
+		r.DrawImage(dc.Image(), x, y, float64(style.Width), float64(style.Height))
+	}
+
+	points := make([][2]float64, len(route))
+	for i, p := range route {
+		px, py := viewport.Pixel(p)
+		points[i] = [2]float64{x + px, y + py}
+	}
+	if len(points) == 1 {
+		// A path of one point strokes nothing, so mark where it is
+		r.FillCircle(points[0][0], points[0][1], style.Stroke, style.Color)
+		return
+	}
+	r.StrokePolyline(points, style.Stroke, style.Color)
+}
+
+// drawRouteOverlay draws routes over each other in a map of the style's size
+// at (x, y), each from its start at the center and all at the same scale, so
+// their shapes and sizes compare.  They're drawn without map tiles, since
+// they don't share a place.
+func drawRouteOverlay(r posterRenderer, routes []geo.Route, colors []color.Color, style RouteMapStyle, x, y float64) {
+	r.FillRect(x, y, float64(style.Width), float64(style.Height), style.Background)
+
+	offsets := make([][][2]float64, len(routes))
+	extent := 1.0 // meters from the center to fit; at least one
+	for i, route := range routes {
+		offsets[i] = route.Offsets()
+		for _, o := range offsets[i] {
+			extent = math.Max(extent, math.Max(math.Abs(o[0]), math.Abs(o[1])))
+		}
+	}
+	scale := (math.Min(float64(style.Width), float64(style.Height))/2 - float64(style.Padding)) / extent
+	centerX, centerY := x+float64(style.Width)/2, y+float64(style.Height)/2
+
+	for i := range offsets {
+		if len(offsets[i]) == 0 {
+			continue
+		}
+		points := make([][2]float64, len(offsets[i]))
+		for j, o := range offsets[i] {
+			points[j] = [2]float64{centerX + o[0]*scale, centerY - o[1]*scale}
+		}
+		if len(points) == 1 {
+			r.FillCircle(points[0][0], points[0][1], style.Stroke, colors[i])
+			continue
+		}
+		r.StrokePolyline(points, style.Stroke, colors[i])
+	}
+}
+
+// drawTiles draws the cached tiles covering the viewport at the zoom level
+// closest to its scale without enlarging them
+func drawTiles(dc *gg.Context, dir string, viewport geo.Viewport) {
+	const tileSize = 256
+	zoom := int(math.Ceil(math.Log2(viewport.Scale / tileSize)))
+	if zoom < 0 {
+		zoom = 0
+	} else if zoom > 19 {
+		zoom = 19
+	}
+	tiles := 1 << uint(zoom)
+	tileScale := viewport.Scale / float64(tiles*tileSize) // <= 1 unless zoom is capped
+	tilePixels := viewport.Scale / float64(tiles)
+
+	firstX := int(math.Floor(-viewport.OffsetX / tilePixels))
+	lastX := int(math.Floor((float64(viewport.Width) - viewport.OffsetX) / tilePixels))
+	firstY := int(math.Max(0, math.Floor(-viewport.OffsetY/tilePixels)))
+	lastY := int(math.Min(float64(tiles-1), math.Floor((float64(viewport.Height)-viewport.OffsetY)/tilePixels)))
+
+	for ty := firstY; ty <= lastY; ty++ {
+		for tx := firstX; tx <= lastX; tx++ {
+			wrapped := ((tx % tiles) + tiles) % tiles
+			tile, err := gg.LoadImage(filepath.Join(dir, strconv.Itoa(zoom), strconv.Itoa(wrapped), strconv.Itoa(ty)+".png"))
+			if err != nil {
+				continue
+			}
+			dc.Push()
+			dc.Translate(float64(tx)*tilePixels+viewport.OffsetX, float64(ty)*tilePixels+viewport.OffsetY)
+			dc.Scale(tileScale, tileScale)
+			dc.DrawImage(tile, 0, 0)
+			dc.Pop()
+		}
+	}
+}
+
+// parseHexColor parses a CSS style color: #rgb, #rrggbb or #rrggbbaa, with
+// or without the #
+func parseHexColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return nil, fmt.Errorf("invalid color %q (expected #rrggbb)", s)
+	}
+	return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, nil
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/scottfrazer/running/strava"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// PosterSpec is everything about a poster a runner can choose.  It's read
+// from a YAML file given with --spec, with the same names as the flags (but
+// _ for -), and flags given on the command line override it.
+type PosterSpec struct {
+	// Which activities, on top of the filter flags
+	Year   int      `yaml:"year"` // shorthand for after and before
+	After  string   `yaml:"after"`
+	Before string   `yaml:"before"`
+	Types  []string `yaml:"types"`
+
+	Title    string `yaml:"title"` // defaults to the activities' years
+	Subtitle string `yaml:"subtitle"`
+	Font     string `yaml:"font"` // TrueType font file
+
+	Size   string  `yaml:"size"` // printed size, e.g. 18x24in
+	Format string  `yaml:"format"`
+	DPI    float64 `yaml:"dpi"`
+	Output string  `yaml:"output"` // defaults to output.<format>
+
+	Layout   string `yaml:"layout"`    // grid, calendar, treemap or overlay
+	TileSize int    `yaml:"tile_size"` // map width and height in layout units
+	Border   int    `yaml:"border"`
+	Spacing  int    `yaml:"spacing"`
+
+	Maps        string  `yaml:"maps"`
+	GoogleMapId string  `yaml:"google_map_id"`
+	Tiles       string  `yaml:"tiles"`
+	Stroke      float64 `yaml:"stroke"`
+	Padding     int     `yaml:"padding"`
+
+	Paper       string `yaml:"paper"` // poster background
+	BorderColor string `yaml:"border_color"`
+	TextColor   string `yaml:"text_color"`
+	Color       string `yaml:"color"`      // routes
+	Background  string `yaml:"background"` // maps
+
+	// Captions and race badges are text/templates of a *strava.SummaryActivity
+	Caption         string `yaml:"caption"`
+	CaptionPosition string `yaml:"caption_position"` // below or over the map
+	CaptionSize     int    `yaml:"caption_size"`
+	RaceColor       string `yaml:"race_color"`
+	RaceBorder      int    `yaml:"race_border"` // width of the race frame; 0 for none
+	RaceBadge       string `yaml:"race_badge"`  // drawn on a band across the top of races' maps
+
+	// Routes can be colored from the palette by which bucket their distance
+	// (in miles) or pace (in minutes per mile, as m:ss) falls in
+	ColorBy string   `yaml:"color_by"` // none, distance or pace
+	Buckets []string `yaml:"buckets"`  // the lower bounds of every bucket but the first
+	Palette []string `yaml:"palette"`
+}
+
+func defaultPosterSpec() PosterSpec {
+	return PosterSpec{
+		Font:        "Roboto-Regular.ttf",
+		Size:        "18x24in",
+		Format:      "png",
+		DPI:         300,
+		Layout:      "grid",
+		TileSize:    1280,
+		Border:      3,
+		Spacing:     50,
+		Maps:        "local",
+		GoogleMapId: "9dc6d0f8e5ac205b", // retro
+		Stroke:      6,
+		Padding:     80,
+		Paper:       "#ffffff",
+		BorderColor: "#000000",
+		TextColor:   "#000000",
+		Color:       "#fc4c02",
+		Background:  "#ffffff",
+
+		CaptionPosition: "below",
+		CaptionSize:     60,
+		RaceColor:       "#c9a227",
+		RaceBorder:      20,
+
+		ColorBy: "none",
+		Palette: []string{"#1a9641", "#a6d96a", "#fdae61", "#d7191c", "#7b3294"},
+	}
+}
+
+// defaultBuckets are the buckets for each ColorBy if the spec has none
+var defaultBuckets = map[string][]string{
+	"distance": {"3.1", "6.2", "13.1", "26.2"},
+	"pace":     {"7:00", "8:00", "9:00", "10:00"},
+}
+
+// posterFlags are the flags of the poster command.  Each PosterSpec field
+// has a flag, which overrides the spec file only if it's given.
+type posterFlags struct {
+	cmd    *kingpin.CmdClause
+	filter *filterFlags
+	file   *string
+	spec   PosterSpec
+	given  map[string]bool // by YAML name
+}
+
+func addPosterFlags(cmd *kingpin.CmdClause) *posterFlags {
+	defaults := defaultPosterSpec()
+	f := &posterFlags{cmd: cmd, filter: addFilterFlags(cmd), given: map[string]bool{}}
+	f.file = cmd.Flag("spec", "YAML poster spec; flags override it").ExistingFile()
+
+	f.flag("year", "Only include activities from this year").IntVar(&f.spec.Year)
+	f.flag("title", "Title; defaults to the year(s) of the activities").StringVar(&f.spec.Title)
+	f.flag("subtitle", "Subtitle, under the title").StringVar(&f.spec.Subtitle)
+	f.flag("font", "TrueType font file for the text").Default(defaults.Font).StringVar(&f.spec.Font)
+
+	f.flag("size", "Printed size, e.g. 18x24in, 50x70cm or 594x841mm; sets the poster's proportions").Default(defaults.Size).StringVar(&f.spec.Size)
+	f.flag("format", "Output format; svg and pdf draw local maps' routes as vectors").Default(defaults.Format).EnumVar(&f.spec.Format, "png", "svg", "pdf")
+	f.flag("dpi", "Resolution of PNG output, in pixels per inch").Default(fmt.Sprint(defaults.DPI)).Float64Var(&f.spec.DPI)
+	f.flag("output", "File to write; defaults to output.<format>").Short('o').StringVar(&f.spec.Output)
+
+	f.flag("layout", "How to lay out the maps: a grid, a calendar of weeks, a treemap sized by distance, or every route overlaid from a common origin").Default(defaults.Layout).EnumVar(&f.spec.Layout, "grid", "calendar", "treemap", "overlay")
+	f.flag("tile-size", "Width and height of each map, in layout units (pixels at the maps' own resolution)").Default(strconv.Itoa(defaults.TileSize)).IntVar(&f.spec.TileSize)
+	f.flag("border", "Width of the border around each map").Default(strconv.Itoa(defaults.Border)).IntVar(&f.spec.Border)
+	f.flag("spacing", "Space between maps").Default(strconv.Itoa(defaults.Spacing)).IntVar(&f.spec.Spacing)
+
+	f.flag("maps", "Where route maps come from: local renders them offline, google fetches them from Google Static Maps (needs GOOGLE_MAPS_API_KEY)").Default(defaults.Maps).EnumVar(&f.spec.Maps, "local", "google")
+	f.flag("google-map-id", "Google Maps map id, which picks the style of Google maps").Default(defaults.GoogleMapId).StringVar(&f.spec.GoogleMapId)
+	f.flag("tiles", "Directory of cached map tiles ({z}/{x}/{y}.png) to draw under local maps").ExistingDirVar(&f.spec.Tiles)
+	f.flag("stroke", "Route line width, for local maps").Default(fmt.Sprint(defaults.Stroke)).Float64Var(&f.spec.Stroke)
+	f.flag("padding", "Space kept clear around each route, for local maps").Default(strconv.Itoa(defaults.Padding)).IntVar(&f.spec.Padding)
+
+	f.flag("paper", "Poster background color").Default(defaults.Paper).StringVar(&f.spec.Paper)
+	f.flag("border-color", "Map border color").Default(defaults.BorderColor).StringVar(&f.spec.BorderColor)
+	f.flag("text-color", "Title and subtitle color").Default(defaults.TextColor).StringVar(&f.spec.TextColor)
+	f.flag("color", "Route color, for local maps").Default(defaults.Color).StringVar(&f.spec.Color)
+	f.flag("background", "Map background color, for local maps").Default(defaults.Background).StringVar(&f.spec.Background)
+
+	f.flag("caption", "Template of each map's caption, e.g. '{{.Date.Format \"Jan 2\"}} {{.DistanceString}} {{.PacePerMile}}/mi'").StringVar(&f.spec.Caption)
+	f.flag("caption-position", "Where captions go").Default(defaults.CaptionPosition).EnumVar(&f.spec.CaptionPosition, "below", "over")
+	f.flag("caption-size", "Caption font size").Default(strconv.Itoa(defaults.CaptionSize)).IntVar(&f.spec.CaptionSize)
+	f.flag("race-color", "Color of the frame and badge of races").Default(defaults.RaceColor).StringVar(&f.spec.RaceColor)
+	f.flag("race-border", "Width of the frame around races; 0 for none").Default(strconv.Itoa(defaults.RaceBorder)).IntVar(&f.spec.RaceBorder)
+	f.flag("race-badge", "Template of a badge across the top of races, e.g. RACE or '{{.Name}}'").StringVar(&f.spec.RaceBadge)
+
+	f.flag("color-by", "Color local maps' routes by distance or pace bucket").Default(defaults.ColorBy).EnumVar(&f.spec.ColorBy, "none", "distance", "pace")
+	f.flag("buckets", "Lower bound of each bucket after the first, in miles or m:ss per mile; may be repeated").StringsVar(&f.spec.Buckets)
+	f.flag("palette", "Color of each bucket, from the lowest; may be repeated").StringsVar(&f.spec.Palette)
+	return f
+}
+
+// flag adds a flag for the PosterSpec field with the same YAML name, but -
+// for _, remembering whether it's given
+func (f *posterFlags) flag(name, help string) *kingpin.FlagClause {
+	field := strings.Replace(name, "-", "_", -1)
+	return f.cmd.Flag(name, help).Action(func(*kingpin.ParseContext) error {
+		f.given[field] = true
+		return nil
+	})
+}
+
+// Spec is the defaults, overridden by the spec file, overridden by the flags
+// given.  The spec's dates and types are applied to the filter flags that
+// weren't given.
+func (f *posterFlags) Spec() (PosterSpec, error) {
+	spec := defaultPosterSpec()
+	if *f.file != "" {
+		contents, err := os.ReadFile(*f.file)
+		if err != nil {
+			return spec, err
+		}
+		if err := yaml.UnmarshalStrict(contents, &spec); err != nil {
+			return spec, fmt.Errorf("invalid poster spec %s: %v", *f.file, err)
+		}
+	}
+
+	specValue, flagValue := reflect.ValueOf(&spec).Elem(), reflect.ValueOf(f.spec)
+	for i := 0; i < specValue.NumField(); i++ {
+		if f.given[specValue.Type().Field(i).Tag.Get("yaml")] {
+			specValue.Field(i).Set(flagValue.Field(i))
+		}
+	}
+
+	if spec.Year != 0 {
+		if spec.After == "" {
+			spec.After = fmt.Sprintf("%d-01-01", spec.Year)
+		}
+		if spec.Before == "" {
+			spec.Before = fmt.Sprintf("%d-01-01", spec.Year+1)
+		}
+	}
+	if *f.filter.after == "" {
+		*f.filter.after = spec.After
+	}
+	if *f.filter.before == "" {
+		*f.filter.before = spec.Before
+	}
+	if len(*f.filter.types) == 0 {
+		*f.filter.types = spec.Types
+	}
+	return spec, nil
+}
+
+// writePoster draws a TilePoster of the activities with a map, oldest first
+func writePoster(activities []strava.SummaryActivity, spec PosterSpec, googleMapsKey, mapsDir string) error {
+	var mapped []strava.SummaryActivity
+	for _, activity := range activities {
+		if len(activity.Map.Polyline) > 0 {
+			mapped = append(mapped, activity)
+		}
+	}
+	if len(mapped) == 0 {
+		return fmt.Errorf("none of the %d activities have a route", len(activities))
+	}
+	sort.Sort(strava.SummaryActivityDateSort(mapped))
+
+	out := PosterOutput{Format: spec.Format, DPI: spec.DPI}
+	var err error
+	if out.Width, out.Height, err = parsePhysicalSize(spec.Size); err != nil {
+		return err
+	}
+
+	style := TilePosterStyle{Title: spec.Title, Subtitle: spec.Subtitle, Font: spec.Font}
+	if style.Title == "" {
+		style.Title = yearsTitle(mapped)
+	}
+	mapStyle := defaultRouteMapStyle()
+	mapStyle.Width, mapStyle.Height = spec.TileSize, spec.TileSize
+	mapStyle.Stroke = spec.Stroke
+	mapStyle.Padding = spec.Padding
+	mapStyle.TileDir = spec.Tiles
+	for _, c := range []struct {
+		value string
+		into  *color.Color
+	}{
+		{spec.Paper, &style.Background},
+		{spec.BorderColor, &style.Border},
+		{spec.TextColor, &style.Text},
+		{spec.Color, &mapStyle.Color},
+		{spec.Background, &mapStyle.Background},
+		{spec.RaceColor, &style.RaceColor},
+	} {
+		if *c.into, err = parseHexColor(c.value); err != nil {
+			return err
+		}
+	}
+
+	if spec.CaptionPosition != "below" && spec.CaptionPosition != "over" {
+		return fmt.Errorf("unknown caption position %q (expected below or over)", spec.CaptionPosition)
+	}
+	style.CaptionBelow = spec.CaptionPosition == "below"
+	style.CaptionSize = float64(spec.CaptionSize)
+	style.RaceBorder = float64(spec.RaceBorder)
+	if style.Captions, err = activityTexts("caption", spec.Caption, mapped); err != nil {
+		return err
+	}
+	var races []strava.SummaryActivity
+	for _, activity := range mapped {
+		if activity.IsRace() {
+			races = append(races, activity)
+		}
+	}
+	if style.RaceBadges, err = activityTexts("race badge", spec.RaceBadge, races); err != nil {
+		return err
+	}
+	routeColor, err := bucketColors(spec)
+	if err != nil {
+		return err
+	}
+
+	layout, err := newPosterLayout(spec.Layout)
+	if err != nil {
+		return err
+	}
+
+	var drawMap posterMap
+	switch spec.Maps {
+	case "local":
+		drawMap = routePosterMap(mapStyle, routeColor)
+	case "google":
+		if routeColor != nil {
+			return fmt.Errorf("routes can only be colored by %s on local maps", spec.ColorBy)
+		}
+		if spec.Layout == "overlay" {
+			return fmt.Errorf("routes can only be overlaid on local maps")
+		}
+		drawMap = rasterPosterMap(googleMapPaths(googleMapsKey, mapped, mapsDir, spec.GoogleMapId))
+	default:
+		return fmt.Errorf("unknown maps %q (expected local or google)", spec.Maps)
+	}
+
+	outputPath := spec.Output
+	if outputPath == "" {
+		outputPath = "output." + out.Format
+	}
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	poster := NewTilePoster(mapped, out.Ratio(), layout, spec.TileSize, spec.TileSize, spec.Border, spec.Spacing, style, drawMap)
+	if err := poster.Generate(output, out); err != nil {
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s (%gx%g in)\n", outputPath, out.Width, out.Height)
+	return nil
+}
+
+// activityTexts executes a template of a *strava.SummaryActivity for each
+// activity, by id.  There are none for an empty template.
+func activityTexts(name, text string, activities []strava.SummaryActivity) (map[int64]string, error) {
+	if text == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	texts := map[int64]string{}
+	for i := range activities {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, &activities[i]); err != nil {
+			return nil, fmt.Errorf("%s of activity %d: %v", name, activities[i].Id, err)
+		}
+		texts[activities[i].Id] = strings.TrimSpace(b.String())
+	}
+	return texts, nil
+}
+
+// bucketColors returns the palette color of the bucket each activity's
+// distance or pace falls in, or nil if routes aren't colored by either
+func bucketColors(spec PosterSpec) (func(*strava.SummaryActivity) color.Color, error) {
+	var value func(*strava.SummaryActivity) float64
+	switch spec.ColorBy {
+	case "none":
+		return nil, nil
+	case "distance":
+		value = (*strava.SummaryActivity).Miles
+	case "pace":
+		value = func(a *strava.SummaryActivity) float64 {
+			return float64(a.MovingTime) / 60 / a.Miles()
+		}
+	default:
+		return nil, fmt.Errorf("unknown color by %q (expected none, distance or pace)", spec.ColorBy)
+	}
+
+	buckets := spec.Buckets
+	if len(buckets) == 0 {
+		buckets = defaultBuckets[spec.ColorBy]
+	}
+	bounds := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		var err error
+		if spec.ColorBy == "pace" {
+			bounds[i], err = parsePace(bucket)
+		} else {
+			bounds[i], err = strconv.ParseFloat(bucket, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s bucket %q", spec.ColorBy, bucket)
+		}
+		if i > 0 && bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("%s buckets must increase, but %s follows %s", spec.ColorBy, bucket, buckets[i-1])
+		}
+	}
+	if len(spec.Palette) < len(bounds)+1 {
+		return nil, fmt.Errorf("%d buckets need a palette of %d colors, not %d", len(bounds)+1, len(bounds)+1, len(spec.Palette))
+	}
+	palette := make([]color.Color, len(bounds)+1)
+	for i := range palette {
+		var err error
+		if palette[i], err = parseHexColor(spec.Palette[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(a *strava.SummaryActivity) color.Color {
+		v := value(a)
+		i := 0
+		for i < len(bounds) && v >= bounds[i] {
+			i++
+		}
+		return palette[i]
+	}, nil
+}
+
+// parsePace parses a pace per mile such as 7:30, or a number of minutes
+// such as 7.5, into minutes
+func parsePace(s string) (float64, error) {
+	invalid := fmt.Errorf("invalid pace %q (expected m:ss)", s)
+	parts := strings.Split(s, ":")
+	if len(parts) == 1 {
+		minutes, err := strconv.ParseFloat(s, 64)
+		if err != nil || minutes <= 0 {
+			return 0, invalid
+		}
+		return minutes, nil
+	}
+	if len(parts) != 2 || len(parts[1]) != 2 {
+		return 0, invalid
+	}
+	minutes, err := strconv.Atoi(parts[0])
+	if err != nil || minutes < 0 {
+		return 0, invalid
+	}
+	seconds, err := strconv.Atoi(parts[1])
+	if err != nil || seconds < 0 || seconds >= 60 || minutes == 0 && seconds == 0 {
+		return 0, invalid
+	}
+	return float64(minutes) + float64(seconds)/60, nil
+}
+
+// yearsTitle is the year of the activities, or the range of years they span
+func yearsTitle(activities []strava.SummaryActivity) string {
+	first, last := activities[0].Date().Year(), activities[0].Date().Year()
+	for _, activity := range activities {
+		if year := activity.Date().Year(); year < first {
+			first = year
+		} else if year > last {
+			last = year
+		}
+	}
+	if first == last {
+		return strconv.Itoa(first)
+	}
+	return fmt.Sprintf("%d–%d", first, last)
+}
+
+// googleMapPaths fetches each activity's map from Google Static Maps into
+// dir, unless it's there already, and returns the mapPath function
+// rasterPosterMap reads them with
+func googleMapPaths(googleMapsKey string, activities []strava.SummaryActivity, dir, mapID string) func(int64) string {
+	mapPath := func(activityId int64) string {
+		return path.Join(dir, fmt.Sprintf("%d_%s.png", activityId, mapID))
+	}
+
+	os.MkdirAll(dir, 0755)
+	for _, activity := range activities {
+		if _, err := os.Stat(mapPath(activity.Id)); os.IsNotExist(err) {
+			fmt.Printf("Generating image %s for activity: %s\n", mapPath(activity.Id), activity.Name)
+			pngBytes, err := APIGoogleStaticMaps(googleMapsKey, activity.Map.Polyline, mapID)
+			check(err)
+			err = os.WriteFile(mapPath(activity.Id), pngBytes, 0644)
+			check(err)
+		}
+	}
+	return mapPath
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func TestParsePace(t *testing.T) {
+	for _, test := range []struct {
+		pace    string
+		minutes float64
+		err     bool
+	}{
+		{pace: "7:30", minutes: 7.5},
+		{pace: "10:00", minutes: 10},
+		{pace: "0:45", minutes: 0.75},
+		{pace: "7.25", minutes: 7.25},
+		{pace: "7:60", err: true},
+		{pace: "7:5", err: true},
+		{pace: "7:-5", err: true},
+		{pace: "-7:30", err: true},
+		{pace: "0:00", err: true},
+		{pace: "0", err: true},
+		{pace: "1:02:03", err: true},
+		{pace: "seven", err: true},
+		{pace: "", err: true},
+	} {
+		minutes, err := parsePace(test.pace)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %g", test.pace, minutes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.pace, err)
+		} else if minutes != test.minutes {
+			t.Errorf("%q: expected %g minutes, got %g", test.pace, test.minutes, minutes)
+		}
+	}
+}
+
+func TestBucketColors(t *testing.T) {
+	// run is an activity of some miles at a pace in minutes per mile
+	run := func(miles, pace float64) *strava.SummaryActivity {
+		return &strava.SummaryActivity{Distance: miles / 0.621371 * 1000, MovingTime: miles * pace * 60}
+	}
+	palette := []string{"#000000", "#111111", "#222222", "#333333", "#444444"}
+	gray := func(v uint8) color.Color { return color.NRGBA{v, v, v, 0xff} }
+
+	for _, test := range []struct {
+		name     string
+		spec     PosterSpec
+		activity *strava.SummaryActivity
+		color    color.Color
+	}{
+		{"below the first bucket", PosterSpec{ColorBy: "distance", Palette: palette}, run(2, 8), gray(0x00)},
+		{"on a bucket's lower bound", PosterSpec{ColorBy: "distance", Palette: palette}, run(6.2, 8), gray(0x22)},
+		{"past the last bucket", PosterSpec{ColorBy: "distance", Palette: palette}, run(31, 8), gray(0x44)},
+		{"custom distance buckets", PosterSpec{ColorBy: "distance", Buckets: []string{"5", "10"}, Palette: palette}, run(7, 8), gray(0x11)},
+		{"fast pace", PosterSpec{ColorBy: "pace", Buckets: []string{"7:00", "8:30"}, Palette: palette}, run(5, 6.5), gray(0x00)},
+		{"slow pace", PosterSpec{ColorBy: "pace", Buckets: []string{"7:00", "8:30"}, Palette: palette}, run(5, 9), gray(0x22)},
+		{"default pace buckets", PosterSpec{ColorBy: "pace", Palette: palette}, run(5, 8.5), gray(0x22)},
+	} {
+		colorOf, err := bucketColors(test.spec)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if c := colorOf(test.activity); c != test.color {
+			t.Errorf("%s: expected %v, got %v", test.name, test.color, c)
+		}
+	}
+
+	if colorOf, err := bucketColors(PosterSpec{ColorBy: "none", Palette: palette}); colorOf != nil || err != nil {
+		t.Errorf("expected no colors for none, got %v", err)
+	}
+
+	for _, test := range []struct {
+		name string
+		spec PosterSpec
+	}{
+		{"unknown color by", PosterSpec{ColorBy: "heartrate", Palette: palette}},
+		{"equal buckets", PosterSpec{ColorBy: "distance", Buckets: []string{"5", "5"}, Palette: palette}},
+		{"decreasing buckets", PosterSpec{ColorBy: "pace", Buckets: []string{"8:00", "7:00"}, Palette: palette}},
+		{"invalid distance", PosterSpec{ColorBy: "distance", Buckets: []string{"5k"}, Palette: palette}},
+		{"invalid pace", PosterSpec{ColorBy: "pace", Buckets: []string{"7:75"}, Palette: palette}},
+		{"short palette", PosterSpec{ColorBy: "distance", Palette: palette[:4]}},
+		{"invalid palette color", PosterSpec{ColorBy: "distance", Buckets: []string{"5"}, Palette: []string{"#000000", "orange"}}},
+	} {
+		if _, err := bucketColors(test.spec); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"github.com/golang/freetype/truetype"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// posterRenderer draws a poster in one output format.  Coordinates and sizes
+// are in the poster's layout units, with y down; each renderer scales them to
+// its output.
+type posterRenderer interface {
+	FillRect(x, y, w, h float64, c color.Color)
+	FillCircle(x, y, r float64, c color.Color)
+	// StrokePolyline draws a line through the points with round caps and
+	// joins
+	StrokePolyline(points [][2]float64, width float64, c color.Color)
+	// DrawImage draws an image stretched to the rectangle
+	DrawImage(img image.Image, x, y, w, h float64)
+	// DrawText draws text centered on (x, y) in a TrueType font file
+	DrawText(s string, x, y, size float64, font string, c color.Color)
+	// Encode writes the output, or the first error drawing it
+	Encode(w io.Writer) error
+}
+
+// PosterOutput is the format and physical size a poster is written at
+type PosterOutput struct {
+	Format string  // png, svg or pdf
+	Width  float64 // inches
+	Height float64 // inches
+	DPI    float64 // pixels per inch, for PNGs
+}
+
+func (out PosterOutput) Ratio() float64 {
+	return out.Width / out.Height
+}
+
+// newPosterRenderer returns a renderer that draws a layout of width by height
+// units at the output's physical size
+func newPosterRenderer(out PosterOutput, width, height float64) (posterRenderer, error) {
+	switch out.Format {
+	case "png":
+		scale := out.Width * out.DPI / width
+		return newPNGRenderer(int(math.Round(width*scale)), int(math.Round(height*scale)), scale), nil
+	case "svg":
+		return &svgRenderer{width: width, height: height, out: out}, nil
+	case "pdf":
+		return newPDFRenderer(width, out), nil
+	}
+	return nil, fmt.Errorf("unknown poster format %q (expected png, svg or pdf)", out.Format)
+}
+
+var physicalSize = regexp.MustCompile(`^([0-9.]+)x([0-9.]+)(in|cm|mm)$`)
+
+// parsePhysicalSize parses a size such as 18x24in, 50x70cm or 594x841mm
+// into inches
+func parsePhysicalSize(s string) (width, height float64, err error) {
+	m := physicalSize.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, 0, fmt.Errorf("invalid size %q (expected e.g. 18x24in, 50x70cm or 594x841mm)", s)
+	}
+	width, werr := strconv.ParseFloat(m[1], 64)
+	height, herr := strconv.ParseFloat(m[2], 64)
+	if werr != nil || herr != nil || width <= 0 || height <= 0 {
+		return 0, 0, fmt.Errorf("invalid size %q", s)
+	}
+	perInch := map[string]float64{"in": 1, "cm": 2.54, "mm": 25.4}[m[3]]
+	return width / perInch, height / perInch, nil
+}
+
+// pngRenderer rasterizes with gg
+type pngRenderer struct {
+	dc    *gg.Context
+	scale float64 // pixels per unit
+	err   error
+}
+
+func newPNGRenderer(width, height int, scale float64) *pngRenderer {
+	return &pngRenderer{dc: gg.NewContext(width, height), scale: scale}
+}
+
+func (r *pngRenderer) FillRect(x, y, w, h float64, c color.Color) {
+	r.dc.DrawRectangle(x*r.scale, y*r.scale, w*r.scale, h*r.scale)
+	r.dc.SetColor(c)
+	r.dc.Fill()
+}
+
+func (r *pngRenderer) FillCircle(x, y, radius float64, c color.Color) {
+	r.dc.DrawCircle(x*r.scale, y*r.scale, radius*r.scale)
+	r.dc.SetColor(c)
+	r.dc.Fill()
+}
+
+func (r *pngRenderer) StrokePolyline(points [][2]float64, width float64, c color.Color) {
+	for _, p := range points {
+		r.dc.LineTo(p[0]*r.scale, p[1]*r.scale)
+	}
+	r.dc.SetColor(c)
+	r.dc.SetLineWidth(width * r.scale)
+	r.dc.SetLineCapRound()
+	r.dc.SetLineJoinRound()
+	r.dc.Stroke()
+}
+
+func (r *pngRenderer) DrawImage(img image.Image, x, y, w, h float64) {
+	bounds := img.Bounds()
+	r.dc.Push()
+	r.dc.Translate(x*r.scale, y*r.scale)
+	r.dc.Scale(w*r.scale/float64(bounds.Dx()), h*r.scale/float64(bounds.Dy()))
+	r.dc.DrawImage(img, -bounds.Min.X, -bounds.Min.Y)
+	r.dc.Pop()
+}
+
+func (r *pngRenderer) DrawText(s string, x, y, size float64, font string, c color.Color) {
+	if err := r.dc.LoadFontFace(font, size*r.scale); err != nil {
+		if r.err == nil {
+			r.err = fmt.Errorf("loading font %s: %w", font, err)
+		}
+		return
+	}
+	r.dc.SetColor(c)
+	r.dc.DrawStringAnchored(s, x*r.scale, y*r.scale, 0.5, 0.5)
+}
+
+func (r *pngRenderer) Encode(w io.Writer) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.dc.EncodePNG(w)
+}
+
+// svgRenderer writes vector SVG in layout units, sized to the physical size.
+// Images are embedded as PNGs.
+type svgRenderer struct {
+	width    float64
+	height   float64
+	out      PosterOutput
+	body     bytes.Buffer
+	families map[string]string // font file => family name
+	err      error
+}
+
+func svgNumber(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// svgPaint returns the attributes that paint with c, e.g. fill="#fc4c02"
+func svgPaint(attribute string, c color.Color) string {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	paint := fmt.Sprintf(`%s="#%02x%02x%02x"`, attribute, n.R, n.G, n.B)
+	if n.A != 0xff {
+		paint += fmt.Sprintf(` %s-opacity="%s"`, attribute, svgNumber(float64(n.A)/0xff))
+	}
+	return paint
+}
+
+func (r *svgRenderer) FillRect(x, y, w, h float64, c color.Color) {
+	fmt.Fprintf(&r.body, "<rect x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\" %s/>\n",
+		svgNumber(x), svgNumber(y), svgNumber(w), svgNumber(h), svgPaint("fill", c))
+}
+
+func (r *svgRenderer) FillCircle(x, y, radius float64, c color.Color) {
+	fmt.Fprintf(&r.body, "<circle cx=\"%s\" cy=\"%s\" r=\"%s\" %s/>\n",
+		svgNumber(x), svgNumber(y), svgNumber(radius), svgPaint("fill", c))
+}
+
+func (r *svgRenderer) StrokePolyline(points [][2]float64, width float64, c color.Color) {
+	coordinates := make([]string, len(points))
+	for i, p := range points {
+		coordinates[i] = svgNumber(p[0]) + "," + svgNumber(p[1])
+	}
+	fmt.Fprintf(&r.body, "<polyline points=\"%s\" fill=\"none\" %s stroke-width=\"%s\" stroke-linecap=\"round\" stroke-linejoin=\"round\"/>\n",
+		strings.Join(coordinates, " "), svgPaint("stroke", c), svgNumber(width))
+}
+
+func (r *svgRenderer) DrawImage(img image.Image, x, y, w, h float64) {
+	var buf bytes.Buffer
+	check(png.Encode(&buf, img))
+	fmt.Fprintf(&r.body, "<image x=\"%s\" y=\"%s\" width=\"%s\" height=\"%s\" preserveAspectRatio=\"none\" xlink:href=\"data:image/png;base64,%s\"/>\n",
+		svgNumber(x), svgNumber(y), svgNumber(w), svgNumber(h), base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+// DrawText names the font's family rather than embedding it, so the font
+// must be installed where the SVG is viewed or printed
+func (r *svgRenderer) DrawText(s string, x, y, size float64, font string, c color.Color) {
+	family, ok := r.families[font]
+	if !ok {
+		var err error
+		if family, err = fontFamily(font); err != nil && r.err == nil {
+			r.err = err
+		}
+		if r.families == nil {
+			r.families = map[string]string{}
+		}
+		r.families[font] = family
+	}
+	fmt.Fprintf(&r.body, "<text x=\"%s\" y=\"%s\" font-family=\"", svgNumber(x), svgNumber(y))
+	xml.EscapeText(&r.body, []byte(family))
+	fmt.Fprintf(&r.body, ", sans-serif\" font-size=\"%s\" text-anchor=\"middle\" dominant-baseline=\"central\" %s>", svgNumber(size), svgPaint("fill", c))
+	xml.EscapeText(&r.body, []byte(s))
+	r.body.WriteString("</text>\n")
+}
+
+// fontFamily reads the family name, e.g. Roboto, from a TrueType font file
+func fontFamily(font string) (string, error) {
+	contents, err := os.ReadFile(font)
+	if err != nil {
+		return "", fmt.Errorf("loading font %s: %w", font, err)
+	}
+	parsed, err := truetype.Parse(contents)
+	if err != nil {
+		return "", fmt.Errorf("loading font %s: %w", font, err)
+	}
+	return parsed.Name(truetype.NameIDFontFamily), nil
+}
+
+func (r *svgRenderer) Encode(w io.Writer) error {
+	if r.err != nil {
+		return r.err
+	}
+	_, err := fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"+
+		"<svg xmlns=\"http://www.w3.org/2000/svg\" xmlns:xlink=\"http://www.w3.org/1999/xlink\" width=\"%sin\" height=\"%sin\" viewBox=\"0 0 %s %s\">\n%s</svg>\n",
+		svgNumber(r.out.Width), svgNumber(r.out.Height), svgNumber(r.width), svgNumber(r.height), r.body.Bytes())
+	return err
+}
+
+// pdfRenderer draws a one page vector PDF of the physical size.  Images are
+// embedded as PNGs.
+type pdfRenderer struct {
+	pdf    *gofpdf.Fpdf
+	scale  float64 // points per unit
+	images int
+	fonts  map[string]string // font file => name it was added as
+}
+
+func newPDFRenderer(width float64, out PosterOutput) *pdfRenderer {
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{
+		UnitStr: "pt",
+		Size:    gofpdf.SizeType{Wd: out.Width * 72, Ht: out.Height * 72},
+	})
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+	return &pdfRenderer{pdf: pdf, scale: out.Width * 72 / width, fonts: map[string]string{}}
+}
+
+// paint sets the color and opacity of what's drawn next, returning the
+// color's components
+func (r *pdfRenderer) paint(c color.Color) (int, int, int) {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	r.pdf.SetAlpha(float64(n.A)/0xff, "Normal")
+	return int(n.R), int(n.G), int(n.B)
+}
+
+func (r *pdfRenderer) FillRect(x, y, w, h float64, c color.Color) {
+	r.pdf.SetFillColor(r.paint(c))
+	r.pdf.Rect(x*r.scale, y*r.scale, w*r.scale, h*r.scale, "F")
+}
+
+func (r *pdfRenderer) FillCircle(x, y, radius float64, c color.Color) {
+	r.pdf.SetFillColor(r.paint(c))
+	r.pdf.Circle(x*r.scale, y*r.scale, radius*r.scale, "F")
+}
+
+func (r *pdfRenderer) StrokePolyline(points [][2]float64, width float64, c color.Color) {
+	if len(points) == 0 {
+		return
+	}
+	r.pdf.SetDrawColor(r.paint(c))
+	r.pdf.SetLineWidth(width * r.scale)
+	r.pdf.SetLineCapStyle("round")
+	r.pdf.SetLineJoinStyle("round")
+	r.pdf.MoveTo(points[0][0]*r.scale, points[0][1]*r.scale)
+	for _, p := range points[1:] {
+		r.pdf.LineTo(p[0]*r.scale, p[1]*r.scale)
+	}
+	r.pdf.DrawPath("D")
+}
+
+func (r *pdfRenderer) DrawImage(img image.Image, x, y, w, h float64) {
+	var buf bytes.Buffer
+	check(png.Encode(&buf, img))
+	r.images++
+	name := fmt.Sprintf("image%d", r.images)
+	options := gofpdf.ImageOptions{ImageType: "PNG"}
+	r.paint(color.Black)
+	r.pdf.RegisterImageOptionsReader(name, options, &buf)
+	r.pdf.ImageOptions(name, x*r.scale, y*r.scale, w*r.scale, h*r.scale, false, options, 0, "")
+}
+
+func (r *pdfRenderer) DrawText(s string, x, y, size float64, font string, c color.Color) {
+	name, ok := r.fonts[font]
+	if !ok {
+		name = fmt.Sprintf("font%d", len(r.fonts)+1)
+		r.fonts[font] = name
+		// AddUTF8Font would look for the file in gofpdf's font directory
+		contents, err := os.ReadFile(font)
+		if err != nil {
+			r.pdf.SetErrorf("loading font %s: %v", font, err)
+			return
+		}
+		r.pdf.AddUTF8FontFromBytes(name, "", contents)
+	}
+	r.pdf.SetFont(name, "", size*r.scale)
+	r.pdf.SetTextColor(r.paint(c))
+	// Text is placed by its baseline; half the cap height below the center
+	// centers digits and capitals
+	_, fontSize := r.pdf.GetFontSize()
+	r.pdf.Text(x*r.scale-r.pdf.GetStringWidth(s)/2, y*r.scale+fontSize*capHeight/2, s)
+}
+
+func (r *pdfRenderer) Encode(w io.Writer) error {
+	return r.pdf.Output(w)
+}
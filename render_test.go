@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestParsePhysicalSize(t *testing.T) {
+	for _, test := range []struct {
+		size          string
+		width, height float64
+		err           bool
+	}{
+		{size: "18x24in", width: 18, height: 24},
+		{size: "24X18IN", width: 24, height: 18},
+		{size: "8.5x11in", width: 8.5, height: 11},
+		{size: "50.8x76.2cm", width: 20, height: 30},
+		{size: "254x508mm", width: 10, height: 20},
+		{size: "18x24", err: true},
+		{size: "18x24ft", err: true},
+		{size: "0x24in", err: true},
+		{size: "18x0.0in", err: true},
+		{size: "1.2.3x24in", err: true},
+		{size: "18 x 24in", err: true},
+		{size: "", err: true},
+	} {
+		width, height, err := parsePhysicalSize(test.size)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %gx%g", test.size, width, height)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.size, err)
+		} else if width != test.width || height != test.height {
+			t.Errorf("%q: expected %gx%g in, got %gx%g", test.size, test.width, test.height, width, height)
+		}
+	}
+}
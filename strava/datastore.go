@@ -0,0 +1,574 @@
+package strava
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DataStore persists Strava activities, laps and the OAuth session
+type DataStore interface {
+	Save(activities []SummaryActivity) error
+	SaveLaps(activityId int64, laps []ActivityLap) error
+	GetLaps(activityId int64) ([]ActivityLap, error)
+	DeleteActivity(activityId int64) error
+	MarkDeleted(activityId int64) error
+	GetRevisions(activityId int64) ([]ActivityRevision, error)
+	SaveEdit(activityId int64, edit ActivityEditRecord) error
+	GetEdits(activityId int64) ([]ActivityEditRecord, error)
+	SaveDetails(activity DetailedActivity) error
+	GetDetails(activityId int64) (*DetailedActivity, error)
+	LoadDetails(filters ActivityFilter) ([]DetailedActivity, error)
+	SaveStreams(activityId int64, streams *Streams) error
+	GetStreams(activityId int64) (*Streams, error)
+	LoadMissingStreams(filters ActivityFilter) ([]SummaryActivity, error)
+	LoadMissingLaps(filters ActivityFilter) ([]SummaryActivity, error)
+	LoadMissingDetails(filters ActivityFilter) ([]SummaryActivity, error)
+	GetSyncState() (*SyncState, error)
+	SaveSyncState(state *SyncState) error
+	GetActivity(activityId int64) (*SummaryActivity, error)
+	NextLocalActivityId() (int64, error)
+	Load(filters ActivityFilter) ([]SummaryActivity, error)
+	LoadPage(page, perPage int) ([]SummaryActivity, error)
+	GetSession() (*StravaSession, error)
+	SaveSession(session *StravaSession) error
+	GetMostRecentActivityDate() (time.Time, error)
+	Migrate() error
+	MigrationStatus() ([]MigrationStatus, error)
+}
+
+// NewDataStore picks a backend based on the DSN.  A DSN of the form
+// "sqlite:<path>" opens an embedded SQLite database, anything else is
+// handed to the Postgres driver.
+func NewDataStore(dsn string) (DataStore, error) {
+	if strings.HasPrefix(dsn, "sqlite:") {
+		return NewSQLiteDataStore(strings.TrimPrefix(dsn, "sqlite:"))
+	}
+	return NewPostgresDataStore(dsn)
+}
+
+type dialect struct {
+	driver          string
+	migrationsTable string
+	migrations      []migration
+	ilike           string                      // case insensitive LIKE operator
+	jsonText        func(path ...string) string // SQL expression for a text field of the value column
+	jsonNumber      func(path ...string) string // SQL expression for a numeric field of the value column
+}
+
+type sqlDataStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func openDataStore(d dialect, dsn string) (*sqlDataStore, error) {
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlDataStore{db, d}, nil
+}
+
+// ActivityRevision is a previous version of an activity, kept when Save
+// replaces it with a changed one
+type ActivityRevision struct {
+	Activity   SummaryActivity
+	ReplacedAt time.Time
+}
+
+// GetMostRecentActivityDate is the UTC start of the newest activity from
+// Strava, where Sync picks up, since Strava's `after` is a UTC timestamp.
+// Activities imported from files are left out: they aren't on Strava, and
+// may be newer than activities still to be fetched.
+func (s *sqlDataStore) GetMostRecentActivityDate() (time.Time, error) {
+	activities, err := s.activityQuery(`SELECT value FROM strava_activities WHERE deleted_at IS NULL AND id > 0 ORDER BY start_time_local DESC LIMIT 1`)
+	if err != nil || len(activities) == 0 {
+		return time.Time{}, err
+	}
+	if activities[0].StartDate == "" {
+		// Only the local time is known, so start from the earliest UTC time
+		// it could be, in the furthest zone east (UTC+14).  Activities
+		// fetched again are updated in place.
+		return activities[0].Date().Add(-14 * time.Hour), nil
+	}
+	return activities[0].StartTime(), nil
+}
+
+func (s *sqlDataStore) GetSession() (*StravaSession, error) {
+	var bytes []byte
+	err := s.db.QueryRow("SELECT value FROM strava_session WHERE id=1").Scan(&bytes)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var session StravaSession
+	if err := json.Unmarshal(bytes, &session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (s *sqlDataStore) SaveSession(session *StravaSession) error {
+	bytes, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO strava_session (id, value)
+		VALUES (1, $1)
+		ON CONFLICT (id)
+		DO UPDATE SET value = EXCLUDED.value`
+	if _, err := s.db.Exec(query, string(bytes)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetSyncState returns the last saved sync checkpoint, or a zero SyncState
+// if no sync has run yet
+func (s *sqlDataStore) GetSyncState() (*SyncState, error) {
+	var state SyncState
+	var bytes []byte
+	err := s.db.QueryRow("SELECT value FROM strava_sync_state WHERE id=1").Scan(&bytes)
+	if err == sql.ErrNoRows {
+		return &state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (s *sqlDataStore) SaveSyncState(state *SyncState) error {
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO strava_sync_state (id, value)
+		VALUES (1, $1)
+		ON CONFLICT (id)
+		DO UPDATE SET value = EXCLUDED.value`
+	if _, err := s.db.Exec(query, string(bytes)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Save inserts new activities and updates changed ones, keeping the value
+// being replaced as a revision.  Saving an activity that was marked deleted
+// restores it.
+func (s *sqlDataStore) Save(activities []SummaryActivity) error {
+	for _, activity := range activities {
+		if err := s.save(activity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlDataStore) save(activity SummaryActivity) error {
+	serialized, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous []byte
+	var deleted bool
+	err = tx.QueryRow(`SELECT value, deleted_at IS NOT NULL FROM strava_activities WHERE id = $1`, activity.Id).Scan(&previous, &deleted)
+	if err == sql.ErrNoRows {
+		query := `INSERT INTO strava_activities (id, start_time_local, value) VALUES ($1, $2, $3)`
+		if _, err := tx.Exec(query, activity.Id, startTimeLocal(activity), string(serialized)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	} else if err != nil {
+		return err
+	}
+
+	var stored SummaryActivity
+	if err := json.Unmarshal(previous, &stored); err != nil {
+		return err
+	}
+	changed := !sameActivity(stored, activity)
+	if !changed && !deleted {
+		return nil
+	}
+
+	if changed {
+		query := `INSERT INTO strava_activity_revisions (activity_id, value, replaced_at) VALUES ($1, $2, $3)`
+		if _, err := tx.Exec(query, activity.Id, string(previous), time.Now().UTC()); err != nil {
+			return err
+		}
+	}
+
+	query := `UPDATE strava_activities SET start_time_local = $1, value = $2, deleted_at = NULL WHERE id = $3`
+	if _, err := tx.Exec(query, startTimeLocal(activity), string(serialized), activity.Id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sameActivity compares the fields we store, ignoring the ones that differ
+// between the list and the detail endpoints for an unchanged activity, and
+// the UTC start time if only one has it (it wasn't always stored)
+func sameActivity(a, b SummaryActivity) bool {
+	if a.StartDate == "" || b.StartDate == "" {
+		a.StartDate, b.StartDate = "", ""
+	}
+	normalize := func(activity SummaryActivity) string {
+		activity.Laps = nil
+		activity.Map.ResourceState = 0
+		serialized, _ := json.Marshal(activity)
+		return string(serialized)
+	}
+	return normalize(a) == normalize(b)
+}
+
+// MarkDeleted soft deletes an activity that no longer exists upstream.  It
+// is excluded from queries unless the filter sets IncludeDeleted, and its
+// laps, details and streams are kept.
+func (s *sqlDataStore) MarkDeleted(activityId int64) error {
+	query := `UPDATE strava_activities SET deleted_at = $1 WHERE id = $2 AND deleted_at IS NULL`
+	if _, err := s.db.Exec(query, time.Now().UTC(), activityId); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetRevisions returns the previous versions of an activity, oldest first
+func (s *sqlDataStore) GetRevisions(activityId int64) ([]ActivityRevision, error) {
+	rows, err := s.db.Query(`SELECT value, replaced_at FROM strava_activity_revisions WHERE activity_id = $1 ORDER BY replaced_at, id`, activityId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ActivityRevision{}
+	for rows.Next() {
+		var value []byte
+		var revision ActivityRevision
+		if err := rows.Scan(&value, &revision.ReplacedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(value, &revision.Activity); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// SaveEdit records an edit made to an activity's metadata
+func (s *sqlDataStore) SaveEdit(activityId int64, edit ActivityEditRecord) error {
+	serialized, err := json.Marshal(edit)
+	if err != nil {
+		return err
+	}
+	query := `INSERT INTO strava_activity_edits (activity_id, value, edited_at) VALUES ($1, $2, $3)`
+	_, err = s.db.Exec(query, activityId, string(serialized), edit.EditedAt)
+	return err
+}
+
+// GetEdits returns the edits made to an activity, oldest first
+func (s *sqlDataStore) GetEdits(activityId int64) ([]ActivityEditRecord, error) {
+	rows, err := s.db.Query(`SELECT value, edited_at FROM strava_activity_edits WHERE activity_id = $1 ORDER BY edited_at, id`, activityId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edits := []ActivityEditRecord{}
+	for rows.Next() {
+		var value []byte
+		var edit ActivityEditRecord
+		if err := rows.Scan(&value, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(value, &edit); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
+
+// startTimeLocal is the value of the typed start_time_local column.  It is
+// stored in the same format Strava uses so that both backends can compare
+// it as a string or a timestamp.
+func startTimeLocal(activity SummaryActivity) interface{} {
+	if activity.DateString == "" {
+		return nil
+	}
+	return activity.DateString
+}
+
+// SaveLaps replaces the laps of an activity and marks its laps as fetched,
+// even if there are none, so LoadMissingLaps won't return it again.  Laps
+// without an id (from files) get negative ids, like local activities.
+func (s *sqlDataStore) SaveLaps(activityId int64, laps []ActivityLap) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM strava_laps WHERE activity_id = $1`, activityId); err != nil {
+		return err
+	}
+
+	var localId int64
+	if err := tx.QueryRow(`SELECT coalesce(min(id), 0) FROM strava_laps`).Scan(&localId); err != nil {
+		return err
+	}
+	if localId > 0 {
+		localId = 0
+	}
+
+	query := `INSERT INTO strava_laps (id, activity_id, value)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (id)
+		DO UPDATE SET activity_id = EXCLUDED.activity_id, value = EXCLUDED.value`
+	for _, lap := range laps {
+		if lap.Id == 0 {
+			localId--
+			lap.Id = localId
+		}
+		serialized, err := json.Marshal(lap)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(query, lap.Id, activityId, string(serialized)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE strava_activities SET laps_fetched = true WHERE id = $1`, activityId); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetLaps returns the stored laps of an activity in order
+func (s *sqlDataStore) GetLaps(activityId int64) ([]ActivityLap, error) {
+	query := fmt.Sprintf("SELECT value FROM strava_laps WHERE activity_id = $1 ORDER BY %s, id", s.dialect.jsonNumber("lap_index"))
+	rows, err := s.db.Query(query, activityId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	laps := []ActivityLap{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		var lap ActivityLap
+		if err := json.Unmarshal(value, &lap); err != nil {
+			return nil, err
+		}
+		laps = append(laps, lap)
+	}
+	return laps, rows.Err()
+}
+
+// DeleteActivity permanently removes an activity along with its laps,
+// details, streams and revisions
+func (s *sqlDataStore) DeleteActivity(activityId int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range []string{
+		`DELETE FROM strava_laps WHERE activity_id = $1`,
+		`DELETE FROM strava_activity_details WHERE activity_id = $1`,
+		`DELETE FROM strava_streams WHERE activity_id = $1`,
+		`DELETE FROM strava_activity_revisions WHERE activity_id = $1`,
+		`DELETE FROM strava_activity_edits WHERE activity_id = $1`,
+		`DELETE FROM strava_activities WHERE id = $1`,
+	} {
+		if _, err := tx.Exec(query, activityId); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadMissingLaps returns the activities matching the filter whose laps
+// haven't been fetched
+func (s *sqlDataStore) LoadMissingLaps(filters ActivityFilter) ([]SummaryActivity, error) {
+	clause, args := filters.compile(s.dialect, "NOT laps_fetched")
+	return s.activityQuery("SELECT value FROM strava_activities"+clause, args...)
+}
+
+func (s *sqlDataStore) SaveDetails(activity DetailedActivity) error {
+	serialized, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO strava_activity_details (activity_id, value)
+		VALUES ($1, $2)
+		ON CONFLICT (activity_id)
+		DO UPDATE SET value = EXCLUDED.value`
+	if _, err := s.db.Exec(query, activity.Id, string(serialized)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetDetails returns the detailed activity, or nil if it hasn't been fetched
+func (s *sqlDataStore) GetDetails(activityId int64) (*DetailedActivity, error) {
+	activities, err := s.detailsQuery("SELECT value FROM strava_activity_details WHERE activity_id = $1", activityId)
+	if err != nil || len(activities) == 0 {
+		return nil, err
+	}
+	return &activities[0], nil
+}
+
+// LoadDetails returns the detailed activities for every activity matching
+// the filter.  Activities whose details haven't been fetched are skipped.
+func (s *sqlDataStore) LoadDetails(filters ActivityFilter) ([]DetailedActivity, error) {
+	clause, args := filters.compile(s.dialect)
+	return s.detailsQuery(
+		"SELECT value FROM strava_activity_details WHERE activity_id IN (SELECT id FROM strava_activities"+clause+")",
+		args...,
+	)
+}
+
+func (s *sqlDataStore) SaveStreams(activityId int64, streams *Streams) error {
+	compressed, err := streams.compress()
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO strava_streams (activity_id, value)
+		VALUES ($1, $2)
+		ON CONFLICT (activity_id)
+		DO UPDATE SET value = EXCLUDED.value`
+	if _, err := s.db.Exec(query, activityId, compressed); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetStreams returns the stored streams, or nil if they haven't been fetched
+func (s *sqlDataStore) GetStreams(activityId int64) (*Streams, error) {
+	var value []byte
+	err := s.db.QueryRow("SELECT value FROM strava_streams WHERE activity_id = $1", activityId).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return decompressStreams(value)
+}
+
+// LoadMissingStreams returns the activities matching the filter that have
+// no stored streams
+func (s *sqlDataStore) LoadMissingStreams(filters ActivityFilter) ([]SummaryActivity, error) {
+	clause, args := filters.compile(s.dialect, "id NOT IN (SELECT activity_id FROM strava_streams)")
+	return s.activityQuery("SELECT value FROM strava_activities"+clause, args...)
+}
+
+// LoadMissingDetails returns the activities matching the filter that have
+// no stored details
+func (s *sqlDataStore) LoadMissingDetails(filters ActivityFilter) ([]SummaryActivity, error) {
+	clause, args := filters.compile(s.dialect, "id NOT IN (SELECT activity_id FROM strava_activity_details)")
+	return s.activityQuery("SELECT value FROM strava_activities"+clause, args...)
+}
+
+func (s *sqlDataStore) detailsQuery(query string, args ...interface{}) ([]DetailedActivity, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activities := []DetailedActivity{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		var activity DetailedActivity
+		if err := json.Unmarshal(value, &activity); err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+	return activities, rows.Err()
+}
+
+func (s *sqlDataStore) activityQuery(query string, args ...interface{}) ([]SummaryActivity, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	activities := []SummaryActivity{}
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		var activity SummaryActivity
+		if err := json.Unmarshal(value, &activity); err != nil {
+			return nil, err
+		}
+		activities = append(activities, activity)
+	}
+	return activities, rows.Err()
+}
+
+// GetActivity returns a stored activity, including one marked deleted, or
+// nil if there is none
+func (s *sqlDataStore) GetActivity(activityId int64) (*SummaryActivity, error) {
+	activities, err := s.activityQuery("SELECT value FROM strava_activities WHERE id = $1", activityId)
+	if err != nil || len(activities) == 0 {
+		return nil, err
+	}
+	return &activities[0], nil
+}
+
+// NextLocalActivityId returns an unused id for an activity that doesn't come
+// from Strava.  Local ids count down from -1 so they never collide with
+// Strava's.
+func (s *sqlDataStore) NextLocalActivityId() (int64, error) {
+	var min int64
+	if err := s.db.QueryRow("SELECT coalesce(min(id), 0) FROM strava_activities").Scan(&min); err != nil {
+		return 0, err
+	}
+	if min >= 0 {
+		return -1, nil
+	}
+	return min - 1, nil
+}
+
+func (s *sqlDataStore) LoadPage(page, perPage int) ([]SummaryActivity, error) {
+	return s.Load(ActivityFilter{Limit: perPage, Offset: (page - 1) * perPage})
+}
+
+func (s *sqlDataStore) Load(filters ActivityFilter) ([]SummaryActivity, error) {
+	clause, args := filters.compile(s.dialect)
+	return s.activityQuery("SELECT value FROM strava_activities"+clause, args...)
+}
@@ -0,0 +1,220 @@
+package strava
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// ActivityEdit is a change to an activity's metadata, as accepted by PUT
+// /activities/{id}.  Nil fields are left as they are.  A GearId of "none"
+// removes the gear.
+type ActivityEdit struct {
+	Name        *string `json:"name,omitempty"`
+	WorkoutType *int    `json:"workout_type,omitempty"`
+	GearId      *string `json:"gear_id,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// IsEmpty is true if the edit doesn't change anything
+func (e ActivityEdit) IsEmpty() bool {
+	return e.Name == nil && e.WorkoutType == nil && e.GearId == nil && e.Description == nil
+}
+
+func (e ActivityEdit) String() string {
+	var changes []string
+	if e.Name != nil {
+		changes = append(changes, fmt.Sprintf("name=%q", *e.Name))
+	}
+	if e.WorkoutType != nil {
+		changes = append(changes, fmt.Sprintf("workout_type=%d", *e.WorkoutType))
+	}
+	if e.GearId != nil {
+		changes = append(changes, fmt.Sprintf("gear=%s", *e.GearId))
+	}
+	if e.Description != nil {
+		changes = append(changes, fmt.Sprintf("description=%q", *e.Description))
+	}
+	return strings.Join(changes, ", ")
+}
+
+// diff narrows the edit to the fields that differ from the activity, and
+// returns the values they replace
+func (e ActivityEdit) diff(activity DetailedActivity) (changes, previous ActivityEdit) {
+	if e.Name != nil && *e.Name != activity.Name {
+		changes.Name, previous.Name = e.Name, &activity.Name
+	}
+	if e.WorkoutType != nil && *e.WorkoutType != activity.WorkoutType {
+		changes.WorkoutType, previous.WorkoutType = e.WorkoutType, &activity.WorkoutType
+	}
+	if e.GearId != nil && gearId(*e.GearId) != activity.GearId {
+		gear := activity.GearId
+		if gear == "" {
+			gear = "none"
+		}
+		changes.GearId, previous.GearId = e.GearId, &gear
+	}
+	if e.Description != nil && *e.Description != activity.Description {
+		changes.Description, previous.Description = e.Description, &activity.Description
+	}
+	return changes, previous
+}
+
+// gearId is the stored gear id for an edit's gear: "none" is no gear
+func gearId(id string) string {
+	if id == "none" {
+		return ""
+	}
+	return id
+}
+
+// apply makes the edit to an activity the way Strava would
+func (e ActivityEdit) apply(activity *DetailedActivity, gear *SummaryGear) {
+	if e.Name != nil {
+		activity.Name = *e.Name
+	}
+	if e.WorkoutType != nil {
+		activity.WorkoutType = *e.WorkoutType
+	}
+	if e.GearId != nil {
+		activity.GearId = gearId(*e.GearId)
+		activity.Gear = nil
+		if activity.GearId != "" {
+			activity.Gear = &SummaryGear{Id: activity.GearId}
+			if gear != nil {
+				activity.Gear.Name = gear.Name
+			}
+		}
+	}
+	if e.Description != nil {
+		activity.Description = *e.Description
+	}
+}
+
+// ActivityEditRecord is an edit made with EditActivity, limited to the
+// fields it changed, and the values it replaced
+type ActivityEditRecord struct {
+	Edit     ActivityEdit `json:"edit"`
+	Previous ActivityEdit `json:"previous"`
+	EditedAt time.Time    `json:"-"`
+}
+
+// EditActivity changes an activity's metadata on Strava and in the store,
+// recording the change.  Local activities are only edited in the store.
+// It returns the fields that changed; an edit that changes nothing isn't
+// sent.
+func (c *StravaClient) EditActivity(ctx context.Context, store DataStore, activityId int64, edit ActivityEdit) (ActivityEdit, error) {
+	summary, err := store.GetActivity(activityId)
+	if err != nil {
+		return ActivityEdit{}, err
+	}
+	if summary == nil {
+		return ActivityEdit{}, fmt.Errorf("no activity %d", activityId)
+	}
+	details, err := store.GetDetails(activityId)
+	if err != nil {
+		return ActivityEdit{}, err
+	}
+	if details == nil {
+		details = &DetailedActivity{SummaryActivity: *summary}
+	}
+	details.SummaryActivity = *summary
+
+	changes, previous := edit.diff(*details)
+	if changes.IsEmpty() {
+		return changes, nil
+	}
+
+	updated := details
+	if summary.IsLocal() {
+		var gear *SummaryGear
+		if changes.GearId != nil {
+			if gear, err = FindGear(store, *changes.GearId); err != nil {
+				return ActivityEdit{}, err
+			}
+		}
+		changes.apply(updated, gear)
+	} else if updated, err = c.apiPutActivity(ctx, activityId, changes); err != nil {
+		return ActivityEdit{}, err
+	}
+
+	record := updated.SummaryActivity
+	record.Laps = nil
+	if err := store.Save([]SummaryActivity{record}); err != nil {
+		return ActivityEdit{}, err
+	}
+	if err := store.SaveDetails(*updated); err != nil {
+		return ActivityEdit{}, err
+	}
+	return changes, store.SaveEdit(activityId, ActivityEditRecord{Edit: changes, Previous: previous, EditedAt: time.Now().UTC()})
+}
+
+// EditActivities makes an edit to every activity matching the filter, e.g.
+// marking every activity named "Marathon" as a race.  It returns how many
+// activities changed; ones the edit wouldn't change are skipped.
+func (c *StravaClient) EditActivities(ctx context.Context, store DataStore, filter ActivityFilter, edit ActivityEdit) (int, error) {
+	activities, err := store.Load(filter)
+	if err != nil {
+		return 0, err
+	}
+	edited := 0
+	for _, activity := range activities {
+		changes, err := c.EditActivity(ctx, store, activity.Id, edit)
+		if err != nil {
+			return edited, fmt.Errorf("editing activity %d: %w", activity.Id, err)
+		}
+		if !changes.IsEmpty() {
+			log.Printf("edited activity %d (%s): %s", activity.Id, activity.Name, changes)
+			edited++
+		}
+	}
+	return edited, nil
+}
+
+func (c *StravaClient) apiPutActivity(ctx context.Context, activityId int64, edit ActivityEdit) (*DetailedActivity, error) {
+	body, err := json.Marshal(edit)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpReq(
+		ctx,
+		"PUT",
+		fmt.Sprintf("%s/api/v3/activities/%d", c.baseURL, activityId),
+		map[string]string{"Content-Type": "application/json"},
+		body,
+		200,
+	)
+	if err != nil {
+		return nil, writeScopeHint(err)
+	}
+
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var activity DetailedActivity
+	if err := json.Unmarshal(body, &activity); err != nil {
+		return nil, err
+	}
+	return &activity, nil
+}
+
+// FindGear looks up gear by id or, ignoring case, by name among the gear of
+// the stored activities.  It returns nil if no activity uses it.
+func FindGear(store DataStore, idOrName string) (*SummaryGear, error) {
+	activities, err := store.LoadDetails(ActivityFilter{IncludeDeleted: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, activity := range activities {
+		gear := activity.Gear
+		if gear != nil && (gear.Id == idOrName || strings.EqualFold(gear.Name, idOrName)) {
+			return gear, nil
+		}
+	}
+	return nil, nil
+}
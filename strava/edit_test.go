@@ -0,0 +1,117 @@
+package strava_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/strava/stravatest"
+)
+
+func TestEditActivities(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+	if err := client.Sync(ctx, store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	name, gear, description := "Tempo Tuesday", "g2222222", "3 x 2 mi at tempo"
+	workout := 3
+	changes, err := client.EditActivity(ctx, store, 7023456789, strava.ActivityEdit{Name: &name, WorkoutType: &workout, GearId: &gear, Description: &description})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.IsEmpty() {
+		t.Fatal("expected the edit to change the activity")
+	}
+
+	details, err := store.GetDetails(7023456789)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Name != name || details.WorkoutType != 3 || details.GearId != gear || details.Description != description {
+		t.Errorf("expected the stored details to be edited, got %+v", details)
+	}
+	summary, err := store.GetActivity(7023456789)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Name != name || summary.WorkoutType != 3 {
+		t.Errorf("expected the stored summary to be edited, got %+v", summary)
+	}
+	for _, a := range server.Activities {
+		if a.Id == 7023456789 && a.Name != name {
+			t.Errorf("expected the edit to be sent to Strava, got %q", a.Name)
+		}
+	}
+
+	edits, err := store.GetEdits(7023456789)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(edits) != 1 || *edits[0].Previous.Name != "Morning Run" || *edits[0].Previous.WorkoutType != 0 || *edits[0].Previous.GearId != "none" {
+		t.Errorf("expected the edit to be recorded with the previous values, got %+v", edits)
+	}
+
+	// Editing to the same values is a no-op that isn't sent
+	before := countRequests(server.Requests(), "/api/v3/activities/7023456789")
+	changes, err = client.EditActivity(ctx, store, 7023456789, strava.ActivityEdit{Name: &name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changes.IsEmpty() || countRequests(server.Requests(), "/api/v3/activities/7023456789") != before {
+		t.Errorf("expected an edit that changes nothing to be skipped, got %s", changes)
+	}
+
+	// Bulk: mark every run with "Marathon" in its name as a race
+	race := 1
+	edited, err := client.EditActivities(ctx, store, strava.ActivityFilter{NameContains: "marathon"}, strava.ActivityEdit{WorkoutType: &race})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited != 0 {
+		t.Errorf("expected the marathon, already a race, to be skipped, edited %d", edited)
+	}
+	edited, err = client.EditActivities(ctx, store, strava.ActivityFilter{Types: []string{"Run"}}, strava.ActivityEdit{WorkoutType: &race})
+	if err != nil {
+		t.Fatal(err)
+	}
+	isRace := true
+	races, err := store.Load(strava.ActivityFilter{IsRace: &isRace})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edited != 1 || len(races) != 2 {
+		t.Errorf("expected one more race, edited %d and have %d races", edited, len(races))
+	}
+}
+
+func TestEditLocalActivity(t *testing.T) {
+	store := newTestStore(t)
+	run := strava.DetailedActivity{}
+	run.Name, run.Type, run.DateString, run.Distance = "Track", "Run", "2022-05-10T22:00:00Z", 8000
+	path := writeActivityFile(t, t.TempDir(), "track.activity", run)
+	if _, err := strava.ImportFiles(store, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Local activities never reach Strava, so no client is needed
+	var client *strava.StravaClient
+	workout := 3
+	if _, err := client.EditActivity(context.Background(), store, -1, strava.ActivityEdit{WorkoutType: &workout}); err != nil {
+		t.Fatal(err)
+	}
+	summary, err := store.GetActivity(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.WorkoutType != 3 {
+		t.Errorf("expected the local activity to be edited, got %+v", summary)
+	}
+}
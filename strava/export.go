@@ -0,0 +1,283 @@
+package strava
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImportResult counts what an import did
+type ImportResult struct {
+	Imported    int // new activities saved
+	Existing    int // already stored, left untouched
+	Files       int // activity files decoded into laps and streams
+	Unsupported int // referenced files in a format without a registered decoder
+	Failed      int // referenced files that were missing or couldn't be decoded
+}
+
+func (r ImportResult) String() string {
+	return fmt.Sprintf(
+		"%d imported, %d already stored; %d files decoded, %d unsupported, %d failed",
+		r.Imported, r.Existing, r.Files, r.Unsupported, r.Failed,
+	)
+}
+
+// exportDateLayout is the format of "Activity Date" in activities.csv,
+// which is in UTC
+const exportDateLayout = "Jan 2, 2006, 3:04:05 PM"
+
+// ImportExport loads the activities in a Strava bulk export archive (the
+// zip from Settings > My Account > Download or Delete Your Account) without
+// using the API.  Each row of activities.csv becomes an activity with its
+// details, and the GPX/TCX/FIT file it references is decoded for laps,
+// streams and the route if a decoder for its format is registered.
+//
+// Activities keep their Strava ids, so importing is idempotent and never
+// overwrites an activity that is already stored, e.g. by Sync.  The export
+// only has UTC start times, so local ones are taken to be in zone, e.g. the
+// athlete's home.
+func ImportExport(store DataStore, zipPath string, zone *time.Location) (*ImportResult, error) {
+	archive, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+
+	// activities.csv is at the root of Strava's archive, but allow for it
+	// having been re-zipped inside a directory
+	var index *zip.File
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[f.Name] = f
+		if path.Base(f.Name) == "activities.csv" && (index == nil || len(f.Name) < len(index.Name)) {
+			index = f
+		}
+	}
+	if index == nil {
+		return nil, fmt.Errorf("%s: no activities.csv; is this a Strava bulk export?", zipPath)
+	}
+	root := path.Dir(index.Name)
+
+	r, err := index.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	rows, err := readExportCSV(r)
+	if err != nil {
+		return nil, fmt.Errorf("activities.csv: %v", err)
+	}
+
+	result := ImportResult{}
+	for _, row := range rows {
+		activity, err := row.activity(zone)
+		if err != nil {
+			return &result, err
+		}
+
+		existing, err := store.GetActivity(activity.Id)
+		if err != nil {
+			return &result, err
+		}
+		if existing != nil {
+			result.Existing++
+			continue
+		}
+
+		var decoded *ActivityFile
+		if filename := row.get("Filename"); filename != "" {
+			decoded, err = decodeExportFile(files[path.Join(root, filename)], filename)
+			var unsupported *UnsupportedFileError
+			if errors.As(err, &unsupported) {
+				result.Unsupported++
+			} else if err != nil {
+				log.Printf("activity %d: %v", activity.Id, err)
+				result.Failed++
+			} else {
+				result.Files++
+				mergeActivityFile(activity, &decoded.Activity)
+			}
+		}
+
+		if err := store.Save([]SummaryActivity{activity.SummaryActivity}); err != nil {
+			return &result, err
+		}
+		if err := store.SaveDetails(*activity); err != nil {
+			return &result, err
+		}
+		if decoded != nil && len(decoded.Laps) > 0 {
+			if err := store.SaveLaps(activity.Id, decoded.Laps); err != nil {
+				return &result, err
+			}
+		}
+		if decoded != nil && decoded.Streams != nil && decoded.Streams.Len() > 0 {
+			if err := store.SaveStreams(activity.Id, decoded.Streams); err != nil {
+				return &result, err
+			}
+		}
+		result.Imported++
+	}
+	return &result, nil
+}
+
+func decodeExportFile(f *zip.File, name string) (*ActivityFile, error) {
+	if f == nil {
+		return nil, fmt.Errorf("%s: not in the archive", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return DecodeFile(name, r)
+}
+
+// exportRow is a row of activities.csv keyed by column name.  Later columns
+// repeat some earlier ones (Elapsed Time, Distance, Max Heart Rate) in SI
+// units, e.g. the first Distance is in the athlete's unit and the second is
+// in meters, so the last column with a name wins, even when it's empty.
+type exportRow map[string]string
+
+func readExportCSV(r io.Reader) ([]exportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []exportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		row := exportRow{}
+		for i, name := range header {
+			value := ""
+			if i < len(record) {
+				value = record[i]
+			}
+			row[strings.TrimSpace(name)] = value
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (row exportRow) get(name string) string {
+	return strings.TrimSpace(row[name])
+}
+
+// float parses a number, which is 0 if the cell is empty: the export leaves
+// unknown values empty
+func (row exportRow) float(name string) (float64, error) {
+	value := row.get(name)
+	if value == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(strings.ReplaceAll(value, ",", ""), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return v, nil
+}
+
+func (row exportRow) activity(zone *time.Location) (*DetailedActivity, error) {
+	id, err := strconv.ParseInt(row.get("Activity ID"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("activities.csv: invalid activity id %q", row.get("Activity ID"))
+	}
+	date, err := time.Parse(exportDateLayout, row.get("Activity Date"))
+	if err != nil {
+		return nil, fmt.Errorf("activities.csv: activity %d: invalid date %q", id, row.get("Activity Date"))
+	}
+
+	// The first invalid number, if any
+	var invalid error
+	float := func(name string) float64 {
+		v, err := row.float(name)
+		if err != nil && invalid == nil {
+			invalid = err
+		}
+		return v
+	}
+
+	activity := &DetailedActivity{
+		SummaryActivity: SummaryActivity{
+			Id:         id,
+			Name:       row.get("Activity Name"),
+			Type:       row.get("Activity Type"),
+			DateString: date.In(zone).Format("2006-01-02T15:04:05Z"),
+			StartDate:  date.Format("2006-01-02T15:04:05Z"),
+			Distance:   float("Distance"),
+			MovingTime: float("Moving Time"),
+		},
+		Description:        row.get("Activity Description"),
+		Calories:           float("Calories"),
+		ElapsedTime:        float("Elapsed Time"),
+		TotalElevationGain: float("Elevation Gain"),
+		ElevHigh:           float("Elevation High"),
+		ElevLow:            float("Elevation Low"),
+		AverageHeartrate:   float("Average Heart Rate"),
+		MaxHeartrate:       float("Max Heart Rate"),
+		AverageCadence:     float("Average Cadence"),
+		AverageSpeed:       float("Average Speed"),
+		MaxSpeed:           float("Max Speed"),
+	}
+	if invalid != nil {
+		return nil, fmt.Errorf("activities.csv: activity %d: %v", id, invalid)
+	}
+	activity.HasHeartrate = activity.AverageHeartrate > 0
+	if gear := row.get("Activity Gear"); gear != "" {
+		activity.Gear = &SummaryGear{Name: gear}
+	}
+	return activity, nil
+}
+
+// mergeActivityFile fills in whatever the CSV row left empty from the
+// decoded file, most importantly the route
+func mergeActivityFile(activity, decoded *DetailedActivity) {
+	if activity.DateString == "" {
+		activity.DateString = decoded.DateString
+	}
+	if activity.StartDate == "" {
+		activity.StartDate = decoded.StartDate
+	}
+	if activity.Map.Polyline == "" {
+		activity.Map.Polyline = decoded.Map.Polyline
+	}
+	if activity.DeviceName == "" {
+		activity.DeviceName = decoded.DeviceName
+	}
+	for _, v := range []struct{ into, from *float64 }{
+		{&activity.Distance, &decoded.Distance},
+		{&activity.MovingTime, &decoded.MovingTime},
+		{&activity.ElapsedTime, &decoded.ElapsedTime},
+		{&activity.TotalElevationGain, &decoded.TotalElevationGain},
+		{&activity.ElevHigh, &decoded.ElevHigh},
+		{&activity.ElevLow, &decoded.ElevLow},
+		{&activity.Calories, &decoded.Calories},
+		{&activity.AverageHeartrate, &decoded.AverageHeartrate},
+		{&activity.MaxHeartrate, &decoded.MaxHeartrate},
+		{&activity.AverageCadence, &decoded.AverageCadence},
+		{&activity.AverageSpeed, &decoded.AverageSpeed},
+		{&activity.MaxSpeed, &decoded.MaxSpeed},
+	} {
+		if *v.into == 0 {
+			*v.into = *v.from
+		}
+	}
+	activity.HasHeartrate = activity.HasHeartrate || decoded.HasHeartrate
+}
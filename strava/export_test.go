@@ -0,0 +1,232 @@
+package strava_test
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/strava/stravatest"
+)
+
+// A trimmed activities.csv in the layout of Strava's bulk export, with the
+// repeated SI unit columns after Filename
+const exportCSV = `Activity ID,Activity Date,Activity Name,Activity Type,Activity Description,Elapsed Time,Distance,Max Heart Rate,Relative Effort,Commute,Activity Private Note,Activity Gear,Filename,Athlete Weight,Bike Weight,Elapsed Time,Moving Time,Distance,Max Speed,Average Speed,Elevation Gain,Elevation Loss,Elevation Low,Elevation High,Max Grade,Average Grade,Average Positive Grade,Average Negative Grade,Max Cadence,Average Cadence,Max Heart Rate,Average Heart Rate,Max Watts,Average Watts,Calories
+7012345678,"Apr 18, 2022, 2:02:14 PM",Boston Marathon,Run,"Hopkinton to Boylston, finally",11502,42.44,181.0,312,false,,"Nike Vaporfly",activities/7012345678.fake.gz,,,11502,11432.0,42442.6,5.2,3.71,251.2,310.0,12.0,150.0,,,,,,88.0,181.0,162.0,,,2710
+6912345678,"Mar 1, 2022, 11:30:00 AM",Lunch Run,Run,,1900,5.01,,21,false,,,activities/6912345678.weird,,,1900,1850.0,5012.0,,2.71,10.0,,,,,,,,,,,,,,
+6812345678,"Feb 2, 2022, 12:00:00 PM",Treadmill,Run,,1800,4.8,,,false,,,,,,1800,1800.0,4800.0,,,,,,,,,,,,,,,,,
+6712345678,"Jan 5, 2022, 1:00:00 PM",Lost File,Run,,1800,4.8,,,false,,,activities/6712345678.fake,,,1800,1800.0,4800.0,,,,,,,,,,,,,,,,,
+`
+
+func init() {
+	strava.RegisterFileDecoder(".fake", func(r io.Reader) (*strava.ActivityFile, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		file := &strava.ActivityFile{Streams: &strava.Streams{Time: []int32{0, 1, 2}}}
+		file.Activity.Map.Polyline = strings.TrimSpace(string(data))
+		file.Activity.DeviceName = "Fake Watch"
+		file.Laps = []strava.ActivityLap{{Id: 1, Name: "Lap 1", LapIndex: 1}}
+		return file, nil
+	})
+}
+
+func writeExport(t *testing.T, csv string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "export_4242.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	archive := zip.NewWriter(f)
+
+	w, err := archive.Create("activities.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, csv)
+
+	w, err = archive.Create("activities/7012345678.fake.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(w)
+	io.WriteString(gz, "_p~iF~ps|U_ulLnnqC_mqNvxq`@\n")
+	gz.Close()
+
+	w, err = archive.Create("activities/6912345678.weird")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "?")
+
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// edt is the zone the export fixtures' local start times are in
+var edt = time.FixedZone("EDT", -4*60*60)
+
+func TestImportExport(t *testing.T) {
+	store := newTestStore(t)
+	path := writeExport(t, exportCSV)
+
+	result, err := strava.ImportExport(store, path, edt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 4 || result.Files != 1 || result.Unsupported != 1 || result.Failed != 1 {
+		t.Errorf("unexpected result: %s", result)
+	}
+
+	marathon, err := store.GetDetails(7012345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marathon == nil {
+		t.Fatal("expected details to be stored")
+	}
+	if marathon.DateString != "2022-04-18T10:02:14Z" || marathon.StartDate != "2022-04-18T14:02:14Z" || marathon.Distance != 42442.6 || marathon.MovingTime != 11432 {
+		t.Errorf("unexpected activity: %s %s %f %f", marathon.DateString, marathon.StartDate, marathon.Distance, marathon.MovingTime)
+	}
+	if marathon.Gear == nil || marathon.Gear.Name != "Nike Vaporfly" || marathon.Calories != 2710 || marathon.AverageHeartrate != 162 {
+		t.Errorf("unexpected details: %+v", marathon)
+	}
+
+	if marathon.Map.Polyline != "_p~iF~ps|U_ulLnnqC_mqNvxq`@" || marathon.DeviceName != "Fake Watch" {
+		t.Errorf("expected the route and device from the decoded file, got %q, %q", marathon.Map.Polyline, marathon.DeviceName)
+	}
+	streams, err := store.GetStreams(7012345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams == nil || streams.Len() != 3 {
+		t.Errorf("expected streams from the decoded file, got %+v", streams)
+	}
+	missingLaps, err := store.LoadMissingLaps(strava.ActivityFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missingLaps) != 3 {
+		t.Errorf("expected laps only for the activity with a decoded file, %d are missing", len(missingLaps))
+	}
+
+	result, err = strava.ImportExport(store, path, edt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 0 || result.Existing != 4 {
+		t.Errorf("expected importing again to be a no-op, got %s", result)
+	}
+}
+
+// TestImportExportMatchesSync imports the marathon from an export and syncs
+// it from Strava, which should store the same start times
+func TestImportExportMatchesSync(t *testing.T) {
+	imported := newTestStore(t)
+	if _, err := strava.ImportExport(imported, writeExport(t, exportCSV), edt); err != nil {
+		t.Fatal(err)
+	}
+
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced := newTestStore(t)
+	if err := client.Sync(context.Background(), synced, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := synced.GetActivity(7012345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := imported.GetActivity(7012345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DateString != want.DateString || got.StartDate != want.StartDate {
+		t.Errorf("imported start %s (%s UTC), synced %s (%s UTC)", got.DateString, got.StartDate, want.DateString, want.StartDate)
+	}
+
+	// and sorts and filters by the same local start time
+	activities, err := imported.Load(strava.ActivityFilter{After: want.Date(), Before: want.Date().Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 1 || activities[0].Id != 7012345678 {
+		t.Errorf("expected a filter on the synced start time to find the imported activity, got %d activities", len(activities))
+	}
+}
+
+func TestImportExportEmptySIColumns(t *testing.T) {
+	// The SI Elapsed Time and Distance are empty, so the first columns, in
+	// the athlete's units, mustn't be taken for them
+	store := newTestStore(t)
+	csv := `Activity ID,Activity Date,Activity Name,Activity Type,Elapsed Time,Distance,Filename,Elapsed Time,Moving Time,Distance
+6612345678,"Dec 1, 2021, 1:00:00 PM",Manual Entry,Run,1800,5.01,,,1750.0,
+`
+	if _, err := strava.ImportExport(store, writeExport(t, csv), edt); err != nil {
+		t.Fatal(err)
+	}
+	details, err := store.GetDetails(6612345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Distance != 0 || details.ElapsedTime != 0 || details.MovingTime != 1750 {
+		t.Errorf("expected only the moving time, got distance %f, elapsed time %f, moving time %f", details.Distance, details.ElapsedTime, details.MovingTime)
+	}
+}
+
+func TestImportExportInvalidNumber(t *testing.T) {
+	store := newTestStore(t)
+	csv := `Activity ID,Activity Date,Activity Name,Activity Type,Distance,Moving Time
+6512345678,"Dec 1, 2021, 1:00:00 PM",Typo,Run,5k,1750.0
+`
+	_, err := strava.ImportExport(store, writeExport(t, csv), edt)
+	if err == nil || !strings.Contains(err.Error(), `invalid Distance "5k"`) {
+		t.Errorf("expected an invalid distance error, got %v", err)
+	}
+}
+
+func TestImportExportTimeZone(t *testing.T) {
+	csv := `Activity ID,Activity Date,Activity Name,Activity Type,Distance,Moving Time
+6412345678,"Dec 1, 2021, 1:00:00 PM",Lunch Run,Run,5000,1750.0
+`
+	for _, test := range []struct {
+		zone  string
+		local string
+	}{
+		{"UTC", "2021-12-01T13:00:00Z"},
+		{"America/Los_Angeles", "2021-12-01T05:00:00Z"},
+		{"Australia/Sydney", "2021-12-02T00:00:00Z"},
+	} {
+		zone, err := time.LoadLocation(test.zone)
+		if err != nil {
+			t.Skipf("no time zone database: %v", err)
+		}
+		store := newTestStore(t)
+		if _, err := strava.ImportExport(store, writeExport(t, csv), zone); err != nil {
+			t.Fatal(err)
+		}
+		activity, err := store.GetActivity(6412345678)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if activity.DateString != test.local || activity.StartDate != "2021-12-01T13:00:00Z" {
+			t.Errorf("%s: expected the local start %s (2021-12-01T13:00:00Z UTC), got %s (%s UTC)", test.zone, test.local, activity.DateString, activity.StartDate)
+		}
+	}
+}
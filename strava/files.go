@@ -0,0 +1,332 @@
+package strava
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scottfrazer/running/geo"
+)
+
+// ActivityFile is an activity recorded in a file (GPX, TCX, FIT, ...) rather
+// than fetched from the API.  Decoders fill in whatever the format carries;
+// the Id is left for the caller to assign.
+type ActivityFile struct {
+	Activity DetailedActivity
+	Laps     []ActivityLap
+	Streams  *Streams
+}
+
+// FileDecoder decodes a single activity file
+type FileDecoder func(r io.Reader) (*ActivityFile, error)
+
+var (
+	fileDecodersMu sync.RWMutex
+	fileDecoders   = map[string]FileDecoder{}
+)
+
+// RegisterFileDecoder makes a decoder available for files with the given
+// extension (e.g. ".gpx").  Format packages call it from init, so importing
+// one for its side effects is enough to enable it, like a database/sql
+// driver.
+func RegisterFileDecoder(ext string, decode FileDecoder) {
+	fileDecodersMu.Lock()
+	defer fileDecodersMu.Unlock()
+	ext = strings.ToLower(ext)
+	if _, dup := fileDecoders[ext]; dup {
+		panic("strava: RegisterFileDecoder called twice for " + ext)
+	}
+	fileDecoders[ext] = decode
+}
+
+// FileFormats returns the extensions with a registered decoder
+func FileFormats() []string {
+	fileDecodersMu.RLock()
+	defer fileDecodersMu.RUnlock()
+	var exts []string
+	for ext := range fileDecoders {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// UnsupportedFileError is returned by DecodeFile for a file format without
+// a registered decoder
+type UnsupportedFileError struct {
+	Name string
+}
+
+func (e *UnsupportedFileError) Error() string {
+	return fmt.Sprintf("%s: unsupported file format", e.Name)
+}
+
+// DecodeFile decodes an activity file, picking the decoder by the file's
+// extension.  Gzipped files (e.g. "123.fit.gz", as in Strava's bulk export)
+// are decompressed first.
+func DecodeFile(name string, r io.Reader) (*ActivityFile, error) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == ".gz" {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		defer gz.Close()
+		r = gz
+		ext = strings.ToLower(filepath.Ext(strings.TrimSuffix(name, filepath.Ext(name))))
+	}
+
+	fileDecodersMu.RLock()
+	decode, ok := fileDecoders[ext]
+	fileDecodersMu.RUnlock()
+	if !ok {
+		return nil, &UnsupportedFileError{name}
+	}
+
+	file, err := decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return file, nil
+}
+
+// movingSpeed is the speed in meters per second below which time between
+// two points doesn't count as moving time
+const movingSpeed = 0.5
+
+// Summarize fills in the activity's distance, times, elevation, heart rate,
+// cadence, speeds and route from its streams, keeping any value the decoder
+// already set.  A missing distance stream is computed from the route.
+func (f *ActivityFile) Summarize() {
+	s := f.Streams
+	if s == nil || s.Len() == 0 {
+		return
+	}
+	a := &f.Activity
+
+	if len(s.Distance) == 0 && len(s.LatLng) == s.Len() {
+		s.Distance = make([]float64, s.Len())
+		for i := 1; i < s.Len(); i++ {
+			s.Distance[i] = s.Distance[i-1] + geo.Distance(s.LatLng[i-1], s.LatLng[i])
+		}
+	}
+
+	var moving, elevationGain float64
+	for i := 1; i < s.Len(); i++ {
+		dt := float64(s.Time[i] - s.Time[i-1])
+		if len(s.Distance) == s.Len() && dt > 0 && (s.Distance[i]-s.Distance[i-1])/dt >= movingSpeed {
+			moving += dt
+		}
+		if len(s.Altitude) == s.Len() && s.Altitude[i] > s.Altitude[i-1] {
+			elevationGain += s.Altitude[i] - s.Altitude[i-1]
+		}
+	}
+
+	setIfZero := func(into *float64, v float64) {
+		if *into == 0 {
+			*into = v
+		}
+	}
+	setIfZero(&a.ElapsedTime, float64(s.Time[s.Len()-1]-s.Time[0]))
+	setIfZero(&a.MovingTime, moving)
+	if len(s.Distance) > 0 {
+		setIfZero(&a.Distance, s.Distance[len(s.Distance)-1])
+	}
+	setIfZero(&a.TotalElevationGain, elevationGain)
+	if len(s.Altitude) > 0 {
+		low, high := s.Altitude[0], s.Altitude[0]
+		for _, alt := range s.Altitude {
+			low, high = math.Min(low, alt), math.Max(high, alt)
+		}
+		setIfZero(&a.ElevLow, low)
+		setIfZero(&a.ElevHigh, high)
+	}
+	if a.MovingTime > 0 {
+		setIfZero(&a.AverageSpeed, a.Distance/a.MovingTime)
+	}
+	if len(s.Velocity) > 0 {
+		setIfZero(&a.MaxSpeed, maxFloat(s.Velocity))
+	}
+	if len(s.Heartrate) > 0 {
+		a.HasHeartrate = true
+		setIfZero(&a.AverageHeartrate, averageInt(s.Heartrate))
+		setIfZero(&a.MaxHeartrate, float64(maxInt(s.Heartrate)))
+	}
+	if len(s.Cadence) > 0 {
+		setIfZero(&a.AverageCadence, averageInt(s.Cadence))
+	}
+	if a.Map.Polyline == "" && len(s.LatLng) > 0 {
+		a.Map.Polyline = geo.Encode(s.LatLng)
+	}
+}
+
+func averageInt(values []int32) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += float64(v)
+	}
+	return sum / float64(len(values))
+}
+
+func maxInt(values []int32) int32 {
+	max := values[0]
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+func maxFloat(values []float64) float64 {
+	max := values[0]
+	for _, v := range values {
+		max = math.Max(max, v)
+	}
+	return max
+}
+
+// ImportFiles imports activity files from disk.  Each becomes a local
+// activity with a negative id, so it can't collide with a Strava id.  A
+// file that matches a stored activity (see findDuplicate), e.g. one Strava
+// already has from the watch, is skipped, so importing is idempotent.
+func ImportFiles(store DataStore, paths []string) (*ImportResult, error) {
+	result := ImportResult{}
+	for _, path := range paths {
+		file, err := decodeFileAt(path)
+		var unsupported *UnsupportedFileError
+		if errors.As(err, &unsupported) {
+			log.Printf("%v", err)
+			result.Unsupported++
+			continue
+		} else if err != nil {
+			log.Printf("%v", err)
+			result.Failed++
+			continue
+		}
+		result.Files++
+
+		activity := &file.Activity
+		if activity.DateString == "" {
+			log.Printf("%s: no start time", path)
+			result.Failed++
+			continue
+		}
+		if activity.Name == "" {
+			activity.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+
+		duplicate, err := findDuplicate(store, activity.SummaryActivity)
+		if err != nil {
+			return &result, err
+		}
+		if duplicate != nil {
+			log.Printf("%s: already stored as activity %d (%s)", path, duplicate.Id, duplicate.Name)
+			result.Existing++
+			continue
+		}
+
+		activity.Id, err = store.NextLocalActivityId()
+		if err != nil {
+			return &result, err
+		}
+		if err := saveActivityFile(store, file); err != nil {
+			return &result, err
+		}
+		log.Printf("imported %s as activity %d: %s, %s", path, activity.Id, activity.Name, activity.DistanceString())
+		result.Imported++
+	}
+	return &result, nil
+}
+
+// Tolerances for matching a file to a stored activity
+const (
+	duplicateStartTolerance = 60 * time.Second
+	duplicateTolerance      = 0.05 // fraction of the distance or moving time
+)
+
+// findDuplicate returns a stored activity, including a deleted one, that
+// is the same as an activity decoded from a file: it has about the same
+// distance and moving time and starts within a minute of it.  Files only
+// have UTC times, which are compared with the UTC start of activities that
+// have one, and of other imported files.  Older rows only have Strava's
+// local start time, so for them it's enough to start within a minute in
+// some time zone, which are whole multiples of 15 minutes from UTC.
+func findDuplicate(store DataStore, activity SummaryActivity) (*SummaryActivity, error) {
+	start := activity.StartTime()
+	candidates, err := store.Load(ActivityFilter{
+		After:          start.Add(-14*time.Hour - duplicateStartTolerance),
+		Before:         start.Add(14*time.Hour + duplicateStartTolerance),
+		IncludeDeleted: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, candidate := range candidates {
+		offset := candidate.StartTime().Sub(start)
+		if candidate.StartDate == "" && !candidate.IsLocal() {
+			offset %= 15 * time.Minute
+			if offset < 0 {
+				offset += 15 * time.Minute
+			}
+			if offset > 15*time.Minute/2 {
+				offset = 15*time.Minute - offset
+			}
+		}
+		if offset < -duplicateStartTolerance || offset > duplicateStartTolerance {
+			continue
+		}
+		if !similar(candidate.Distance, activity.Distance) {
+			continue
+		}
+		if candidate.MovingTime > 0 && activity.MovingTime > 0 && !similar(candidate.MovingTime, activity.MovingTime) {
+			continue
+		}
+		return &candidates[i], nil
+	}
+	return nil, nil
+}
+
+func similar(a, b float64) bool {
+	return math.Abs(a-b) <= duplicateTolerance*math.Max(a, b)
+}
+
+func decodeFileAt(path string) (*ActivityFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return DecodeFile(path, f)
+}
+
+// saveActivityFile stores a local activity along with its details, laps and
+// streams.  All of them are saved, even if empty, so Sync never asks Strava
+// for the children of an activity it doesn't know about.
+func saveActivityFile(store DataStore, file *ActivityFile) error {
+	id := file.Activity.Id
+	streams := file.Streams
+	if streams == nil {
+		streams = &Streams{}
+	}
+	if err := store.Save([]SummaryActivity{file.Activity.SummaryActivity}); err != nil {
+		return err
+	}
+	if err := store.SaveDetails(file.Activity); err != nil {
+		return err
+	}
+	if err := store.SaveLaps(id, file.Laps); err != nil {
+		return err
+	}
+	return store.SaveStreams(id, streams)
+}
@@ -0,0 +1,120 @@
+package strava_test
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func init() {
+	// .activity files are an ActivityFile as JSON, to import whatever a
+	// test needs
+	strava.RegisterFileDecoder(".activity", func(r io.Reader) (*strava.ActivityFile, error) {
+		file := &strava.ActivityFile{}
+		return file, json.NewDecoder(r).Decode(file)
+	})
+}
+
+func writeActivityFile(t *testing.T, dir, name string, activity strava.DetailedActivity) string {
+	t.Helper()
+	data, err := json.Marshal(strava.ActivityFile{Activity: activity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImportFilesDedupe(t *testing.T) {
+	store := newTestStore(t)
+	// Strava's copy of a morning run in Boston, with the local start time
+	err := store.Save([]strava.SummaryActivity{
+		{Id: 7100000001, Name: "Morning Run", DateString: "2022-05-07T07:00:05Z", Distance: 10012, MovingTime: 3010, Type: "Run"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activity := func(date string, distance, movingTime float64) strava.DetailedActivity {
+		a := strava.DetailedActivity{}
+		a.DateString, a.Distance, a.MovingTime, a.Type = date, distance, movingTime, "Run"
+		return a
+	}
+	dir := t.TempDir()
+	paths := []string{
+		// The watch's file of the same run, in UTC
+		writeActivityFile(t, dir, "same.activity", activity("2022-05-07T11:00:00Z", 10000, 3000)),
+		// An evening run on the same day
+		writeActivityFile(t, dir, "evening.activity", activity("2022-05-07T22:00:00Z", 10000, 3000)),
+		// Starting at the same time but a different distance
+		writeActivityFile(t, dir, "longer.activity", activity("2022-05-08T11:00:00Z", 10000, 3000)),
+	}
+	err = store.Save([]strava.SummaryActivity{
+		{Id: 7100000002, Name: "Long Run", DateString: "2022-05-08T07:00:00Z", Distance: 20000, MovingTime: 6000, Type: "Run"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := strava.ImportFiles(store, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Existing != 1 || result.Imported != 2 {
+		t.Errorf("expected one duplicate and two imports, got %s", result)
+	}
+
+	result, err = strava.ImportFiles(store, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Existing != 3 || result.Imported != 0 {
+		t.Errorf("expected importing again to find every file, got %s", result)
+	}
+}
+
+// TestImportFilesDoubles imports both runs of a day in Sydney (UTC+10),
+// 12 hours apart with about the same distance, when Strava only has the
+// morning one: the evening one starts a whole number of hours from it, so
+// only its UTC start time tells them apart
+func TestImportFilesDoubles(t *testing.T) {
+	store := newTestStore(t)
+	err := store.Save([]strava.SummaryActivity{
+		{Id: 7100000011, Name: "Morning Run", DateString: "2022-05-07T06:00:05Z", StartDate: "2022-05-06T20:00:05Z", Distance: 8012, MovingTime: 2410, Type: "Run"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activity := func(date string, distance, movingTime float64) strava.DetailedActivity {
+		a := strava.DetailedActivity{}
+		a.DateString, a.Distance, a.MovingTime, a.Type = date, distance, movingTime, "Run"
+		return a
+	}
+	dir := t.TempDir()
+	morning := writeActivityFile(t, dir, "morning.activity", activity("2022-05-06T20:00:00Z", 8000, 2400))
+	evening := writeActivityFile(t, dir, "evening.activity", activity("2022-05-07T08:00:00Z", 8100, 2450))
+
+	result, err := strava.ImportFiles(store, []string{morning, evening})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Existing != 1 || result.Imported != 1 {
+		t.Errorf("expected the morning run to be found and the evening one imported, got %s", result)
+	}
+	activities, err := store.Load(strava.ActivityFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 2 || !activities[0].IsLocal() || !activities[0].StartTime().Equal(time.Date(2022, 5, 7, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the imported evening run and Strava's morning run, got %+v", activities)
+	}
+}
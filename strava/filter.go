@@ -0,0 +1,128 @@
+package strava
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type SortOrder int
+
+const (
+	NewestFirst SortOrder = iota
+	OldestFirst
+	LongestFirst
+	ShortestFirst
+)
+
+// ActivityFilter selects activities from a DataStore.  The zero value
+// matches every activity that hasn't been deleted, newest first.
+type ActivityFilter struct {
+	Types        []string  // e.g. "Run", "Ride"; empty matches every type
+	After        time.Time // inclusive, compared against start_date_local
+	Before       time.Time // exclusive, compared against start_date_local
+	MinDistance  float64   // meters
+	MaxDistance  float64   // meters
+	WorkoutType  *int
+	IsRace       *bool
+	NameContains string // case insensitive
+	HasPolyline  bool
+	// IncludeDeleted also matches activities marked deleted because they
+	// no longer exist upstream
+	IncludeDeleted bool
+	Limit          int
+	Offset         int
+	Sort           SortOrder
+}
+
+// compile turns the filter into a WHERE/ORDER BY/LIMIT clause suffix for a
+// query against strava_activities, plus the bind parameters it references.
+// Any extra conditions are ANDed into the WHERE clause as-is.
+func (f ActivityFilter) compile(d dialect, extra ...string) (string, []interface{}) {
+	where := append([]string{}, extra...)
+	args := []interface{}{}
+	param := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if !f.IncludeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+
+	if len(f.Types) > 0 {
+		placeholders := []string{}
+		for _, t := range f.Types {
+			placeholders = append(placeholders, param(t))
+		}
+		where = append(where, fmt.Sprintf("%s IN (%s)", d.jsonText("type"), strings.Join(placeholders, ", ")))
+	}
+
+	if !f.After.IsZero() {
+		where = append(where, "start_time_local >= "+param(f.After.Format("2006-01-02T15:04:05Z")))
+	}
+
+	if !f.Before.IsZero() {
+		where = append(where, "start_time_local < "+param(f.Before.Format("2006-01-02T15:04:05Z")))
+	}
+
+	if f.MinDistance > 0 {
+		where = append(where, d.jsonNumber("distance")+" >= "+param(f.MinDistance))
+	}
+
+	if f.MaxDistance > 0 {
+		where = append(where, d.jsonNumber("distance")+" <= "+param(f.MaxDistance))
+	}
+
+	workoutType := fmt.Sprintf("coalesce(%s, 0)", d.jsonNumber("workout_type"))
+	if f.WorkoutType != nil {
+		where = append(where, workoutType+" = "+param(*f.WorkoutType))
+	}
+
+	if f.IsRace != nil {
+		if *f.IsRace {
+			where = append(where, workoutType+" = 1")
+		} else {
+			where = append(where, workoutType+" <> 1")
+		}
+	}
+
+	if f.NameContains != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(f.NameContains)
+		where = append(where, fmt.Sprintf(`%s %s %s ESCAPE '\'`, d.jsonText("name"), d.ilike, param("%"+escaped+"%")))
+	}
+
+	if f.HasPolyline {
+		where = append(where, fmt.Sprintf("coalesce(%s, '') <> ''", d.jsonText("map", "summary_polyline")))
+	}
+
+	clause := ""
+	if len(where) > 0 {
+		clause += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	switch f.Sort {
+	case OldestFirst:
+		clause += " ORDER BY start_time_local ASC"
+	case LongestFirst:
+		clause += fmt.Sprintf(" ORDER BY %s DESC", d.jsonNumber("distance"))
+	case ShortestFirst:
+		clause += fmt.Sprintf(" ORDER BY %s ASC", d.jsonNumber("distance"))
+	default:
+		clause += " ORDER BY start_time_local DESC"
+	}
+
+	if f.Limit > 0 {
+		clause += " LIMIT " + param(f.Limit)
+	}
+
+	if f.Offset > 0 {
+		if f.Limit <= 0 {
+			// SQLite does not allow an OFFSET without a LIMIT
+			clause += " LIMIT " + param(int64(1<<62))
+		}
+		clause += " OFFSET " + param(f.Offset)
+	}
+
+	return clause, args
+}
@@ -0,0 +1,86 @@
+package strava_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func TestFilter(t *testing.T) {
+	store := newTestStore(t)
+	run := func(id int64, name, activityType, date string, distance float64, workoutType int) strava.SummaryActivity {
+		return strava.SummaryActivity{Id: id, Name: name, Type: activityType, DateString: date, Distance: distance, WorkoutType: workoutType}
+	}
+	activities := []strava.SummaryActivity{
+		run(1, "Morning Run", "Run", "2022-01-05T06:00:00Z", 5000, 0),
+		run(2, "100% effort", "Run", "2022-02-10T07:00:00Z", 1609, 1),
+		run(3, "100 effort", "Run", "2022-02-11T07:00:00Z", 1700, 0),
+		run(4, "Commute", "Ride", "2022-03-01T08:00:00Z", 12000, 10),
+		run(5, "Boston Marathon", "Run", "2022-04-18T10:00:00Z", 42195, 1),
+		run(6, "Track_Intervals", "Run", "2022-05-01T18:00:00Z", 8000, 3),
+		run(7, "Track Intervals", "Run", "2022-06-01T18:00:00Z", 8100, 3),
+		run(8, "Deleted Walk", "Walk", "2022-07-01T12:00:00Z", 3000, 0),
+	}
+	activities[0].Map.Polyline = "_p~iF~ps|U_ulLnnqC_mqNvxq`@"
+	if err := store.Save(activities); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkDeleted(8); err != nil {
+		t.Fatal(err)
+	}
+
+	date := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	yes, no, tempo := true, false, 3
+	for _, test := range []struct {
+		name   string
+		filter strava.ActivityFilter
+		ids    []int64
+	}{
+		{"everything but deleted, newest first", strava.ActivityFilter{}, []int64{7, 6, 5, 4, 3, 2, 1}},
+		{"including deleted", strava.ActivityFilter{IncludeDeleted: true}, []int64{8, 7, 6, 5, 4, 3, 2, 1}},
+		{"one type", strava.ActivityFilter{Types: []string{"Ride"}}, []int64{4}},
+		{"several types", strava.ActivityFilter{Types: []string{"Ride", "Walk"}, IncludeDeleted: true}, []int64{8, 4}},
+		{"after is inclusive", strava.ActivityFilter{After: date("2022-04-18").Add(10 * time.Hour)}, []int64{7, 6, 5}},
+		{"before is exclusive", strava.ActivityFilter{Before: date("2022-02-11").Add(7 * time.Hour)}, []int64{2, 1}},
+		{"between", strava.ActivityFilter{After: date("2022-02-01"), Before: date("2022-04-01")}, []int64{4, 3, 2}},
+		{"min distance", strava.ActivityFilter{MinDistance: 8000}, []int64{7, 6, 5, 4}},
+		{"max distance", strava.ActivityFilter{MaxDistance: 1700}, []int64{3, 2}},
+		{"distance range", strava.ActivityFilter{MinDistance: 5000, MaxDistance: 8000}, []int64{6, 1}},
+		{"races", strava.ActivityFilter{IsRace: &yes}, []int64{5, 2}},
+		{"not races", strava.ActivityFilter{IsRace: &no, Types: []string{"Run"}}, []int64{7, 6, 3, 1}},
+		{"workout type", strava.ActivityFilter{WorkoutType: &tempo}, []int64{7, 6}},
+		{"name, ignoring case", strava.ActivityFilter{NameContains: "track"}, []int64{7, 6}},
+		{"name with a literal %", strava.ActivityFilter{NameContains: "100%"}, []int64{2}},
+		{"name with a literal _", strava.ActivityFilter{NameContains: "k_I"}, []int64{6}},
+		{"name with a backslash", strava.ActivityFilter{NameContains: `\`}, nil},
+		{"with a route", strava.ActivityFilter{HasPolyline: true}, []int64{1}},
+		{"oldest first", strava.ActivityFilter{Types: []string{"Run"}, Sort: strava.OldestFirst}, []int64{1, 2, 3, 5, 6, 7}},
+		{"longest first", strava.ActivityFilter{Sort: strava.LongestFirst}, []int64{5, 4, 7, 6, 1, 3, 2}},
+		{"shortest first", strava.ActivityFilter{Sort: strava.ShortestFirst}, []int64{2, 3, 1, 6, 7, 4, 5}},
+		{"limit", strava.ActivityFilter{Limit: 2}, []int64{7, 6}},
+		{"limit and offset", strava.ActivityFilter{Limit: 2, Offset: 2}, []int64{5, 4}},
+		{"offset without a limit", strava.ActivityFilter{Offset: 5}, []int64{2, 1}},
+		{"everything at once", strava.ActivityFilter{Types: []string{"Run"}, After: date("2022-02-01"), MinDistance: 1000, IsRace: &no, Sort: strava.OldestFirst, Limit: 1, Offset: 1}, []int64{6}},
+	} {
+		activities, err := store.Load(test.filter)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var ids []int64
+		for _, activity := range activities {
+			ids = append(ids, activity.Id)
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("%s: expected activities %v, got %v", test.name, test.ids, ids)
+		}
+	}
+}
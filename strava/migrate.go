@@ -0,0 +1,102 @@
+package strava
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is one numbered step of a backend's schema.  Versions are applied
+// in ascending order and recorded in the schema_migrations table, so each
+// migration runs exactly once per database.
+type migration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+type MigrationStatus struct {
+	Version     int
+	Description string
+	AppliedAt   *time.Time // nil if the migration is pending
+}
+
+func (m MigrationStatus) Pending() bool {
+	return m.AppliedAt == nil
+}
+
+func (s *sqlDataStore) appliedMigrations() (map[int]time.Time, error) {
+	if _, err := s.db.Exec(s.dialect.migrationsTable); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists every known migration along with when it was applied
+func (s *sqlDataStore) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	for _, m := range s.dialect.migrations {
+		st := MigrationStatus{Version: m.version, Description: m.description}
+		if appliedAt, ok := applied[m.version]; ok {
+			st.AppliedAt = &appliedAt
+		}
+		status = append(status, st)
+	}
+	return status, nil
+}
+
+// Migrate applies all pending migrations, each in its own transaction
+func (s *sqlDataStore) Migrate() error {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range s.dialect.migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+
+		log.Printf("applying migration %d: %s", m.version, m.description)
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range m.statements {
+			if _, err := tx.Exec(statement); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %v", m.version, err)
+			}
+		}
+		query := `INSERT INTO schema_migrations (version, description, applied_at) VALUES ($1, $2, $3)`
+		if _, err := tx.Exec(query, m.version, m.description, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
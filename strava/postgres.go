@@ -0,0 +1,104 @@
+package strava
+
+import (
+	"fmt"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+var postgresDialect = dialect{
+	driver: "postgres",
+	ilike:  "ILIKE",
+	jsonText: func(path ...string) string {
+		return fmt.Sprintf("(value#>>'{%s}')", strings.Join(path, ","))
+	},
+	jsonNumber: func(path ...string) string {
+		return fmt.Sprintf("(value#>>'{%s}')::float8", strings.Join(path, ","))
+	},
+	migrationsTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer primary key,
+		description text not null,
+		applied_at timestamptz not null
+	)`,
+	migrations: []migration{
+		{1, "create activity, lap and session tables", []string{
+			`CREATE TABLE IF NOT EXISTS strava_activities (
+				id bigint primary key,
+				value jsonb
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS strava_laps (
+				id bigint primary key,
+				activity_id text,
+				value jsonb
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS strava_session (
+				id integer primary key,
+				value jsonb
+			)`,
+		}},
+		{2, "add typed start_time_local column to activities", []string{
+			`ALTER TABLE strava_activities ADD COLUMN IF NOT EXISTS start_time_local timestamptz`,
+			`UPDATE strava_activities
+				SET start_time_local = (value->>'start_date_local')::timestamptz
+				WHERE start_time_local IS NULL`,
+			`DROP INDEX IF EXISTS strava_activities_date`,
+			`CREATE INDEX IF NOT EXISTS strava_activities_start_time_local ON strava_activities (start_time_local DESC)`,
+		}},
+		{3, "make lap activity_id a bigint and index it", []string{
+			`ALTER TABLE strava_laps ALTER COLUMN activity_id TYPE bigint USING activity_id::bigint`,
+			`CREATE INDEX IF NOT EXISTS strava_laps_activity_id ON strava_laps (activity_id)`,
+		}},
+		{4, "create activity details table", []string{
+			`CREATE TABLE IF NOT EXISTS strava_activity_details (
+				activity_id bigint primary key,
+				value jsonb
+			)`,
+		}},
+		{5, "create activity streams table", []string{
+			`CREATE TABLE IF NOT EXISTS strava_streams (
+				activity_id bigint primary key,
+				value bytea
+			)`,
+		}},
+		{6, "track sync progress and which activities have their laps", []string{
+			`ALTER TABLE strava_activities ADD COLUMN IF NOT EXISTS laps_fetched boolean NOT NULL DEFAULT false`,
+			`UPDATE strava_activities SET laps_fetched = true WHERE id IN (SELECT activity_id FROM strava_laps)`,
+			`CREATE TABLE IF NOT EXISTS strava_sync_state (
+				id integer primary key,
+				value jsonb
+			)`,
+		}},
+		{7, "keep activity revisions and soft delete activities", []string{
+			`ALTER TABLE strava_activities ADD COLUMN IF NOT EXISTS deleted_at timestamptz`,
+			`CREATE TABLE IF NOT EXISTS strava_activity_revisions (
+				id bigserial primary key,
+				activity_id bigint not null,
+				value jsonb,
+				replaced_at timestamptz not null
+			)`,
+			`CREATE INDEX IF NOT EXISTS strava_activity_revisions_activity_id ON strava_activity_revisions (activity_id)`,
+		}},
+		{8, "record edits made to activity metadata", []string{
+			`CREATE TABLE IF NOT EXISTS strava_activity_edits (
+				id bigserial primary key,
+				activity_id bigint not null,
+				value jsonb,
+				edited_at timestamptz not null
+			)`,
+			`CREATE INDEX IF NOT EXISTS strava_activity_edits_activity_id ON strava_activity_edits (activity_id)`,
+		}},
+	},
+}
+
+// NewPostgresDataStore opens a DataStore backed by Postgres, e.g.
+// NewPostgresDataStore("dbname=website sslmode=disable")
+func NewPostgresDataStore(dsn string) (DataStore, error) {
+	store, err := openDataStore(postgresDialect, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
@@ -0,0 +1,167 @@
+package strava
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Strava's documented defaults, used until a response tells us otherwise
+const (
+	defaultShortLimit = 100
+	defaultDailyLimit = 1000
+	shortWindow       = 15 * time.Minute
+)
+
+// RateBudget is Strava's accounting of our API usage, as reported by the
+// X-RateLimit-Limit and X-RateLimit-Usage headers.  The short window resets
+// every quarter hour and the daily window at midnight UTC.
+type RateBudget struct {
+	ShortLimit int       `json:"short_limit"`
+	ShortUsage int       `json:"short_usage"`
+	DailyLimit int       `json:"daily_limit"`
+	DailyUsage int       `json:"daily_usage"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+func (b RateBudget) ShortRemaining() int {
+	if b.UpdatedAt.IsZero() || !shortWindowStart(time.Now()).Equal(shortWindowStart(b.UpdatedAt)) {
+		return b.ShortLimit
+	}
+	return b.ShortLimit - b.ShortUsage
+}
+
+func (b RateBudget) DailyRemaining() int {
+	if b.UpdatedAt.IsZero() || !dailyWindowStart(time.Now()).Equal(dailyWindowStart(b.UpdatedAt)) {
+		return b.DailyLimit
+	}
+	return b.DailyLimit - b.DailyUsage
+}
+
+func (b RateBudget) String() string {
+	return fmt.Sprintf(
+		"%d/%d left this 15 minutes, %d/%d left today",
+		b.ShortRemaining(), b.ShortLimit, b.DailyRemaining(), b.DailyLimit,
+	)
+}
+
+func shortWindowStart(t time.Time) time.Time {
+	return t.UTC().Truncate(shortWindow)
+}
+
+func dailyWindowStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// parseRateBudget reads the "short,daily" pairs from Strava's rate limit
+// headers.  ok is false if the response didn't include them.
+func parseRateBudget(header http.Header) (budget RateBudget, ok bool) {
+	pair := func(name string) (int, int, bool) {
+		parts := strings.Split(header.Get(name), ",")
+		if len(parts) != 2 {
+			return 0, 0, false
+		}
+		short, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+		daily, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+		return short, daily, err1 == nil && err2 == nil
+	}
+
+	shortLimit, dailyLimit, ok1 := pair("X-RateLimit-Limit")
+	shortUsage, dailyUsage, ok2 := pair("X-RateLimit-Usage")
+	if !ok1 || !ok2 {
+		return budget, false
+	}
+	return RateBudget{shortLimit, shortUsage, dailyLimit, dailyUsage, time.Now().UTC()}, true
+}
+
+// rateLimiter spaces requests so the remaining 15 minute budget lasts until
+// the window resets, and blocks entirely once either window is exhausted
+type rateLimiter struct {
+	mu      sync.Mutex
+	limiter *rate.Limiter
+	budget  RateBudget
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		limiter: rate.NewLimiter(defaultShortLimit/rate.Limit(shortWindow.Seconds()), 10),
+		budget:  RateBudget{ShortLimit: defaultShortLimit, DailyLimit: defaultDailyLimit},
+	}
+}
+
+func (l *rateLimiter) Budget() RateBudget {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.budget
+}
+
+// restore seeds the limiter with a budget persisted by an earlier process,
+// so a new run doesn't start by overrunning an exhausted window
+func (l *rateLimiter) restore(budget RateBudget) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if budget.UpdatedAt.After(l.budget.UpdatedAt) {
+		l.budget = budget
+	}
+}
+
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	budget := l.Budget()
+
+	var until time.Time
+	if budget.DailyRemaining() <= 0 {
+		until = dailyWindowStart(time.Now()).Add(24 * time.Hour)
+	} else if budget.ShortRemaining() <= 0 {
+		until = shortWindowStart(time.Now()).Add(shortWindow)
+	}
+
+	if !until.IsZero() {
+		log.Printf("rate limit exhausted (%s); waiting until %s", budget, until.Local().Format("15:04:05"))
+		if err := sleep(ctx, time.Until(until)); err != nil {
+			return err
+		}
+	}
+
+	return l.limiter.Wait(ctx)
+}
+
+// update records the budget from a response and re-paces the limiter to
+// spread the remaining short window budget over the time left in it
+func (l *rateLimiter) update(header http.Header) {
+	budget, ok := parseRateBudget(header)
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.budget = budget
+
+	remaining := budget.ShortRemaining()
+	if daily := budget.DailyRemaining(); daily < remaining {
+		remaining = daily
+	}
+	left := shortWindowStart(budget.UpdatedAt).Add(shortWindow).Sub(budget.UpdatedAt)
+	if remaining > 0 && left > 0 {
+		l.limiter.SetLimit(rate.Limit(float64(remaining) / left.Seconds()))
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,146 @@
+package strava_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/strava/stravatest"
+)
+
+func TestRateBudgetFromHeaders(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	server.ShortLimit, server.DailyLimit = 600, 30000
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Sync(context.Background(), newTestStore(t), strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	n := len(server.Requests())
+	budget := client.RateBudget()
+	if budget.ShortLimit != 600 || budget.DailyLimit != 30000 || budget.ShortUsage != n || budget.DailyUsage != n {
+		t.Errorf("expected limits 600,30000 and usage %d,%d, got %+v", n, n, budget)
+	}
+	if budget.ShortRemaining() != 600-n || budget.DailyRemaining() != 30000-n {
+		t.Errorf("expected %d and %d left, got %s", 600-n, 30000-n, budget)
+	}
+}
+
+func TestRateBudgetWindows(t *testing.T) {
+	now := time.Now().UTC()
+	quarterHour := now.Truncate(15 * time.Minute)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		name         string
+		updatedAt    time.Time
+		short, daily int
+	}{
+		{"never updated", time.Time{}, 100, 1000},
+		{"this quarter hour", quarterHour, 60, 400},
+		{"last quarter hour", quarterHour.Add(-time.Second), 100, 400},
+		{"yesterday", midnight.Add(-time.Second), 100, 1000},
+	} {
+		if test.name == "last quarter hour" && quarterHour.Equal(midnight) {
+			// the quarter hour before was yesterday
+			test.daily = 1000
+		}
+		budget := strava.RateBudget{ShortLimit: 100, ShortUsage: 40, DailyLimit: 1000, DailyUsage: 600, UpdatedAt: test.updatedAt}
+		if short, daily := budget.ShortRemaining(), budget.DailyRemaining(); short != test.short || daily != test.daily {
+			t.Errorf("%s: expected %d and %d left, got %d and %d", test.name, test.short, test.daily, short, daily)
+		}
+	}
+}
+
+func TestSyncWaitsForAnExhaustedWindow(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	// The client gets a 429 and then waits for the next quarter hour instead
+	// of retrying on its usual backoff
+	server.ExhaustShortWindow()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := client.Sync(ctx, store, strava.SyncOptions{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the sync to wait out the window, got %v", err)
+	}
+	if n := len(server.Requests()); n != 1 {
+		t.Errorf("expected a single request in the exhausted window, got %d", n)
+	}
+	if budget := client.RateBudget(); budget.ShortRemaining() > 0 {
+		t.Errorf("expected the short window to be exhausted, got %s", budget)
+	}
+}
+
+func TestSyncRestoresRateBudget(t *testing.T) {
+	// Stay clear of the end of the quarter hour, which would reset the budget
+	// mid-test
+	if left := time.Until(time.Now().Truncate(15 * time.Minute).Add(15 * time.Minute)); left < 2*time.Second {
+		time.Sleep(left)
+	}
+	now := time.Now().UTC()
+	for _, test := range []struct {
+		name      string
+		updatedAt time.Time
+		waits     bool
+	}{
+		{"this quarter hour", now.Truncate(15 * time.Minute), true},
+		{"last quarter hour", now.Truncate(15 * time.Minute).Add(-time.Second), false},
+	} {
+		server := stravatest.NewServer()
+		client, err := server.Client()
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := newTestStore(t)
+		exhausted := strava.RateBudget{ShortLimit: 100, ShortUsage: 100, DailyLimit: 1000, DailyUsage: 100, UpdatedAt: test.updatedAt}
+		if err := store.SaveSyncState(&strava.SyncState{RateBudget: exhausted}); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = client.Sync(ctx, store, strava.SyncOptions{})
+		cancel()
+		server.Close()
+		if test.waits && (!errors.Is(err, context.DeadlineExceeded) || len(server.Requests()) != 0) {
+			t.Errorf("%s: expected the sync to wait without a request, got %v after %d requests", test.name, err, len(server.Requests()))
+		}
+		if !test.waits && err != nil {
+			t.Errorf("%s: expected the budget to have reset, got %v", test.name, err)
+		}
+	}
+}
+
+func TestRateLimitedRequestsBackOff(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	server.Fail("/api/v3/activities/7023456789/laps", http.StatusTooManyRequests)
+	server.Fail("/api/v3/activities/7023456789/laps", http.StatusTooManyRequests)
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := client.Sync(context.Background(), newTestStore(t), strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(server.Requests(), "/api/v3/activities/7023456789/laps"); n != 3 {
+		t.Errorf("expected the request to be retried twice, got %d requests", n)
+	}
+	// one second, then two
+	if elapsed := time.Since(start); elapsed < 3*time.Second {
+		t.Errorf("expected the retries to back off for 3s, took %s", elapsed)
+	}
+}
@@ -0,0 +1,104 @@
+package strava
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = dialect{
+	driver: "sqlite3",
+	ilike:  "LIKE",
+	jsonText: func(path ...string) string {
+		return fmt.Sprintf("json_extract(value, '$.%s')", strings.Join(path, "."))
+	},
+	jsonNumber: func(path ...string) string {
+		return fmt.Sprintf("json_extract(value, '$.%s')", strings.Join(path, "."))
+	},
+	migrationsTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version integer primary key,
+		description text not null,
+		applied_at timestamp not null
+	)`,
+	migrations: []migration{
+		{1, "create activity, lap and session tables", []string{
+			`CREATE TABLE IF NOT EXISTS strava_activities (
+				id integer primary key,
+				value text
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS strava_laps (
+				id integer primary key,
+				activity_id integer,
+				value text
+			)`,
+
+			`CREATE TABLE IF NOT EXISTS strava_session (
+				id integer primary key,
+				value text
+			)`,
+		}},
+		{2, "add typed start_time_local column to activities", []string{
+			`ALTER TABLE strava_activities ADD COLUMN start_time_local text`,
+			`UPDATE strava_activities SET start_time_local = json_extract(value, '$.start_date_local')`,
+			`CREATE INDEX IF NOT EXISTS strava_activities_start_time_local ON strava_activities (start_time_local DESC)`,
+		}},
+		{3, "index lap activity_id", []string{
+			`CREATE INDEX IF NOT EXISTS strava_laps_activity_id ON strava_laps (activity_id)`,
+		}},
+		{4, "create activity details table", []string{
+			`CREATE TABLE IF NOT EXISTS strava_activity_details (
+				activity_id integer primary key,
+				value text
+			)`,
+		}},
+		{5, "create activity streams table", []string{
+			`CREATE TABLE IF NOT EXISTS strava_streams (
+				activity_id integer primary key,
+				value blob
+			)`,
+		}},
+		{6, "track sync progress and which activities have their laps", []string{
+			`ALTER TABLE strava_activities ADD COLUMN laps_fetched boolean NOT NULL DEFAULT false`,
+			`UPDATE strava_activities SET laps_fetched = true WHERE id IN (SELECT activity_id FROM strava_laps)`,
+			`CREATE TABLE IF NOT EXISTS strava_sync_state (
+				id integer primary key,
+				value text
+			)`,
+		}},
+		{7, "keep activity revisions and soft delete activities", []string{
+			`ALTER TABLE strava_activities ADD COLUMN deleted_at timestamp`,
+			`CREATE TABLE IF NOT EXISTS strava_activity_revisions (
+				id integer primary key autoincrement,
+				activity_id integer not null,
+				value text,
+				replaced_at timestamp not null
+			)`,
+			`CREATE INDEX IF NOT EXISTS strava_activity_revisions_activity_id ON strava_activity_revisions (activity_id)`,
+		}},
+		{8, "record edits made to activity metadata", []string{
+			`CREATE TABLE IF NOT EXISTS strava_activity_edits (
+				id integer primary key autoincrement,
+				activity_id integer not null,
+				value text,
+				edited_at timestamp not null
+			)`,
+			`CREATE INDEX IF NOT EXISTS strava_activity_edits_activity_id ON strava_activity_edits (activity_id)`,
+		}},
+	},
+}
+
+// NewSQLiteDataStore opens (and creates if necessary) an embedded SQLite
+// database at the given path, so no database server is needed
+func NewSQLiteDataStore(path string) (DataStore, error) {
+	if err := createDirectoryIfNotExists(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	store, err := openDataStore(sqliteDialect, path)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
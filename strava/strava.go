@@ -1,9 +1,9 @@
 package strava
 
 import (
+	"bufio"
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,22 +18,23 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
-	"golang.org/x/time/rate"
-
-	_ "github.com/lib/pq"
+	"github.com/scottfrazer/running/geo"
 )
 
 type SummaryActivity struct {
 	Id          int64         `json:"id"`
 	Name        string        `json:"name"`
 	DateString  string        `json:"start_date_local"`
+	StartDate   string        `json:"start_date,omitempty"` // in UTC
 	Distance    float64       `json:"distance"`
 	MovingTime  float64       `json:"moving_time"`
 	WorkoutType int           `json:"workout_type"`
 	Type        string        `json:"type"`
+	Private     bool          `json:"private"`
 	Map         ActivityMap   `json:"map"`
 	Laps        []ActivityLap `json:"laps"`
 }
@@ -53,12 +54,68 @@ type ActivityLap struct {
 	AverageSpeed       float64   `json:"average_speed"`
 	MaxSpeed           float64   `json:"max_speed"`
 	AverageCadence     float64   `json:"average_cadence"`
+	AverageHeartrate   float64   `json:"average_heartrate"`
+	MaxHeartrate       float64   `json:"max_heartrate"`
+	Calories           float64   `json:"calories,omitempty"` // from files; Strava's laps don't have it
 	DeviceWatts        bool      `json:"device_watts"`
 	AverageWats        float64   `json:"average_watts"`
 	LapIndex           int32     `json:"lap_index"`
 	Split              int32     `json:"split"`
 }
 
+// DetailedActivity is the full representation returned by /activities/{id}
+type DetailedActivity struct {
+	SummaryActivity
+	Description        string       `json:"description"`
+	Calories           float64      `json:"calories"`
+	DeviceName         string       `json:"device_name"`
+	GearId             string       `json:"gear_id"`
+	Gear               *SummaryGear `json:"gear"`
+	ElapsedTime        float64      `json:"elapsed_time"`
+	TotalElevationGain float64      `json:"total_elevation_gain"`
+	ElevHigh           float64      `json:"elev_high"`
+	ElevLow            float64      `json:"elev_low"`
+	HasHeartrate       bool         `json:"has_heartrate"`
+	AverageHeartrate   float64      `json:"average_heartrate"`
+	MaxHeartrate       float64      `json:"max_heartrate"`
+	AverageCadence     float64      `json:"average_cadence"`
+	AverageSpeed       float64      `json:"average_speed"`
+	MaxSpeed           float64      `json:"max_speed"`
+	SplitsMetric       []Split      `json:"splits_metric"`
+	SplitsStandard     []Split      `json:"splits_standard"`
+	BestEfforts        []BestEffort `json:"best_efforts"`
+}
+
+type Split struct {
+	Split               int32   `json:"split"`
+	Distance            float64 `json:"distance"`
+	ElapsedTime         int32   `json:"elapsed_time"`
+	MovingTime          int32   `json:"moving_time"`
+	ElevationDifference float64 `json:"elevation_difference"`
+	AverageSpeed        float64 `json:"average_speed"`
+	AverageHeartrate    float64 `json:"average_heartrate"`
+	PaceZone            int32   `json:"pace_zone"`
+}
+
+type BestEffort struct {
+	Id             int64     `json:"id"`
+	Name           string    `json:"name"`
+	ElapsedTime    int32     `json:"elapsed_time"`
+	MovingTime     int32     `json:"moving_time"`
+	StartDateLocal time.Time `json:"start_date_local"`
+	Distance       float64   `json:"distance"`
+	PrRank         int32     `json:"pr_rank"`
+	StartIndex     int32     `json:"start_index"`
+	EndIndex       int32     `json:"end_index"`
+}
+
+type SummaryGear struct {
+	Id       string  `json:"id"`
+	Name     string  `json:"name"`
+	Primary  bool    `json:"primary"`
+	Distance float64 `json:"distance"`
+}
+
 type SummaryActivityDateSort []SummaryActivity
 
 func (tds SummaryActivityDateSort) Len() int {
@@ -79,12 +136,51 @@ type ActivityMap struct {
 	Polyline      string `json:"summary_polyline"`
 }
 
+// IsLocal is true for an activity imported from a file rather than Strava
+func (a *SummaryActivity) IsLocal() bool {
+	return a.Id < 0
+}
+
+// Route decodes the activity's summary polyline.  It's empty for
+// activities without GPS, and for a polyline that fails to decode.
+func (a *SummaryActivity) Route() geo.Route {
+	points, err := geo.Decode(a.Map.Polyline)
+	if err != nil {
+		log.Printf("activity %d: %v", a.Id, err)
+		return nil
+	}
+	return points
+}
+
+// BoundingBox is the bounding box of the activity's route, empty if it has
+// none
+func (a *SummaryActivity) BoundingBox() geo.BoundingBox {
+	return a.Route().Bounds()
+}
+
+// Date is the local start time, as Strava gives it: the wall clock time
+// where the activity started, marked as UTC
 func (a *SummaryActivity) Date() time.Time {
 	// TODO: ignoring error
 	t, _ := time.Parse("2006-01-02T15:04:05Z", a.DateString)
 	return t
 }
 
+// StartTime is when the activity actually started, in UTC.  Activities
+// stored without a start_date fall back to Date, which is right for
+// imported files (they only have UTC times) but off by the time zone for
+// activities synced before start_date was kept.
+func (a *SummaryActivity) StartTime() time.Time {
+	if a.StartDate == "" {
+		return a.Date()
+	}
+	t, err := time.Parse(time.RFC3339, a.StartDate)
+	if err != nil {
+		return a.Date()
+	}
+	return t.UTC()
+}
+
 func (a *SummaryActivity) IsRace() bool {
 	return a.WorkoutType == 1
 }
@@ -173,81 +269,284 @@ func (session StravaSession) Json() (string, error) {
 }
 
 func (session StravaSession) IsExpired() bool {
+	return session.expiresWithin(0)
+}
+
+func (session StravaSession) expiresWithin(d time.Duration) bool {
 	expiresAt := time.Unix(session.ExpiresAt, 0)
 	now := time.Now().UTC()
-	return now.After(expiresAt)
+	return now.Add(d).After(expiresAt)
 }
 
+// SessionStore persists the OAuth session; DataStore implements it
+type SessionStore interface {
+	GetSession() (*StravaSession, error)
+	SaveSession(session *StravaSession) error
+}
+
+// refreshMargin is how long before expiry a session is refreshed, so a
+// token doesn't expire between the check and the request
+const refreshMargin = 5 * time.Minute
+
 type StravaClient struct {
-	session *StravaSession
-	limiter *rate.Limiter
+	mu         sync.Mutex // guards session
+	session    *StravaSession
+	sessions   SessionStore
+	limiter    *rateLimiter
+	httpClient *http.Client
+	baseURL    string
+}
+
+const defaultBaseURL = "https://www.strava.com"
+
+// StravaClientOption customizes a StravaClient, e.g. to point it at a fake
+// Strava server in tests
+type StravaClientOption func(*StravaClient)
+
+// WithHTTPClient makes the client send every request through httpClient
+func WithHTTPClient(httpClient *http.Client) StravaClientOption {
+	return func(c *StravaClient) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTransport makes the client send every request through transport
+func WithTransport(transport http.RoundTripper) StravaClientOption {
+	return func(c *StravaClient) {
+		c.httpClient = &http.Client{Transport: transport}
+	}
+}
+
+// WithBaseURL replaces https://www.strava.com as the root of every OAuth and
+// API URL
+func WithBaseURL(baseURL string) StravaClientOption {
+	return func(c *StravaClient) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithSessionStore persists every refreshed session to store, so the next
+// process starts with a valid token
+func WithSessionStore(store SessionStore) StravaClientOption {
+	return func(c *StravaClient) {
+		c.sessions = store
+	}
+}
+
+func newStravaClient(opts []StravaClientOption) *StravaClient {
+	c := &StravaClient{
+		limiter:    newRateLimiter(),
+		httpClient: &http.Client{},
+		baseURL:    defaultBaseURL,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 func NewStravaClient() (*StravaClient, error) {
 	return nil, nil
 }
 
-func refreshSession(session *StravaSession) error {
-	body, err := json.Marshal(map[string]string{
-		"client_id":     session.ClientId,
-		"client_secret": session.ClientSecret,
-		"grant_type":    "refresh_token",
-		"refresh_token": session.RefreshToken,
-	})
-
+// apiPostToken exchanges an authorization code or refresh token for a session
+func (c *StravaClient) apiPostToken(ctx context.Context, params map[string]string) (*StravaSession, error) {
+	body, err := json.Marshal(params)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	req, err := http.NewRequest(
+	req, err := http.NewRequestWithContext(
+		ctx,
 		http.MethodPost,
-		"https://www.strava.com/api/v3/oauth/token",
+		c.baseURL+"/api/v3/oauth/token",
 		bytes.NewReader(body),
 	)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Add("content-type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	jsonBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request failed: %s: %s", resp.Status, jsonBytes)
 	}
 
 	var newSession StravaSession
 	if err := json.Unmarshal(jsonBytes, &newSession); err != nil {
+		return nil, err
+	}
+
+	newSession.ClientId = params["client_id"]
+	newSession.ClientSecret = params["client_secret"]
+	return &newSession, nil
+}
+
+func (c *StravaClient) refreshSession(ctx context.Context, session *StravaSession) error {
+	newSession, err := c.apiPostToken(ctx, map[string]string{
+		"client_id":     session.ClientId,
+		"client_secret": session.ClientSecret,
+		"grant_type":    "refresh_token",
+		"refresh_token": session.RefreshToken,
+	})
+	if err != nil {
 		return err
 	}
 
-	newSession.ClientId = session.ClientId
-	newSession.ClientSecret = session.ClientSecret
-	*session = newSession
+	if c.sessions != nil {
+		if err := c.sessions.SaveSession(newSession); err != nil {
+			return fmt.Errorf("saving refreshed session: %v", err)
+		}
+	}
+
+	*session = *newSession
 	return nil
 }
 
-func NewStravaClientFromSession(session StravaSession) (*StravaClient, error) {
-	if session.IsExpired() {
-		if err := refreshSession(&session); err != nil {
-			return nil, err
+// accessToken returns a token that's valid for at least refreshMargin,
+// refreshing the session first if necessary.  With force, the session is
+// refreshed regardless of its expiry, e.g. after the API rejected it.
+func (c *StravaClient) accessToken(ctx context.Context, force bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !force && !c.session.expiresWithin(refreshMargin) {
+		return c.session.AccessToken, nil
+	}
+
+	// Another process sharing the store may have refreshed already
+	if c.sessions != nil {
+		stored, err := c.sessions.GetSession()
+		if err != nil {
+			return "", err
+		}
+		if stored != nil && stored.AccessToken != c.session.AccessToken && !stored.expiresWithin(refreshMargin) {
+			*c.session = *stored
+			return c.session.AccessToken, nil
 		}
 	}
 
-	return &StravaClient{
-		session: &session,
-		limiter: rate.NewLimiter(100.0/(60*15), 10),
-	}, nil
+	log.Printf("refreshing Strava session (expires %s)", time.Unix(c.session.ExpiresAt, 0).Local().Format(time.RFC1123))
+	if err := c.refreshSession(ctx, c.session); err != nil {
+		return "", err
+	}
+	return c.session.AccessToken, nil
+}
+
+func (c *StravaClient) apiGetSessionFromAuthorizationCode(ctx context.Context, clientId, clientSecret, authorizationCode string) (*StravaSession, error) {
+	return c.apiPostToken(ctx, map[string]string{
+		"client_id":     clientId,
+		"client_secret": clientSecret,
+		"grant_type":    "authorization_code",
+		"code":          authorizationCode,
+	})
+}
+
+func NewStravaClientFromSession(session StravaSession, opts ...StravaClientOption) (*StravaClient, error) {
+	c := newStravaClient(opts)
+	c.session = &session
+	if _, err := c.accessToken(context.Background(), false); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// scopes are the permissions login asks for: reading private activities,
+// and writing them for uploads
+var scopes = []string{"read_all", "activity:read_all", "activity:write"}
+
+// authorizeURL is the page where the athlete grants us access.  Strava
+// redirects to redirectURI with a `code` parameter once they do.
+func (c *StravaClient) authorizeURL(clientId, redirectURI string) (string, error) {
+	authorizeURL, err := url.Parse(c.baseURL + "/oauth/authorize")
+	if err != nil {
+		return "", err
+	}
+	q := authorizeURL.Query()
+	q.Add("client_id", clientId)
+	q.Add("response_type", "code")
+	q.Add("redirect_uri", redirectURI)
+	q.Add("scope", strings.Join(scopes, ","))
+	q.Add("approval_prompt", "force")
+	authorizeURL.RawQuery = q.Encode()
+	return authorizeURL.String(), nil
+}
+
+// NewStravaClientFromManualLogin is the login flow for machines without a
+// browser.  It prints the authorize URL to out and reads back either the URL
+// Strava redirected to after approval or just its `code` parameter.  The
+// redirect goes to localhost, so the page fails to load; that's expected and
+// the URL can be copied from the browser's address bar.
+func NewStravaClientFromManualLogin(clientId, clientSecret string, store DataStore, in io.Reader, out io.Writer, opts ...StravaClientOption) (*StravaClient, error) {
+	c := newStravaClient(opts)
+
+	authorizeURL, err := c.authorizeURL(clientId, "http://localhost/exchange_token")
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(out, "Open this URL in a browser and approve access:\n\n  %s\n\n", authorizeURL)
+	fmt.Fprintf(out, "Then paste the URL you were redirected to (or its code parameter): ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return nil, err
+	}
+
+	code, err := authorizationCode(line)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := c.apiGetSessionFromAuthorizationCode(context.Background(), clientId, clientSecret, code)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.SaveSession(session); err != nil {
+		return nil, err
+	}
+	return NewStravaClientFromSession(*session, append(opts, WithSessionStore(store))...)
 }
 
-func NewStravaClientFromBrowserBasedLogin(clientId, clientSecret string, store DataStore) (*StravaClient, error) {
+// authorizationCode extracts the code from a pasted redirect URL, or returns
+// the input itself if it's a bare code
+func authorizationCode(input string) (string, error) {
+	input = strings.TrimSpace(input)
+	if !strings.Contains(input, "://") && !strings.Contains(input, "?") {
+		if input == "" {
+			return "", fmt.Errorf("no authorization code given")
+		}
+		return input, nil
+	}
+
+	u, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	if e := u.Query().Get("error"); e != "" {
+		return "", fmt.Errorf("authorization failed: %s", e)
+	}
+	code := u.Query().Get("code")
+	if code == "" {
+		return "", fmt.Errorf("no code parameter in %s", input)
+	}
+	return code, nil
+}
+
+func NewStravaClientFromBrowserBasedLogin(clientId, clientSecret string, store DataStore, opts ...StravaClientOption) (*StravaClient, error) {
+	c := newStravaClient(opts)
 	port := 9753
 	done := make(chan bool, 1)
 	quit := make(chan os.Signal, 1)
@@ -257,7 +556,7 @@ func NewStravaClientFromBrowserBasedLogin(clientId, clientSecret string, store D
 
 	router := http.NewServeMux()
 	router.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-		session, err := apiGetSessionFromAuthorizationCode(clientId, clientSecret, r.URL.Query()["code"][0])
+		session, err := c.apiGetSessionFromAuthorizationCode(r.Context(), clientId, clientSecret, r.URL.Query()["code"][0])
 		if err != nil {
 			panic(err)
 		}
@@ -297,22 +596,14 @@ func NewStravaClientFromBrowserBasedLogin(clientId, clientSecret string, store D
 	}(server)
 
 	// Open this URL to start the process of authentication
-	authorizeURL, err := url.Parse("https://strava.com/oauth/authorize")
+	authorizeURL, err := c.authorizeURL(clientId, fmt.Sprintf("http://localhost:%d/callback", port))
 	if err != nil {
 		return nil, err
 	}
-	q := authorizeURL.Query()
-	q.Add("client_id", clientId)
-	q.Add("response_type", "code")
-	q.Add("redirect_uri", fmt.Sprintf("http://localhost:%d/callback", port))
-	q.Add("scope", "read_all")
-	q.Add("scope", "activity:read_all")
-	q.Add("approval_prompt", "force")
-	authorizeURL.RawQuery = q.Encode()
 
 	// Open web browser to authorize
 	fmt.Printf("Opening web browser to initiate authentication...\n")
-	open(authorizeURL.String())
+	open(authorizeURL)
 
 	// Wait for exchange to finish
 	<-done
@@ -324,26 +615,94 @@ func NewStravaClientFromBrowserBasedLogin(clientId, clientSecret string, store D
 	if session == nil {
 		return nil, fmt.Errorf("unexpected error: no session found")
 	}
-	return NewStravaClientFromSession(*session)
+	return NewStravaClientFromSession(*session, append(opts, WithSessionStore(store))...)
+}
+
+const maxRetries = 5
+
+// StatusError is returned when the API responds with an unexpected status
+type StatusError struct {
+	StatusCode int
+	Expected   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status: %d (expected %d)", e.StatusCode, e.Expected)
+}
+
+func isNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
+// httpReq performs an API request within the rate limit.  The session is
+// refreshed before it expires, and once more if the API rejects the token
+// with 401 Unauthorized.  Requests that fail with 429 Too Many Requests are
+// retried with exponential backoff, as are those that fail with a 5xx error
+// unless they're POSTs, which may have been carried out anyway (e.g. an
+// upload).  The rate limiter holds off further requests until the window
+// resets if the budget is exhausted.
+func (c *StravaClient) httpReq(ctx context.Context, method string, url string, headers map[string]string, body []byte, expectedStatus int) (*http.Response, error) {
+	_, explicitAuthorization := headers["Authorization"]
+
+	backoff := time.Second
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		if !explicitAuthorization {
+			token, err := c.accessToken(ctx, false)
+			if err != nil {
+				return nil, err
+			}
+			headers["Authorization"] = "Bearer " + token
+		}
+
+		if err := c.limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		resp, err := c.doReq(ctx, method, url, headers, body)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && !explicitAuthorization && !refreshed {
+			if _, err := c.accessToken(ctx, true); err != nil {
+				return nil, err
+			}
+			refreshed = true
+			continue
+		}
+
+		retry := resp.StatusCode == http.StatusTooManyRequests || (resp.StatusCode >= 500 && method != "POST")
+		if retry && attempt < maxRetries {
+			log.Printf("%s %s ... %s; retrying in %s", method, url, resp.Status, backoff)
+			if err := sleep(ctx, backoff); err != nil {
+				return nil, err
+			}
+			backoff *= 2
+			continue
+		}
+
+		if expectedStatus != -1 && resp.StatusCode != expectedStatus {
+			return resp, &StatusError{resp.StatusCode, expectedStatus}
+		}
+
+		return resp, nil
+	}
 }
 
-func (c *StravaClient) httpReq(method string, url string, headers map[string]string, body []byte, expectedStatus int) (*http.Response, error) {
+func (c *StravaClient) doReq(ctx context.Context, method string, url string, headers map[string]string, body []byte) (*http.Response, error) {
 	start := time.Now()
-	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
 
-	if _, ok := headers["Authorization"]; !ok && c.session.AccessToken != "" {
-		headers["Authorization"] = "Bearer " + c.session.AccessToken
-	}
-
 	for k, v := range headers {
 		req.Header.Add(k, v)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -355,78 +714,64 @@ func (c *StravaClient) httpReq(method string, url string, headers map[string]str
 	resp.Body.Close()
 	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
 
-	log.Printf("%s %s ... %s (%s; %s)", req.Method, req.URL.String(), resp.Status, time.Since(start), humanize.Bytes(uint64(len(responseBody))))
+	c.limiter.update(resp.Header)
 
-	if expectedStatus != -1 && resp.StatusCode != expectedStatus {
-		return resp, fmt.Errorf("unexpected status: %d (expected %d)", resp.StatusCode, expectedStatus)
-	}
+	log.Printf("%s %s ... %s (%s; %s; %s)", req.Method, req.URL.String(), resp.Status, time.Since(start), humanize.Bytes(uint64(len(responseBody))), c.limiter.Budget())
 
 	return resp, nil
 }
 
-func apiGetSessionFromAuthorizationCode(clientId, clientSecret, authorizationCode string) (*StravaSession, error) {
-	body, err := json.Marshal(map[string]string{
-		"client_id":     clientId,
-		"client_secret": clientSecret,
-		"grant_type":    "authorization_code",
-		"code":          authorizationCode,
-	})
+// RateBudget returns the API budget as of the most recent response
+func (c *StravaClient) RateBudget() RateBudget {
+	return c.limiter.Budget()
+}
 
-	if err != nil {
-		return nil, err
+// apiGetActivities fetches a page of activities started after and before
+// the given times; a zero time leaves that end of the window open
+func (c *StravaClient) apiGetActivities(ctx context.Context, page int, after, before time.Time) ([]SummaryActivity, error) {
+	url := fmt.Sprintf("%s/api/v3/athlete/activities?page=%d&per_page=200", c.baseURL, page)
+	if !after.IsZero() {
+		url = url + fmt.Sprintf("&after=%d", after.Unix())
+	}
+	if !before.IsZero() {
+		url = url + fmt.Sprintf("&before=%d", before.Unix())
 	}
 
-	req, err := http.NewRequest(
-		http.MethodPost,
-		"https://www.strava.com/api/v3/oauth/token",
-		bytes.NewReader(body),
+	resp, err := c.httpReq(
+		ctx,
+		"GET",
+		url,
+		map[string]string{},
+		[]byte{},
+		200,
 	)
-
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("content-type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	jsonBytes, err := io.ReadAll(resp.Body)
+	var activities []SummaryActivity
+	err = json.Unmarshal(body, &activities)
 	if err != nil {
 		return nil, err
 	}
-
-	var newsession StravaSession
-	if err := json.Unmarshal(jsonBytes, &newsession); err != nil {
-		return nil, err
-	}
-
-	newsession.ClientId = clientId
-	newsession.ClientSecret = clientSecret
-
-	return &newsession, nil
+	return activities, nil
 }
 
-func (c *StravaClient) apiGetActivities(ctx context.Context, page int, mostRecent time.Time) ([]SummaryActivity, error) {
-	c.limiter.Wait(ctx)
-
-	url := fmt.Sprintf("https://www.strava.com/api/v3/athlete/activities?page=%d&per_page=200", page)
-	if !mostRecent.IsZero() {
-		url = url + fmt.Sprintf("&after=%d", mostRecent.Unix())
-	}
-
+func (c *StravaClient) apiGetActivity(ctx context.Context, activityId int64) (*DetailedActivity, error) {
+	url := fmt.Sprintf("%s/api/v3/activities/%d?include_all_efforts=false", c.baseURL, activityId)
 	resp, err := c.httpReq(
+		ctx,
 		"GET",
 		url,
 		map[string]string{},
 		[]byte{},
-		-1,
+		200,
 	)
-	log.Printf("GET %s: %d", url, resp.StatusCode)
 
 	if err != nil {
 		return nil, err
@@ -437,23 +782,22 @@ func (c *StravaClient) apiGetActivities(ctx context.Context, page int, mostRecen
 		return nil, err
 	}
 
-	var activities []SummaryActivity
-	err = json.Unmarshal(body, &activities)
+	var activity DetailedActivity
+	err = json.Unmarshal(body, &activity)
 	if err != nil {
 		return nil, err
 	}
-	return activities, nil
+	return &activity, nil
 }
 
 func (c *StravaClient) apiGetAthlete(ctx context.Context) (*StravaAthlete, error) {
-	c.limiter.Wait(ctx)
-
 	resp, err := c.httpReq(
+		ctx,
 		"GET",
-		"https://www.strava.com/api/v3/athlete",
+		c.baseURL+"/api/v3/athlete",
 		map[string]string{},
 		[]byte{},
-		-1,
+		200,
 	)
 
 	if err != nil {
@@ -474,18 +818,15 @@ func (c *StravaClient) apiGetAthlete(ctx context.Context) (*StravaAthlete, error
 }
 
 func (c *StravaClient) apiGetLaps(ctx context.Context, activityId int64) ([]ActivityLap, error) {
-	c.limiter.Wait(ctx)
-
-	url := fmt.Sprintf("https://www.strava.com/api/v3/activities/%d/laps", activityId)
+	url := fmt.Sprintf("%s/api/v3/activities/%d/laps", c.baseURL, activityId)
 	resp, err := c.httpReq(
+		ctx,
 		"GET",
 		url,
 		map[string]string{},
 		[]byte{},
-		-1,
+		200,
 	)
-	log.Printf("GET %s: %d", url, resp.StatusCode)
-
 	if err != nil {
 		return nil, err
 	}
@@ -503,37 +844,6 @@ func (c *StravaClient) apiGetLaps(ctx context.Context, activityId int64) ([]Acti
 	return laps, nil
 }
 
-func (c *StravaClient) Sync(ctx context.Context, store DataStore) error {
-	mostRecent, err := store.GetMostRecentActivityDate()
-	if err != nil {
-		return err
-	}
-
-	for i := 1; ; i++ {
-		activities, err := c.apiGetActivities(ctx, i, mostRecent)
-		if err != nil {
-			return err
-		}
-		if len(activities) == 0 {
-			break
-		}
-		for _, activity := range activities {
-			laps, err := c.apiGetLaps(ctx, activity.Id)
-			if err != nil {
-				return err
-			}
-			if err := store.SaveLaps(activity.Id, laps); err != nil {
-				return err
-			}
-		}
-		if err := store.Save(activities); err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 // open opens the specified URL in the default browser of the user.
 func open(url string) error {
 	var cmd string
@@ -569,186 +879,3 @@ func createDirectoryIfNotExists(dirName string) error {
 
 	return nil
 }
-
-type DataStore struct {
-	db *sql.DB
-}
-
-func NewPostgresDataStore(dsn string) (DataStore, error) {
-	db, err := sql.Open("postgres", dsn)
-	if err != nil {
-		return DataStore{}, err
-	}
-
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS strava_activities (
-			id bigserial primary key,
-			value jsonb
-		)`,
-
-		`CREATE TABLE IF NOT EXISTS strava_activities (
-			id bigserial primary key,
-			start_time_local timestamptz,
-			value jsonb
-		)`,
-
-		`CREATE TABLE IF NOT EXISTS strava_laps (
-			id bigserial primary key,
-			activity_id text,
-			value jsonb
-		)`,
-
-		`CREATE INDEX IF NOT EXISTS strava_activities_date ON strava_activities (start_date_local DESC)`,
-	}
-
-	for _, query := range queries {
-		_, err = db.Exec(query)
-		if err != nil {
-			return DataStore{}, err
-		}
-	}
-
-	return DataStore{db}, nil
-}
-
-type ActivityFilter struct {
-	start *time.Time
-	end   *time.Time
-}
-
-func (s *DataStore) GetMostRecentActivityDate() (time.Time, error) {
-	query := `SELECT coalesce(max((value->>'start_date_local')::timestamptz), '1970-01-01T00:00:00Z'::timestamptz) FROM strava_activities`
-	var t time.Time
-	err := s.db.QueryRow(query).Scan(&t)
-	return t, err
-}
-
-func (s *DataStore) GetSession() (*StravaSession, error) {
-	var bytes []byte
-	err := s.db.QueryRow("SELECT value FROM strava_session WHERE id=1").Scan(&bytes)
-	if err == sql.ErrNoRows {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-
-	var session StravaSession
-	if err := json.Unmarshal(bytes, &session); err != nil {
-		return nil, err
-	}
-
-	return &session, nil
-}
-
-func (s *DataStore) SaveSession(session *StravaSession) error {
-	bytes, err := json.Marshal(session)
-	if err != nil {
-		return err
-	}
-
-	query := `INSERT INTO strava_session (id, value)
-		VALUES (1, $1)
-		ON CONFLICT (id)
-		DO UPDATE SET value = EXCLUDED.value`
-	if _, err := s.db.Exec(query, bytes); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (s *DataStore) Save(activities []SummaryActivity) error {
-	query := `INSERT INTO strava_activities (id, value) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`
-	for _, activity := range activities {
-		serialized, err := json.Marshal(activity)
-		if err != nil {
-			return err
-		}
-		if _, err := s.db.Exec(query, activity.Id, serialized); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (s *DataStore) SaveLaps(activityId int64, laps []ActivityLap) error {
-	query := `INSERT INTO strava_laps (id, activity_id, value) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING`
-	for _, lap := range laps {
-		serialized, err := json.Marshal(lap)
-		if err != nil {
-			return err
-		}
-		if _, err := s.db.Exec(query, lap.Id, activityId, serialized); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (s *DataStore) activityQuery(query string) ([]SummaryActivity, error) {
-	rows, err := s.db.Query(query)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	activities := []SummaryActivity{}
-	for rows.Next() {
-		var value []byte
-		if err := rows.Scan(&value); err != nil {
-			return nil, err
-		}
-		var activity SummaryActivity
-		if err := json.Unmarshal(value, &activity); err != nil {
-			return nil, err
-		}
-		activities = append(activities, activity)
-	}
-	return activities, nil
-}
-
-func (s *DataStore) LoadPage(page, perPage int) ([]SummaryActivity, error) {
-	return s.activityQuery(
-		fmt.Sprintf(`
-			SELECT value
-			FROM strava_activities
-			ORDER BY (value->>'start_date_local')::timestamptz DESC
-			LIMIT %d
-			OFFSET %d`,
-			perPage,
-			(page-1)*perPage,
-		),
-	)
-}
-
-func (s *DataStore) Load(filters ActivityFilter) ([]SummaryActivity, error) {
-	where := []string{}
-
-	if filters.start != nil {
-		where = append(
-			where,
-			fmt.Sprintf(
-				"(value->>'start_date_local')::timestamptz >= '%s'::timestamptz",
-				filters.start.Format(time.RFC3339),
-			),
-		)
-	}
-
-	if filters.end != nil {
-		where = append(
-			where,
-			fmt.Sprintf(
-				"(value->>'start_date_local')::timestamptz < '%s'::timestamptz",
-				filters.end.Format(time.RFC3339),
-			),
-		)
-	}
-
-	query := "SELECT value FROM strava_activities"
-	if len(where) > 0 {
-		query += fmt.Sprintf(" WHERE %s", strings.Join(where, " AND "))
-	}
-	query += " ORDER BY (value->>'start_date_local')::timestamptz DESC"
-
-	return s.activityQuery(query)
-}
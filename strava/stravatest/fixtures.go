@@ -0,0 +1,157 @@
+package stravatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+// Responses recorded from the Strava API, trimmed to the fields we use
+
+const athleteJSON = `{
+  "id": 4242,
+  "username": "testrunner",
+  "resource_state": 3,
+  "firstname": "Test",
+  "lastname": "Runner",
+  "city": "Boston",
+  "state": "Massachusetts",
+  "country": "United States",
+  "sex": "F",
+  "premium": true,
+  "created_at": "2014-03-02T21:10:16Z",
+  "updated_at": "2022-11-30T02:04:11Z"
+}`
+
+const activitiesJSON = `[
+  {
+    "id": 7012345678,
+    "name": "Boston Marathon",
+    "type": "Run",
+    "workout_type": 1,
+    "start_date": "2022-04-18T14:02:14Z",
+    "start_date_local": "2022-04-18T10:02:14Z",
+    "distance": 42442.6,
+    "moving_time": 11432,
+    "elapsed_time": 11502,
+    "total_elevation_gain": 251.2,
+    "map": {"id": "a7012345678", "resource_state": 3, "summary_polyline": "ugfaGvahrLt@cBdCyEjDsHbBoEdAgEx@gFb@}Fd@sGh@mH"},
+    "description": "Hopkinton to Boylston",
+    "calories": 2876,
+    "device_name": "Garmin Forerunner 955",
+    "gear_id": "g1111111",
+    "gear": {"id": "g1111111", "name": "Vaporfly Next% 2", "primary": false, "distance": 210342.0},
+    "has_heartrate": true,
+    "average_heartrate": 164.2,
+    "max_heartrate": 181,
+    "average_speed": 3.713,
+    "max_speed": 5.2,
+    "splits_standard": [
+      {"split": 1, "distance": 1609.9, "elapsed_time": 419, "moving_time": 419, "elevation_difference": -21.4, "average_speed": 3.84, "average_heartrate": 152.1, "pace_zone": 4},
+      {"split": 2, "distance": 1608.1, "elapsed_time": 423, "moving_time": 423, "elevation_difference": -8.2, "average_speed": 3.8, "average_heartrate": 158.9, "pace_zone": 4}
+    ],
+    "best_efforts": [
+      {"id": 21000000001, "name": "1 mile", "elapsed_time": 401, "moving_time": 401, "start_date_local": "2022-04-18T12:58:20Z", "distance": 1609, "pr_rank": null, "start_index": 10120, "end_index": 10521},
+      {"id": 21000000002, "name": "Marathon", "elapsed_time": 11384, "moving_time": 11384, "start_date_local": "2022-04-18T10:02:14Z", "distance": 42195, "pr_rank": 1, "start_index": 0, "end_index": 11384}
+    ]
+  },
+  {
+    "id": 7023456789,
+    "name": "Morning Run",
+    "type": "Run",
+    "workout_type": 0,
+    "start_date": "2022-04-20T10:31:02Z",
+    "start_date_local": "2022-04-20T06:31:02Z",
+    "distance": 8046.7,
+    "moving_time": 2701,
+    "elapsed_time": 2760,
+    "total_elevation_gain": 42.1,
+    "map": {"id": "a7023456789", "resource_state": 3, "summary_polyline": "kvfaGrzirLrAnBxBdDvBxCnBhC"},
+    "device_name": "Garmin Forerunner 955",
+    "has_heartrate": true,
+    "average_heartrate": 138.4,
+    "max_heartrate": 151
+  },
+  {
+    "id": 7034567890,
+    "name": "Commute",
+    "type": "Ride",
+    "workout_type": 10,
+    "start_date": "2022-04-21T12:12:45Z",
+    "start_date_local": "2022-04-21T08:12:45Z",
+    "distance": 12874.8,
+    "moving_time": 2280,
+    "elapsed_time": 2512,
+    "total_elevation_gain": 61.0,
+    "map": {"id": "a7034567890", "resource_state": 3, "summary_polyline": ""}
+  }
+]`
+
+const lapsJSON = `{
+  "7012345678": [
+    {"id": 31000000001, "resource_state": 2, "name": "Lap 1", "elapsed_time": 5750, "moving_time": 5716, "start_date": "2022-04-18T14:02:14Z", "start_date_local": "2022-04-18T10:02:14Z", "distance": 21221.3, "start_index": 0, "end_index": 5716, "total_elevation_gain": 101.0, "average_speed": 3.71, "max_speed": 5.2, "average_cadence": 88.1, "lap_index": 1, "split": 1},
+    {"id": 31000000002, "resource_state": 2, "name": "Lap 2", "elapsed_time": 5752, "moving_time": 5716, "start_date": "2022-04-18T15:38:04Z", "start_date_local": "2022-04-18T11:38:04Z", "distance": 21221.3, "start_index": 5717, "end_index": 11432, "total_elevation_gain": 150.2, "average_speed": 3.71, "max_speed": 4.9, "average_cadence": 87.4, "lap_index": 2, "split": 2}
+  ],
+  "7023456789": [
+    {"id": 31000000003, "resource_state": 2, "name": "Lap 1", "elapsed_time": 2760, "moving_time": 2701, "start_date": "2022-04-20T10:31:02Z", "start_date_local": "2022-04-20T06:31:02Z", "distance": 8046.7, "start_index": 0, "end_index": 2701, "total_elevation_gain": 42.1, "average_speed": 2.98, "max_speed": 3.6, "average_cadence": 84.0, "lap_index": 1, "split": 1}
+  ]
+}`
+
+func mustUnmarshal(data string, v interface{}) {
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		panic(fmt.Sprintf("stravatest: bad fixture: %v", err))
+	}
+}
+
+func fixtureAthlete() strava.StravaAthlete {
+	var athlete strava.StravaAthlete
+	mustUnmarshal(athleteJSON, &athlete)
+	return athlete
+}
+
+func fixtureActivities() []strava.DetailedActivity {
+	var activities []strava.DetailedActivity
+	mustUnmarshal(activitiesJSON, &activities)
+	return activities
+}
+
+func fixtureLaps(activity strava.DetailedActivity) []strava.ActivityLap {
+	var laps map[string][]strava.ActivityLap
+	mustUnmarshal(lapsJSON, &laps)
+	return laps[fmt.Sprint(activity.Id)]
+}
+
+// GenerateActivities returns n daily runs starting on the given day, each
+// with a single lap, for exercising paging
+func GenerateActivities(n int, start time.Time) ([]strava.DetailedActivity, [][]strava.ActivityLap) {
+	var activities []strava.DetailedActivity
+	var laps [][]strava.ActivityLap
+	for i := 0; i < n; i++ {
+		date := start.AddDate(0, 0, i)
+		activity := strava.DetailedActivity{
+			SummaryActivity: strava.SummaryActivity{
+				Id:         8000000000 + int64(i),
+				Name:       fmt.Sprintf("Run %d", i+1),
+				Type:       "Run",
+				DateString: date.Format("2006-01-02T15:04:05Z"),
+				StartDate:  date.Format("2006-01-02T15:04:05Z"),
+				Distance:   5000 + float64(i%10)*1000,
+				MovingTime: 1500 + float64(i%10)*300,
+			},
+			ElapsedTime: 1560 + float64(i%10)*300,
+		}
+		activities = append(activities, activity)
+		laps = append(laps, []strava.ActivityLap{{
+			Id:             9000000000 + int64(i),
+			Name:           "Lap 1",
+			StartDateLocal: date,
+			Distance:       activity.Distance,
+			MovingTime:     int32(activity.MovingTime),
+			LapIndex:       1,
+			Split:          1,
+		}})
+	}
+	return activities, laps
+}
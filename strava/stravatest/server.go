@@ -0,0 +1,540 @@
+// Package stravatest provides an in-process fake of the Strava API for
+// exercising StravaClient without network access or API quota
+package stravatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+const (
+	ClientId     = "12345"
+	ClientSecret = "fake-client-secret"
+)
+
+// Server is a fake Strava API.  Its exported fields may be set to shape the
+// responses before the first request; once a client is running use the
+// methods, which are safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	Athlete    strava.StravaAthlete
+	Activities []strava.DetailedActivity
+	Laps       map[int64][]strava.ActivityLap
+	Streams    map[int64]strava.Streams
+
+	// The tokens the server accepts.  A successful refresh rotates both.
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+
+	// Limits reported in the X-RateLimit-Limit header.  Usage is counted
+	// from every API request the server answers.
+	ShortLimit int
+	DailyLimit int
+	shortUsage int
+	dailyUsage int
+
+	failures []failure
+	requests []string
+	uploads  []*upload
+}
+
+// UploadedFile is a file received by POST /uploads
+type UploadedFile struct {
+	Name     string
+	DataType string
+	Data     []byte
+	Metadata strava.UploadMetadata
+}
+
+type upload struct {
+	strava.Upload
+	file UploadedFile
+}
+
+type failure struct {
+	prefix string
+	status int
+}
+
+// NewServer starts a fake Strava API loaded with the default fixtures.  The
+// caller must Close it.
+func NewServer() *Server {
+	s := &Server{
+		Athlete:      fixtureAthlete(),
+		Laps:         map[int64][]strava.ActivityLap{},
+		Streams:      map[int64]strava.Streams{},
+		AccessToken:  "fake-access-token-1",
+		RefreshToken: "fake-refresh-token-1",
+		ExpiresIn:    21600,
+		ShortLimit:   100000,
+		DailyLimit:   1000000,
+	}
+	for _, activity := range fixtureActivities() {
+		s.AddActivity(activity, fixtureLaps(activity))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v3/oauth/token", s.handleToken)
+	mux.HandleFunc("/api/v3/athlete", s.api(s.handleAthlete))
+	mux.HandleFunc("/api/v3/athlete/activities", s.api(s.handleActivities))
+	mux.HandleFunc("/api/v3/activities/", s.api(s.handleActivity))
+	mux.HandleFunc("/api/v3/uploads", s.api(s.handlePostUpload))
+	mux.HandleFunc("/api/v3/uploads/", s.api(s.handleGetUpload))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Client returns a StravaClient talking to this server with a valid session
+func (s *Server) Client(opts ...strava.StravaClientOption) (*strava.StravaClient, error) {
+	return strava.NewStravaClientFromSession(s.Session(), append([]strava.StravaClientOption{s.Option()}, opts...)...)
+}
+
+// Option points a StravaClient at this server
+func (s *Server) Option() strava.StravaClientOption {
+	return strava.WithBaseURL(s.URL)
+}
+
+// Session returns a session holding the server's current tokens
+func (s *Server) Session() strava.StravaSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return strava.StravaSession{
+		ClientId:     ClientId,
+		ClientSecret: ClientSecret,
+		AccessToken:  s.AccessToken,
+		RefreshToken: s.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(s.ExpiresIn) * time.Second).Unix(),
+		ExpiresIn:    s.ExpiresIn,
+		TokenType:    "Bearer",
+	}
+}
+
+// AddActivity adds (or replaces) an activity and its laps
+func (s *Server) AddActivity(activity strava.DetailedActivity, laps []strava.ActivityLap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeActivity(activity.Id)
+	s.Activities = append(s.Activities, activity)
+	s.Laps[activity.Id] = laps
+}
+
+// RemoveActivity deletes an activity, as if the athlete deleted it on Strava
+func (s *Server) RemoveActivity(id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeActivity(id)
+}
+
+func (s *Server) removeActivity(id int64) {
+	for i, activity := range s.Activities {
+		if activity.Id == id {
+			s.Activities = append(s.Activities[:i], s.Activities[i+1:]...)
+			break
+		}
+	}
+	delete(s.Laps, id)
+	delete(s.Streams, id)
+}
+
+// Uploads returns the files uploaded so far
+func (s *Server) Uploads() []UploadedFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []UploadedFile
+	for _, u := range s.uploads {
+		files = append(files, u.file)
+	}
+	return files
+}
+
+// Fail makes the next API request whose path and query start with prefix
+// fail with the given status.  Call it repeatedly to fail several requests.
+func (s *Server) Fail(prefix string, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, failure{prefix, status})
+}
+
+// RevokeAccessToken invalidates the current access token, so the next API
+// request fails with 401 until the client refreshes its session
+func (s *Server) RevokeAccessToken() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.AccessToken = rotateToken(s.AccessToken)
+}
+
+// ExhaustShortWindow reports the 15 minute budget as fully used
+func (s *Server) ExhaustShortWindow() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shortUsage = s.ShortLimit
+}
+
+// Requests returns the path and query of every request received so far
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) writeError(w http.ResponseWriter, status int, message string) {
+	s.writeJSON(w, status, map[string]interface{}{
+		"message": message,
+		"errors":  []interface{}{},
+	})
+}
+
+// api wraps an API handler with request logging, injected failures, bearer
+// token authentication and rate limit accounting
+func (s *Server) api(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.URL.RequestURI())
+		s.shortUsage++
+		s.dailyUsage++
+		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d,%d", s.ShortLimit, s.DailyLimit))
+		w.Header().Set("X-RateLimit-Usage", fmt.Sprintf("%d,%d", s.shortUsage, s.dailyUsage))
+
+		status := 0
+		for i, f := range s.failures {
+			if strings.HasPrefix(r.URL.RequestURI(), f.prefix) {
+				status = f.status
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+				break
+			}
+		}
+		if status == 0 && s.shortUsage > s.ShortLimit {
+			status = http.StatusTooManyRequests
+		}
+		authorized := r.Header.Get("Authorization") == "Bearer "+s.AccessToken
+		s.mu.Unlock()
+
+		switch {
+		case status == http.StatusTooManyRequests:
+			s.writeError(w, status, "Rate Limit Exceeded")
+		case status != 0:
+			s.writeError(w, status, http.StatusText(status))
+		case !authorized:
+			s.writeError(w, http.StatusUnauthorized, "Authorization Error")
+		default:
+			handler(w, r)
+		}
+	}
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	var params map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.URL.RequestURI())
+
+	if params["client_id"] != ClientId || params["client_secret"] != ClientSecret {
+		s.writeError(w, http.StatusUnauthorized, "Authorization Error")
+		return
+	}
+
+	switch params["grant_type"] {
+	case "refresh_token":
+		if params["refresh_token"] != s.RefreshToken {
+			s.writeError(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+	case "authorization_code":
+		if params["code"] == "" {
+			s.writeError(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+	default:
+		s.writeError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	s.AccessToken = rotateToken(s.AccessToken)
+	s.RefreshToken = rotateToken(s.RefreshToken)
+	s.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token_type":    "Bearer",
+		"access_token":  s.AccessToken,
+		"refresh_token": s.RefreshToken,
+		"expires_at":    time.Now().Add(time.Duration(s.ExpiresIn) * time.Second).Unix(),
+		"expires_in":    s.ExpiresIn,
+	})
+}
+
+// rotateToken turns fake-access-token-1 into fake-access-token-2
+func rotateToken(token string) string {
+	i := strings.LastIndex(token, "-")
+	n, _ := strconv.Atoi(token[i+1:])
+	return fmt.Sprintf("%s-%d", token[:i], n+1)
+}
+
+func (s *Server) handleAthlete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeJSON(w, http.StatusOK, s.Athlete)
+}
+
+// handleActivities mimics /athlete/activities: newest first, or oldest first
+// when an `after` cursor is given, paged with page/per_page.  Like Strava,
+// `after` and `before` are compared with the UTC start time.
+func (s *Server) handleActivities(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	page, perPage := 1, 30
+	if v, err := strconv.Atoi(q.Get("page")); err == nil {
+		page = v
+	}
+	if v, err := strconv.Atoi(q.Get("per_page")); err == nil {
+		perPage = v
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var activities []strava.SummaryActivity
+	for _, activity := range s.Activities {
+		if after := q.Get("after"); after != "" {
+			unix, _ := strconv.ParseInt(after, 10, 64)
+			if !activity.StartTime().After(time.Unix(unix, 0)) {
+				continue
+			}
+		}
+		if before := q.Get("before"); before != "" {
+			unix, _ := strconv.ParseInt(before, 10, 64)
+			if !activity.StartTime().Before(time.Unix(unix, 0)) {
+				continue
+			}
+		}
+		summary := activity.SummaryActivity
+		summary.Laps = nil
+		activities = append(activities, summary)
+	}
+
+	sort.SliceStable(activities, func(i, j int) bool {
+		if q.Get("after") != "" {
+			return activities[i].StartTime().Before(activities[j].StartTime())
+		}
+		return activities[i].StartTime().After(activities[j].StartTime())
+	})
+
+	start := (page - 1) * perPage
+	if start > len(activities) {
+		start = len(activities)
+	}
+	end := start + perPage
+	if end > len(activities) {
+		end = len(activities)
+	}
+	s.writeJSON(w, http.StatusOK, append([]strava.SummaryActivity{}, activities[start:end]...))
+}
+
+// handleActivity serves /activities/{id} (GET and PUT),
+// /activities/{id}/laps and /activities/{id}/streams
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v3/activities/"), "/")
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		s.writeError(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var activity *strava.DetailedActivity
+	for i := range s.Activities {
+		if s.Activities[i].Id == id {
+			activity = &s.Activities[i]
+		}
+	}
+	if activity == nil {
+		s.writeError(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		s.writeJSON(w, http.StatusOK, activity)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		var edit strava.ActivityEdit
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+			s.writeError(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+		updateActivity(activity, edit)
+		s.writeJSON(w, http.StatusOK, activity)
+	case len(parts) == 2 && parts[1] == "laps":
+		s.writeJSON(w, http.StatusOK, append([]strava.ActivityLap{}, s.Laps[id]...))
+	case len(parts) == 2 && parts[1] == "streams":
+		streams, ok := s.Streams[id]
+		if !ok {
+			s.writeError(w, http.StatusNotFound, "Record Not Found")
+			return
+		}
+		s.writeJSON(w, http.StatusOK, streamsByType(streams))
+	default:
+		s.writeError(w, http.StatusNotFound, "Record Not Found")
+	}
+}
+
+// updateActivity applies the fields of PUT /activities/{id} to an activity
+func updateActivity(activity *strava.DetailedActivity, edit strava.ActivityEdit) {
+	if edit.Name != nil {
+		activity.Name = *edit.Name
+	}
+	if edit.WorkoutType != nil {
+		activity.WorkoutType = *edit.WorkoutType
+	}
+	if edit.Description != nil {
+		activity.Description = *edit.Description
+	}
+	if edit.GearId != nil {
+		activity.GearId, activity.Gear = "", nil
+		if *edit.GearId != "none" {
+			activity.GearId = *edit.GearId
+			activity.Gear = &strava.SummaryGear{Id: *edit.GearId}
+		}
+	}
+}
+
+// streamsByType renders streams the way Strava does with key_by_type=true
+func streamsByType(streams strava.Streams) map[string]interface{} {
+	byType := map[string]interface{}{}
+	add := func(key string, data interface{}, n int) {
+		if n > 0 {
+			byType[key] = map[string]interface{}{
+				"data":          data,
+				"series_type":   "distance",
+				"original_size": n,
+				"resolution":    "high",
+			}
+		}
+	}
+	add("time", streams.Time, len(streams.Time))
+	add("latlng", streams.LatLng, len(streams.LatLng))
+	add("distance", streams.Distance, len(streams.Distance))
+	add("altitude", streams.Altitude, len(streams.Altitude))
+	add("heartrate", streams.Heartrate, len(streams.Heartrate))
+	add("cadence", streams.Cadence, len(streams.Cadence))
+	add("velocity_smooth", streams.Velocity, len(streams.Velocity))
+	return byType
+}
+
+// Upload statuses, as Strava words them
+const (
+	uploadProcessing = "Your activity is still being processed."
+	uploadReady      = "Your activity is ready."
+	uploadFailed     = "There was an error processing your activity."
+)
+
+// handlePostUpload accepts a file for processing.  Like Strava, it never
+// finishes processing within the POST; the activity is created when the
+// upload is first polled.
+func (s *Server) handlePostUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil || r.FormValue("data_type") == "" {
+		s.writeError(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := &upload{
+		Upload: strava.Upload{Id: int64(len(s.uploads) + 1), Status: uploadProcessing},
+		file: UploadedFile{
+			Name:     header.Filename,
+			DataType: r.FormValue("data_type"),
+			Data:     data,
+			Metadata: strava.UploadMetadata{
+				Name:        r.FormValue("name"),
+				Description: r.FormValue("description"),
+				Type:        r.FormValue("sport_type"),
+			},
+		},
+	}
+	s.uploads = append(s.uploads, u)
+	s.writeJSON(w, http.StatusCreated, u.Upload)
+}
+
+// handleGetUpload reports an upload's status, processing it first if
+// needed.  A file identical to an earlier upload is a duplicate.
+func (s *Server) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/v3/uploads/"), 10, 64)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil || id < 1 || id > int64(len(s.uploads)) {
+		s.writeError(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+
+	u := s.uploads[id-1]
+	if u.Status == uploadProcessing {
+		s.process(u)
+	}
+	s.writeJSON(w, http.StatusOK, u.Upload)
+}
+
+func (s *Server) process(u *upload) {
+	for _, earlier := range s.uploads {
+		if earlier != u && earlier.ActivityId != 0 && bytes.Equal(earlier.file.Data, u.file.Data) {
+			u.Status = uploadFailed
+			u.Error = fmt.Sprintf("%s duplicate of activity %d", u.file.Name, earlier.ActivityId)
+			return
+		}
+	}
+
+	activity := strava.DetailedActivity{
+		SummaryActivity: strava.SummaryActivity{
+			Id:         9100000000 + u.Id,
+			Name:       u.file.Metadata.Name,
+			Type:       u.file.Metadata.Type,
+			DateString: "2022-05-07T07:00:00Z",
+		},
+		Description: u.file.Metadata.Description,
+	}
+	if activity.Name == "" {
+		activity.Name = "Uploaded Activity"
+	}
+	if activity.Type == "" {
+		activity.Type = "Run"
+	}
+	s.removeActivity(activity.Id)
+	s.Activities = append(s.Activities, activity)
+	s.Laps[activity.Id] = nil
+	u.Status = uploadReady
+	u.ActivityId = activity.Id
+}
@@ -0,0 +1,139 @@
+package strava
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// Streams holds the point-level data of an activity.  Every non-empty
+// slice has one entry per recorded point.
+type Streams struct {
+	Time      []int32      `json:"time,omitempty"` // seconds since the start of the activity
+	LatLng    [][2]float64 `json:"latlng,omitempty"`
+	Distance  []float64    `json:"distance,omitempty"` // meters
+	Altitude  []float64    `json:"altitude,omitempty"` // meters
+	Heartrate []int32      `json:"heartrate,omitempty"`
+	Cadence   []int32      `json:"cadence,omitempty"`
+	Velocity  []float64    `json:"velocity_smooth,omitempty"` // meters per second
+}
+
+const streamKeys = "time,latlng,distance,altitude,heartrate,cadence,velocity_smooth"
+
+func (s *Streams) Len() int {
+	return len(s.Time)
+}
+
+// compress encodes the streams as gzipped JSON for storage
+func (s *Streams) compress() ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressStreams(value []byte) (*Streams, error) {
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var streams Streams
+	if err := json.NewDecoder(r).Decode(&streams); err != nil {
+		return nil, err
+	}
+	return &streams, nil
+}
+
+// apiGetStreams fetches the streams of an activity.  Activities without
+// streams (e.g. manually entered ones) return empty Streams.
+func (c *StravaClient) apiGetStreams(ctx context.Context, activityId int64) (*Streams, error) {
+	url := fmt.Sprintf("%s/api/v3/activities/%d/streams?keys=%s&key_by_type=true", c.baseURL, activityId, streamKeys)
+	resp, err := c.httpReq(
+		ctx,
+		"GET",
+		url,
+		map[string]string{},
+		[]byte{},
+		-1,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &Streams{}, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{resp.StatusCode, http.StatusOK}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var byType map[string]struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &byType); err != nil {
+		return nil, err
+	}
+
+	var streams Streams
+	for key, into := range map[string]interface{}{
+		"time":            &streams.Time,
+		"latlng":          &streams.LatLng,
+		"distance":        &streams.Distance,
+		"altitude":        &streams.Altitude,
+		"heartrate":       &streams.Heartrate,
+		"cadence":         &streams.Cadence,
+		"velocity_smooth": &streams.Velocity,
+	} {
+		if stream, ok := byType[key]; ok {
+			if err := json.Unmarshal(stream.Data, into); err != nil {
+				return nil, fmt.Errorf("stream %s: %v", key, err)
+			}
+		}
+	}
+	return &streams, nil
+}
+
+func (c *StravaClient) syncStreams(ctx context.Context, store DataStore, activityId int64) error {
+	streams, err := c.apiGetStreams(ctx, activityId)
+	if err != nil {
+		return err
+	}
+	return store.SaveStreams(activityId, streams)
+}
+
+// BackfillStreams fetches streams for up to max activities matching the
+// filter that don't have any stored yet, returning how many were fetched.
+// Requests go through the client's rate limiter, so a large backfill is
+// best done over several runs with a max that fits the rate budget.
+func (c *StravaClient) BackfillStreams(ctx context.Context, store DataStore, filter ActivityFilter, max int) (int, error) {
+	filter.Limit = max
+	activities, err := store.LoadMissingStreams(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, activity := range activities {
+		log.Printf("fetching streams %d/%d: %s (%s)", i+1, len(activities), activity.Name, activity.DateString)
+		if err := c.syncStreams(ctx, store, activity.Id); err != nil {
+			return i, err
+		}
+	}
+	return len(activities), nil
+}
@@ -0,0 +1,269 @@
+package strava
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+type SyncOptions struct {
+	Streams bool // also fetch the streams of each new activity
+
+	// Reconcile re-walks the activities started in [ReconcileAfter,
+	// ReconcileBefore) after syncing, picking up edits and marking stored
+	// activities that no longer exist upstream as deleted.  A zero
+	// ReconcileBefore means now.
+	Reconcile       bool
+	ReconcileAfter  time.Time
+	ReconcileBefore time.Time
+}
+
+// SyncState is the checkpoint of a Sync run, persisted after every page so
+// an interrupted run resumes where it stopped instead of starting over
+type SyncState struct {
+	InProgress  bool       `json:"in_progress"`
+	After       time.Time  `json:"after"`     // the run's cursor, in UTC: only activities started after this are fetched
+	LastPage    int        `json:"last_page"` // last page of activities that was completely saved
+	StartedAt   time.Time  `json:"started_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt time.Time  `json:"completed_at"`
+	LastError   string     `json:"last_error"`
+	LastErrorAt time.Time  `json:"last_error_at"`
+	RateBudget  RateBudget `json:"rate_budget"` // as of the last checkpoint
+}
+
+// SyncStatus is the persisted SyncState plus how many stored activities are
+// still missing laps, details or streams
+type SyncStatus struct {
+	SyncState
+	MissingLaps    int
+	MissingDetails int
+	MissingStreams int
+}
+
+func GetSyncStatus(store DataStore) (*SyncStatus, error) {
+	state, err := store.GetSyncState()
+	if err != nil {
+		return nil, err
+	}
+	status := SyncStatus{SyncState: *state}
+
+	for _, missing := range []struct {
+		load  func(ActivityFilter) ([]SummaryActivity, error)
+		count *int
+	}{
+		{store.LoadMissingLaps, &status.MissingLaps},
+		{store.LoadMissingDetails, &status.MissingDetails},
+		{store.LoadMissingStreams, &status.MissingStreams},
+	} {
+		activities, err := missing.load(ActivityFilter{})
+		if err != nil {
+			return nil, err
+		}
+		*missing.count = len(activities)
+	}
+	return &status, nil
+}
+
+// Sync fetches every activity newer than the most recent stored one.  Each
+// page of activities is saved before their laps and details are fetched, so
+// a failure never leaves laps without a parent activity.  Progress and the
+// last error are checkpointed in the store, and the next call resumes an
+// unfinished run from the page after the last one saved.
+func (c *StravaClient) Sync(ctx context.Context, store DataStore, opts SyncOptions) error {
+	state, err := store.GetSyncState()
+	if err != nil {
+		return err
+	}
+
+	c.limiter.restore(state.RateBudget)
+
+	if state.InProgress {
+		log.Printf("resuming sync started %s from page %d", state.StartedAt.Local().Format(time.RFC1123), state.LastPage+1)
+	} else {
+		mostRecent, err := store.GetMostRecentActivityDate()
+		if err != nil {
+			return err
+		}
+		*state = SyncState{
+			InProgress: true,
+			After:      mostRecent,
+			StartedAt:  time.Now().UTC(),
+		}
+	}
+
+	err = c.sync(ctx, store, opts, state)
+	if err == nil && opts.Reconcile {
+		var updated, deleted int
+		updated, deleted, err = c.Reconcile(ctx, store, opts.ReconcileAfter, opts.ReconcileBefore)
+		log.Printf("reconciled activities since %s: %d updated, %d deleted", opts.ReconcileAfter.Format("2006-01-02"), updated, deleted)
+	}
+	state.RateBudget = c.RateBudget()
+	if err != nil {
+		state.LastError = err.Error()
+		state.LastErrorAt = time.Now().UTC()
+		if saveErr := store.SaveSyncState(state); saveErr != nil {
+			log.Printf("error saving sync state: %v", saveErr)
+		}
+		return err
+	}
+
+	state.InProgress = false
+	state.CompletedAt = time.Now().UTC()
+	state.LastError = ""
+	return store.SaveSyncState(state)
+}
+
+func (c *StravaClient) sync(ctx context.Context, store DataStore, opts SyncOptions, state *SyncState) error {
+	for page := state.LastPage + 1; ; page++ {
+		activities, err := c.apiGetActivities(ctx, page, state.After, time.Time{})
+		if err != nil {
+			return err
+		}
+		if len(activities) == 0 {
+			break
+		}
+		if err := store.Save(activities); err != nil {
+			return err
+		}
+		state.LastPage = page
+		state.UpdatedAt = time.Now().UTC()
+		state.RateBudget = c.RateBudget()
+		if err := store.SaveSyncState(state); err != nil {
+			return err
+		}
+	}
+
+	// Fill in the children of every activity in this run's window that
+	// doesn't have them yet, including ones left over by an earlier failure.
+	// The cursor is UTC and stored activities are filtered by their local
+	// start, so the window starts a day early to cover every zone.
+	window := ActivityFilter{Sort: OldestFirst}
+	if !state.After.IsZero() {
+		window.After = state.After.AddDate(0, 0, -1)
+	}
+
+	missingLaps, err := store.LoadMissingLaps(window)
+	if err != nil {
+		return err
+	}
+	for _, activity := range missingLaps {
+		laps, err := c.apiGetLaps(ctx, activity.Id)
+		if err != nil {
+			return err
+		}
+		if err := store.SaveLaps(activity.Id, laps); err != nil {
+			return err
+		}
+	}
+
+	missingDetails, err := store.LoadMissingDetails(window)
+	if err != nil {
+		return err
+	}
+	for _, activity := range missingDetails {
+		detailed, err := c.apiGetActivity(ctx, activity.Id)
+		if err != nil {
+			return err
+		}
+		if err := store.SaveDetails(*detailed); err != nil {
+			return err
+		}
+	}
+
+	if opts.Streams {
+		missingStreams, err := store.LoadMissingStreams(window)
+		if err != nil {
+			return err
+		}
+		for _, activity := range missingStreams {
+			if err := c.syncStreams(ctx, store, activity.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SyncActivity fetches a single activity with its laps and details and
+// updates the stored copy.  An activity that no longer exists upstream, or
+// that we can no longer see, is marked deleted.
+func (c *StravaClient) SyncActivity(ctx context.Context, store DataStore, activityId int64) error {
+	detailed, err := c.apiGetActivity(ctx, activityId)
+	if isNotFound(err) {
+		log.Printf("activity %d not found upstream; marking it deleted", activityId)
+		return store.MarkDeleted(activityId)
+	} else if err != nil {
+		return err
+	}
+
+	laps, err := c.apiGetLaps(ctx, activityId)
+	if err != nil {
+		return err
+	}
+
+	summary := detailed.SummaryActivity
+	summary.Laps = nil
+	if err := store.Save([]SummaryActivity{summary}); err != nil {
+		return err
+	}
+	if err := store.SaveLaps(activityId, laps); err != nil {
+		return err
+	}
+	return store.SaveDetails(*detailed)
+}
+
+// Reconcile compares the stored activities started in [after, before) with
+// Strava's.  New and changed activities are fetched again with their laps
+// and details, and stored ones Strava no longer has are marked deleted.
+// It returns how many activities were updated and deleted.
+func (c *StravaClient) Reconcile(ctx context.Context, store DataStore, after, before time.Time) (updated, deleted int, err error) {
+	if before.IsZero() {
+		before = time.Now()
+	}
+
+	stored, err := store.Load(ActivityFilter{After: after, Before: before})
+	if err != nil {
+		return 0, 0, err
+	}
+	storedById := map[int64]SummaryActivity{}
+	for _, activity := range stored {
+		storedById[activity.Id] = activity
+	}
+
+	// Strava filters on the UTC start time and we store the local one, so
+	// ask for a day more on each side to be sure we see the whole window
+	seen := map[int64]bool{}
+	for page := 1; ; page++ {
+		activities, err := c.apiGetActivities(ctx, page, after.AddDate(0, 0, -1), before.AddDate(0, 0, 1))
+		if err != nil {
+			return updated, deleted, err
+		}
+		if len(activities) == 0 {
+			break
+		}
+		for _, activity := range activities {
+			seen[activity.Id] = true
+			if previous, ok := storedById[activity.Id]; ok && sameActivity(previous, activity) {
+				continue
+			}
+			if err := c.SyncActivity(ctx, store, activity.Id); err != nil {
+				return updated, deleted, err
+			}
+			updated++
+		}
+	}
+
+	for _, activity := range stored {
+		if seen[activity.Id] || activity.IsLocal() {
+			continue
+		}
+		log.Printf("activity %d (%s) no longer exists upstream; marking it deleted", activity.Id, activity.Name)
+		if err := store.MarkDeleted(activity.Id); err != nil {
+			return updated, deleted, err
+		}
+		deleted++
+	}
+	return updated, deleted, nil
+}
@@ -0,0 +1,429 @@
+package strava_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/strava/stravatest"
+)
+
+func newTestStore(t *testing.T) strava.DataStore {
+	t.Helper()
+	store, err := strava.NewSQLiteDataStore(filepath.Join(t.TempDir(), "running.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func countRequests(requests []string, prefix string) int {
+	n := 0
+	for _, r := range requests {
+		if strings.HasPrefix(r, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestSyncSavesActivitiesLapsAndDetails(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	activities, err := store.Load(strava.ActivityFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 3 {
+		t.Fatalf("expected 3 activities, got %d", len(activities))
+	}
+
+	details, err := store.GetDetails(7012345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details == nil || details.DeviceName != "Garmin Forerunner 955" || len(details.BestEfforts) != 2 {
+		t.Fatalf("unexpected details: %+v", details)
+	}
+
+	status, err := strava.GetSyncStatus(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.InProgress || status.CompletedAt.IsZero() || status.MissingLaps != 0 || status.MissingDetails != 0 {
+		t.Fatalf("unexpected sync status: %+v", status)
+	}
+}
+
+// TestSyncAfterImportingFiles syncs into a store with an imported activity
+// newer than every Strava activity, which mustn't move the sync cursor past
+// them
+func TestSyncAfterImportingFiles(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	local := strava.DetailedActivity{}
+	local.DateString, local.Distance, local.MovingTime, local.Type = "2022-06-01T10:00:00Z", 5000, 1500, "Run"
+	result, err := strava.ImportFiles(store, []string{writeActivityFile(t, t.TempDir(), "june.activity", local)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 1 {
+		t.Fatalf("expected the file to be imported, got %s", result)
+	}
+
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	activities, err := store.Load(strava.ActivityFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 4 {
+		t.Errorf("expected the 3 older Strava activities and the imported one, got %d", len(activities))
+	}
+}
+
+// TestSyncCursorIsUTC syncs activities in a zone ahead of UTC, where the
+// local start time of the newest one is later than the UTC start of the
+// next one
+func TestSyncCursorIsUTC(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	morning := strava.DetailedActivity{}
+	morning.Id, morning.Name, morning.Type, morning.Distance = 7200000001, "Morning Run", "Run", 8000
+	morning.DateString, morning.StartDate = "2022-07-01T18:00:00Z", "2022-07-01T08:00:00Z"
+	server.AddActivity(morning, nil)
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	evening := strava.DetailedActivity{}
+	evening.Id, evening.Name, evening.Type, evening.Distance = 7200000002, "Evening Run", "Run", 5000
+	evening.DateString, evening.StartDate = "2022-07-01T20:00:00Z", "2022-07-01T10:00:00Z"
+	server.AddActivity(evening, nil)
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if activity, err := store.GetActivity(evening.Id); err != nil || activity == nil {
+		t.Errorf("expected the second sync to fetch the evening run, got %v (%v)", activity, err)
+	}
+}
+
+func TestMostRecentActivityDateWithoutUTCStart(t *testing.T) {
+	store := newTestStore(t)
+	if err := store.Save([]strava.SummaryActivity{{Id: 1, Type: "Run", DateString: "2022-07-01T18:00:00Z"}}); err != nil {
+		t.Fatal(err)
+	}
+	date, err := store.GetMostRecentActivityDate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the local time is known, so the cursor is the earliest it could be
+	if want := time.Date(2022, 7, 1, 4, 0, 0, 0, time.UTC); !date.Equal(want) {
+		t.Errorf("expected the cursor %s, got %s", want, date)
+	}
+}
+
+func TestSyncPaging(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	activities, laps := stravatest.GenerateActivities(250, time.Date(2020, 1, 1, 7, 0, 0, 0, time.UTC))
+	for i := range activities {
+		server.AddActivity(activities[i], laps[i])
+	}
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.Load(strava.ActivityFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 253 {
+		t.Fatalf("expected 253 activities, got %d", len(stored))
+	}
+	if n := countRequests(server.Requests(), "/api/v3/athlete/activities"); n != 3 {
+		t.Fatalf("expected 3 pages to be requested (the last one empty), got %d", n)
+	}
+
+	// A second sync only asks for activities after the newest one
+	before := len(server.Requests())
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.Requests()[before:]
+	if len(requests) != 1 || !strings.Contains(requests[0], "after=") {
+		t.Fatalf("expected a single incremental request, got %v", requests)
+	}
+}
+
+func TestSyncResumesFromLastCompletedPage(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	activities, laps := stravatest.GenerateActivities(250, time.Date(2020, 1, 1, 7, 0, 0, 0, time.UTC))
+	for i := range activities {
+		server.AddActivity(activities[i], laps[i])
+	}
+	server.Fail("/api/v3/athlete/activities?page=2", http.StatusBadRequest)
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err == nil {
+		t.Fatal("expected the sync to fail")
+	}
+
+	status, err := strava.GetSyncStatus(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.InProgress || status.LastPage != 1 || status.LastError == "" {
+		t.Fatalf("unexpected sync status after failure: %+v", status)
+	}
+	// The first page was saved before any laps were fetched
+	if status.MissingLaps != 200 {
+		t.Fatalf("expected 200 activities missing laps, got %d", status.MissingLaps)
+	}
+
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := server.Requests()
+	if n := countRequests(requests, "/api/v3/athlete/activities?page=1"); n != 1 {
+		t.Fatalf("expected page 1 to be fetched once, got %d", n)
+	}
+	if n := countRequests(requests, "/api/v3/athlete/activities?page=2"); n != 2 {
+		t.Fatalf("expected page 2 to be fetched twice, got %d", n)
+	}
+
+	status, err = strava.GetSyncStatus(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.InProgress || status.LastError != "" || status.MissingLaps != 0 {
+		t.Fatalf("unexpected sync status after resuming: %+v", status)
+	}
+}
+
+func TestSyncRetriesRateLimitedRequests(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	server.Fail("/api/v3/activities/7023456789/laps", http.StatusTooManyRequests)
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(server.Requests(), "/api/v3/activities/7023456789/laps"); n != 2 {
+		t.Fatalf("expected the rate limited request to be retried once, got %d requests", n)
+	}
+
+	budget := client.RateBudget()
+	if budget.ShortUsage != len(server.Requests()) || budget.ShortLimit != server.ShortLimit {
+		t.Fatalf("rate budget %+v doesn't match the server's headers", budget)
+	}
+}
+
+func TestExpiredSessionIsRefreshed(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	session := server.Session()
+	session.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+
+	client, err := strava.NewStravaClientFromSession(session, server.Option())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Session().AccessToken == session.AccessToken {
+		t.Fatal("expected the server to issue a new access token")
+	}
+
+	store := newTestStore(t)
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRefreshWithRevokedTokenFails(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	session := server.Session()
+	session.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	session.RefreshToken = "revoked"
+
+	if _, err := strava.NewStravaClientFromSession(session, server.Option()); err == nil {
+		t.Fatal("expected refreshing with a revoked token to fail")
+	}
+}
+
+func TestRejectedTokenIsRefreshedAndPersisted(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	store := newTestStore(t)
+	client, err := server.Client(strava.WithSessionStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.RevokeAccessToken()
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.GetSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == nil || stored.AccessToken != server.Session().AccessToken {
+		t.Fatalf("expected the refreshed session to be saved, got %+v", stored)
+	}
+}
+
+func TestExpiringSessionIsRefreshedBeforeRequests(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	store := newTestStore(t)
+	session := server.Session()
+	session.ExpiresAt = time.Now().Add(time.Minute).Unix()
+
+	client, err := strava.NewStravaClientFromSession(session, server.Option(), strava.WithSessionStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Sync(context.Background(), store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRequests(server.Requests(), "/api/v3/oauth/token"); n != 1 {
+		t.Fatalf("expected exactly one refresh, got %d", n)
+	}
+	if stored, _ := store.GetSession(); stored == nil || stored.IsExpired() {
+		t.Fatalf("expected a fresh session to be saved, got %+v", stored)
+	}
+}
+
+func TestReconcileAppliesEditsAndDeletions(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	if err := client.Sync(ctx, store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the morning run a race and delete the ride
+	for _, activity := range server.Activities {
+		if activity.Id == 7023456789 {
+			activity.Name = "Parkrun"
+			activity.WorkoutType = 1
+			server.AddActivity(activity, server.Laps[activity.Id])
+			break
+		}
+	}
+	server.RemoveActivity(7034567890)
+
+	err = client.Sync(ctx, store, strava.SyncOptions{
+		Reconcile:      true,
+		ReconcileAfter: time.Date(2022, 4, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	isRace := true
+	races, err := store.Load(strava.ActivityFilter{IsRace: &isRace, Sort: strava.OldestFirst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(races) != 2 || races[1].Name != "Parkrun" {
+		t.Fatalf("expected the edited run to be a race, got %+v", races)
+	}
+
+	revisions, err := store.GetRevisions(7023456789)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 1 || revisions[0].Activity.Name != "Morning Run" {
+		t.Errorf("expected the previous version to be kept as a revision, got %+v", revisions)
+	}
+	details, err := store.GetDetails(7023456789)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details == nil || details.Name != "Parkrun" {
+		t.Errorf("expected details to be refetched, got %+v", details)
+	}
+
+	rides, err := store.Load(strava.ActivityFilter{Types: []string{"Ride"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rides) != 0 {
+		t.Errorf("expected the deleted ride to be excluded, got %+v", rides)
+	}
+	rides, err = store.Load(strava.ActivityFilter{Types: []string{"Ride"}, IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rides) != 1 {
+		t.Errorf("expected the deleted ride to be kept, got %d", len(rides))
+	}
+
+	// Unchanged activities aren't refetched or revised
+	revisions, err = store.GetRevisions(7012345678)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 0 {
+		t.Errorf("expected no revisions of an unchanged activity, got %d", len(revisions))
+	}
+	if n := countRequests(server.Requests(), "/api/v3/activities/7012345678"); n != 2 {
+		t.Errorf("expected the unchanged activity's detail and laps to be fetched once each, got %d requests", n)
+	}
+}
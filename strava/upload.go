@@ -0,0 +1,261 @@
+package strava
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upload is the status of a file uploaded to Strava.  ActivityId is set
+// once Strava has processed the file, and Error if it couldn't.
+type Upload struct {
+	Id         int64  `json:"id"`
+	ExternalId string `json:"external_id"`
+	Error      string `json:"error"`
+	Status     string `json:"status"`
+	ActivityId int64  `json:"activity_id"`
+}
+
+// UploadMetadata overrides what Strava would otherwise take from the file
+type UploadMetadata struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+const (
+	// Strava asks clients to poll an upload at most once a second; most
+	// files are processed within a few seconds
+	uploadPollInterval = time.Second
+	uploadTimeout      = 2 * time.Minute
+)
+
+// duplicateUpload matches the error of a file Strava already has, e.g.
+// "run.fit duplicate of activity 7012345678"
+var duplicateUpload = regexp.MustCompile(`duplicate of .*?activit(?:y|ies)/?\s*(\d+)`)
+
+// uploadDataType is the data_type of a file for /uploads, from its name
+func uploadDataType(name string) (string, error) {
+	lower := strings.ToLower(name)
+	gz := strings.HasSuffix(lower, ".gz")
+	ext := strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(lower, ".gz")), ".")
+	switch ext {
+	case "gpx", "tcx", "fit":
+		if gz {
+			return ext + ".gz", nil
+		}
+		return ext, nil
+	}
+	return "", &UnsupportedFileError{Name: name}
+}
+
+func (c *StravaClient) apiPostUpload(ctx context.Context, name string, data []byte, metadata UploadMetadata) (*Upload, error) {
+	dataType, err := uploadDataType(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"data_type":   dataType,
+		"name":        metadata.Name,
+		"description": metadata.Description,
+		"sport_type":  metadata.Type,
+	}
+	for k, v := range fields {
+		if v == "" {
+			continue
+		}
+		if err := form.WriteField(k, v); err != nil {
+			return nil, err
+		}
+	}
+	w, err := form.CreateFormFile("file", filepath.Base(name))
+	if err != nil {
+		return nil, err
+	}
+	w.Write(data)
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpReq(
+		ctx,
+		"POST",
+		c.baseURL+"/api/v3/uploads",
+		map[string]string{"Content-Type": form.FormDataContentType()},
+		body.Bytes(),
+		201,
+	)
+	if err != nil {
+		return nil, writeScopeHint(err)
+	}
+	return decodeUpload(resp)
+}
+
+func (c *StravaClient) apiGetUpload(ctx context.Context, uploadId int64) (*Upload, error) {
+	resp, err := c.httpReq(
+		ctx,
+		"GET",
+		fmt.Sprintf("%s/api/v3/uploads/%d", c.baseURL, uploadId),
+		map[string]string{},
+		[]byte{},
+		200,
+	)
+	if err != nil {
+		return nil, writeScopeHint(err)
+	}
+	return decodeUpload(resp)
+}
+
+func decodeUpload(resp *http.Response) (*Upload, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(body, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// writeScopeHint explains a rejected upload or edit: sessions from before
+// uploads were supported weren't granted the activity:write scope
+func writeScopeHint(err error) error {
+	statusErr, ok := err.(*StatusError)
+	if ok && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+		return fmt.Errorf("%w; run `running login` again to allow uploads and edits (activity:write)", err)
+	}
+	return err
+}
+
+// UploadFile uploads a GPX, TCX or FIT file (optionally gzipped, as named)
+// and waits for Strava to process it, returning the id of the new activity.
+// A file Strava already has isn't an error: the id of the existing activity
+// is returned instead.
+func (c *StravaClient) UploadFile(ctx context.Context, name string, data []byte, metadata UploadMetadata) (int64, error) {
+	upload, err := c.apiPostUpload(ctx, name, data, metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(uploadTimeout)
+	for upload.ActivityId == 0 && upload.Error == "" {
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("upload %d of %s still processing after %s: %s", upload.Id, name, uploadTimeout, upload.Status)
+		}
+		if err := sleep(ctx, uploadPollInterval); err != nil {
+			return 0, err
+		}
+		if upload, err = c.apiGetUpload(ctx, upload.Id); err != nil {
+			return 0, err
+		}
+	}
+
+	if upload.Error != "" {
+		if m := duplicateUpload.FindStringSubmatch(upload.Error); m != nil {
+			activityId, _ := strconv.ParseInt(m[1], 10, 64)
+			log.Printf("%s is already on Strava as activity %d", name, activityId)
+			return activityId, nil
+		}
+		return 0, fmt.Errorf("upload of %s failed: %s", name, upload.Error)
+	}
+	return upload.ActivityId, nil
+}
+
+// UploadActivity uploads a local activity, encoded as the named file, and
+// replaces it with the Strava activity it becomes.  The local activity's
+// streams are kept under the new id; everything else is synced from
+// Strava.
+func (c *StravaClient) UploadActivity(ctx context.Context, store DataStore, activityId int64, name string, data []byte) (int64, error) {
+	activity, err := store.GetActivity(activityId)
+	if err != nil {
+		return 0, err
+	}
+	if activity == nil {
+		return 0, fmt.Errorf("no activity %d", activityId)
+	}
+	if !activity.IsLocal() {
+		return 0, fmt.Errorf("activity %d is already on Strava", activityId)
+	}
+	return c.uploadLocal(ctx, store, activity, name, data)
+}
+
+// UploadActivityFile uploads a GPX, TCX or FIT file and syncs the activity
+// it becomes.  If the file is of a local activity (see findDuplicate), e.g.
+// one imported from it earlier, that activity is replaced as by
+// UploadActivity instead of being left behind as a copy.
+func (c *StravaClient) UploadActivityFile(ctx context.Context, store DataStore, name string, data []byte) (int64, error) {
+	file, err := DecodeFile(name, bytes.NewReader(data))
+	if err != nil {
+		// Strava may still read a file we can't, which just can't match
+		log.Printf("%v; not looking for a local copy", err)
+	} else if file.Activity.DateString != "" {
+		duplicate, err := findDuplicate(store, file.Activity.SummaryActivity)
+		if err != nil {
+			return 0, err
+		}
+		if duplicate != nil && duplicate.IsLocal() {
+			return c.uploadLocal(ctx, store, duplicate, name, data)
+		}
+	}
+
+	stravaId, err := c.UploadFile(ctx, name, data, UploadMetadata{})
+	if err != nil {
+		return 0, err
+	}
+	return stravaId, c.SyncActivity(ctx, store, stravaId)
+}
+
+// uploadLocal uploads the file of a local activity, with its name, type and
+// description, and links the local activity to the Strava one
+func (c *StravaClient) uploadLocal(ctx context.Context, store DataStore, activity *SummaryActivity, name string, data []byte) (int64, error) {
+	metadata := UploadMetadata{Name: activity.Name, Type: activity.Type}
+	details, err := store.GetDetails(activity.Id)
+	if err != nil {
+		return 0, err
+	}
+	if details != nil {
+		metadata.Description = details.Description
+	}
+
+	stravaId, err := c.UploadFile(ctx, name, data, metadata)
+	if err != nil {
+		return 0, err
+	}
+	return stravaId, c.linkActivity(ctx, store, activity.Id, stravaId)
+}
+
+// linkActivity replaces a local activity with the Strava activity it was
+// uploaded as
+func (c *StravaClient) linkActivity(ctx context.Context, store DataStore, localId, stravaId int64) error {
+	streams, err := store.GetStreams(localId)
+	if err != nil {
+		return err
+	}
+	if err := c.SyncActivity(ctx, store, stravaId); err != nil {
+		return err
+	}
+	if streams != nil {
+		if err := store.SaveStreams(stravaId, streams); err != nil {
+			return err
+		}
+	}
+	if err := store.DeleteActivity(localId); err != nil {
+		return err
+	}
+	log.Printf("local activity %d is now Strava activity %d", localId, stravaId)
+	return nil
+}
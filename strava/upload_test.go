@@ -0,0 +1,202 @@
+package strava_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/scottfrazer/running/gpx"
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/strava/stravatest"
+)
+
+func TestUploadActivity(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	run := strava.DetailedActivity{Description: "Treadmill at the hotel"}
+	run.Name, run.Type, run.DateString, run.Distance, run.MovingTime = "Hotel Run", "Run", "2022-05-07T11:00:00Z", 5000, 1500
+	path := writeActivityFile(t, t.TempDir(), "hotel.activity", run)
+	if _, err := strava.ImportFiles(store, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveStreams(-1, &strava.Streams{Time: []int32{0, 750, 1500}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	id, err := client.UploadActivity(ctx, store, -1, "hotel.tcx.gz", []byte("<TrainingCenterDatabase/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploads := server.Uploads()
+	if len(uploads) != 1 {
+		t.Fatalf("expected one upload, got %d", len(uploads))
+	}
+	if u := uploads[0]; u.DataType != "tcx.gz" || u.Metadata.Name != "Hotel Run" || u.Metadata.Description != "Treadmill at the hotel" {
+		t.Errorf("unexpected upload: %s %+v", u.DataType, u.Metadata)
+	}
+
+	local, err := store.GetActivity(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local != nil {
+		t.Error("expected the local activity to be replaced")
+	}
+	linked, err := store.GetActivity(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linked == nil || linked.Name != "Hotel Run" {
+		t.Fatalf("expected the Strava activity to be stored, got %+v", linked)
+	}
+	streams, err := store.GetStreams(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streams == nil || streams.Len() != 3 {
+		t.Errorf("expected the local streams to be kept, got %+v", streams)
+	}
+
+	// The same file again is a duplicate, which resolves to the same activity
+	again, err := client.UploadFile(ctx, "hotel.tcx.gz", []byte("<TrainingCenterDatabase/>"), strava.UploadMetadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != id {
+		t.Errorf("expected the duplicate to resolve to activity %d, got %d", id, again)
+	}
+
+	if _, err := client.UploadActivity(ctx, store, id, "hotel.tcx", nil); err == nil {
+		t.Error("expected an error uploading an activity that's already on Strava")
+	}
+	if _, err := client.UploadFile(ctx, "notes.txt", nil, strava.UploadMetadata{}); err == nil {
+		t.Error("expected an error for an unsupported file")
+	}
+}
+
+// TestUploadActivityFile uploads a GPX file that was imported earlier,
+// which replaces the local activity, and then one that wasn't
+func TestUploadActivityFile(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	gpx := func(name, start, end string) []byte {
+		return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk>
+    <name>` + name + `</name>
+    <type>running</type>
+    <trkseg>
+      <trkpt lat="42.3300000" lon="-71.1500000"><time>` + start + `</time></trkpt>
+      <trkpt lat="42.3390000" lon="-71.1500000"><time>` + end + `</time></trkpt>
+    </trkseg>
+  </trk>
+</gpx>
+`)
+	}
+	dir := t.TempDir()
+	imported := filepath.Join(dir, "tempo.gpx")
+	if err := os.WriteFile(imported, gpx("Tempo", "2022-05-07T11:00:00Z", "2022-05-07T11:05:00Z"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strava.ImportFiles(store, []string{imported}); err != nil {
+		t.Fatal(err)
+	}
+	if local, err := store.GetActivity(-1); err != nil || local == nil {
+		t.Fatalf("expected the file to be imported as activity -1, got %v (%v)", local, err)
+	}
+
+	ctx := context.Background()
+	data, err := os.ReadFile(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.UploadActivityFile(ctx, store, imported, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local, err := store.GetActivity(-1); err != nil || local != nil {
+		t.Errorf("expected the local copy to be replaced, got %v (%v)", local, err)
+	}
+	if linked, err := store.GetActivity(id); err != nil || linked == nil || linked.Name != "Tempo" {
+		t.Errorf("expected the Strava activity to be stored with the local name, got %+v (%v)", linked, err)
+	}
+
+	other, err := client.UploadActivityFile(ctx, store, "easy.gpx", gpx("Easy", "2022-05-08T11:00:00Z", "2022-05-08T11:05:00Z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == id {
+		t.Fatalf("expected a new activity for a different file, got %d again", id)
+	}
+	if synced, err := store.GetActivity(other); err != nil || synced == nil {
+		t.Errorf("expected the new activity to be synced, got %v (%v)", synced, err)
+	}
+	uploads := server.Uploads()
+	if len(uploads) != 2 || uploads[0].Metadata.Name != "Tempo" || uploads[1].Metadata.Name != "" {
+		t.Errorf("expected the local activity's name only on the first upload, got %+v", uploads)
+	}
+}
+
+func TestUploadWithoutWriteScope(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Fail("/api/v3/uploads", http.StatusForbidden)
+	_, err = client.UploadFile(context.Background(), "run.fit", []byte{0}, strava.UploadMetadata{})
+	var statusErr *strava.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a 403, got %v", err)
+	}
+}
+
+// TestUploadRetries retries an upload Strava turned away for the rate
+// limit, but not one that failed on the server, which may have created the
+// activity anyway
+func TestUploadRetries(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	server.Fail("/api/v3/uploads", http.StatusTooManyRequests)
+	if _, err := client.UploadFile(ctx, "run.fit", []byte{1}, strava.UploadMetadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Uploads()); n != 1 {
+		t.Errorf("expected the rate limited upload to be retried, got %d uploads", n)
+	}
+
+	server.Fail("/api/v3/uploads", http.StatusBadGateway)
+	_, err = client.UploadFile(ctx, "run.fit", []byte{2}, strava.UploadMetadata{})
+	var statusErr *strava.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected a 502, got %v", err)
+	}
+	if n := countRequests(server.Requests(), "/api/v3/uploads"); n != 4 {
+		t.Errorf("expected the failed upload not to be retried, got %d upload requests", n)
+	}
+}
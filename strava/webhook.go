@@ -0,0 +1,137 @@
+package strava
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// WebhookEvent is a Strava push subscription event
+type WebhookEvent struct {
+	ObjectType     string            `json:"object_type"` // "activity" or "athlete"
+	ObjectId       int64             `json:"object_id"`
+	AspectType     string            `json:"aspect_type"` // "create", "update" or "delete"
+	Updates        map[string]string `json:"updates"`     // e.g. {"title": "..."}, {"private": "true"}, {"authorized": "false"}
+	OwnerId        int64             `json:"owner_id"`
+	SubscriptionId int64             `json:"subscription_id"`
+	EventTime      int64             `json:"event_time"`
+}
+
+// webhookQueue is how many events can wait for Run before new ones are
+// turned away
+const webhookQueue = 1000
+
+// WebhookHandler implements Strava's push subscription callback.  GET
+// requests answer the subscription validation challenge, which always fails
+// without a verify token; POSTed events are acknowledged immediately (Strava
+// expects a response within two seconds) and applied to the store by Run.
+type WebhookHandler struct {
+	client      *StravaClient
+	store       DataStore
+	verifyToken string
+	events      chan WebhookEvent
+}
+
+func NewWebhookHandler(client *StravaClient, store DataStore, verifyToken string) *WebhookHandler {
+	return &WebhookHandler{
+		client:      client,
+		store:       store,
+		verifyToken: verifyToken,
+		events:      make(chan WebhookEvent, webhookQueue),
+	}
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if h.verifyToken == "" || q.Get("hub.mode") != "subscribe" || q.Get("hub.verify_token") != h.verifyToken {
+			http.Error(w, "invalid verify token", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"hub.challenge": q.Get("hub.challenge")})
+
+	case http.MethodPost:
+		var event WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case h.events <- event:
+			log.Printf("webhook: %s %s %d", event.AspectType, event.ObjectType, event.ObjectId)
+			w.WriteHeader(http.StatusOK)
+		default:
+			// Answer now rather than block past Strava's deadline; it
+			// retries, and the next Sync picks up anything still missed
+			log.Printf("webhook: queue full, dropped %s %s %d", event.AspectType, event.ObjectType, event.ObjectId)
+			http.Error(w, "too many queued events", http.StatusServiceUnavailable)
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Run applies queued events one at a time until ctx is cancelled.  Failed
+// events are logged and dropped; the next Sync picks up anything missed.
+func (h *WebhookHandler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-h.events:
+			if err := h.HandleEvent(ctx, event); err != nil {
+				log.Printf("webhook: error handling %s of %s %d: %v", event.AspectType, event.ObjectType, event.ObjectId, err)
+			}
+		}
+	}
+}
+
+// HandleEvent applies a single event to the store
+func (h *WebhookHandler) HandleEvent(ctx context.Context, event WebhookEvent) error {
+	switch event.ObjectType {
+	case "activity":
+		switch event.AspectType {
+		case "create", "update":
+			// Updates only say which fields changed (title, type, private),
+			// so refetch the whole activity.  If it became private to a
+			// token without activity:read_all it 404s and is marked deleted.
+			return h.client.SyncActivity(ctx, h.store, event.ObjectId)
+		case "delete":
+			return h.store.MarkDeleted(event.ObjectId)
+		}
+	case "athlete":
+		if event.Updates["authorized"] == "false" {
+			log.Printf("webhook: athlete %d revoked access; run `running login` to authorize again", event.ObjectId)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown event: %s %s", event.AspectType, event.ObjectType)
+}
+
+// Replay applies recorded events, one JSON object per line, in order.  It's
+// useful for reprocessing events captured from a live subscription.
+func (h *WebhookHandler) Replay(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal([]byte(text), &event); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := h.HandleEvent(ctx, event); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
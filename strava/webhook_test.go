@@ -0,0 +1,173 @@
+package strava_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/strava/stravatest"
+)
+
+func TestWebhookValidation(t *testing.T) {
+	handler := strava.NewWebhookHandler(nil, nil, "s3cret")
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/webhook?hub.mode=subscribe&hub.verify_token=s3cret&hub.challenge=15f7d1a91c1f40f8a748fd134752feb3", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["hub.challenge"] != "15f7d1a91c1f40f8a748fd134752feb3" {
+		t.Errorf("expected the challenge to be echoed, got %v", body)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/webhook?hub.mode=subscribe&hub.verify_token=wrong&hub.challenge=x", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a bad verify token, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	strava.NewWebhookHandler(nil, nil, "").ServeHTTP(w, httptest.NewRequest("GET", "/webhook?hub.mode=subscribe&hub.verify_token=&hub.challenge=x", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without a verify token, got %d", w.Code)
+	}
+}
+
+func TestWebhookFullQueueIsRejected(t *testing.T) {
+	// Nothing runs the handler, so the queue fills up
+	handler := strava.NewWebhookHandler(nil, nil, "s3cret")
+	event := `{"aspect_type": "create", "object_id": 7023456789, "object_type": "activity", "owner_id": 4242}`
+	for i := 0; ; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/webhook", strings.NewReader(event)))
+		if w.Code == http.StatusServiceUnavailable {
+			if i == 0 {
+				t.Error("expected events to be queued before the queue is full")
+			}
+			return
+		}
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if i > 10000 {
+			t.Fatal("the queue never filled up")
+		}
+	}
+}
+
+func TestWebhookEventIsProcessedAfterAcknowledging(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler := strava.NewWebhookHandler(client, store, "s3cret")
+	go handler.Run(ctx)
+
+	event := `{"aspect_type": "create", "object_id": 7023456789, "object_type": "activity", "owner_id": 4242}`
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/webhook", strings.NewReader(event)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		details, err := store.GetDetails(7023456789)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if details != nil {
+			return
+		}
+	}
+	t.Fatal("activity was never fetched")
+}
+
+// TestWebhookReplay replays recorded events against a store that was synced
+// before the athlete made the changes they describe
+func TestWebhookReplay(t *testing.T) {
+	server := stravatest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	if err := client.Sync(ctx, store, strava.SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new run, a rename, a deletion, and a run made private
+	activities, laps := stravatest.GenerateActivities(1, time.Date(2022, 4, 22, 7, 0, 0, 0, time.UTC))
+	server.AddActivity(activities[0], laps[0])
+	for _, activity := range server.Activities {
+		if activity.Id == 7023456789 {
+			activity.Name = "Easy Shakeout"
+			server.AddActivity(activity, server.Laps[activity.Id])
+			break
+		}
+	}
+	server.RemoveActivity(7034567890)
+	server.RemoveActivity(7012345678)
+
+	events, err := os.Open("testdata/webhook_events.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Close()
+	if err := strava.NewWebhookHandler(client, store, "").Replay(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.Load(strava.ActivityFilter{Sort: strava.OldestFirst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, activity := range stored {
+		names = append(names, activity.Name)
+	}
+	if got := strings.Join(names, ", "); got != "Easy Shakeout, Run 1" {
+		t.Fatalf("unexpected activities after replay: %s", got)
+	}
+
+	details, err := store.GetDetails(7023456789)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details == nil || details.Name != "Easy Shakeout" {
+		t.Errorf("expected the renamed activity's details to be updated, got %+v", details)
+	}
+	all, err := store.Load(strava.ActivityFilter{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 4 {
+		t.Errorf("expected deleted activities to be kept, got %d activities", len(all))
+	}
+
+	missing, err := store.LoadMissingLaps(strava.ActivityFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Errorf("expected laps to be stored for every activity, %d are missing", len(missing))
+	}
+}
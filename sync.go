@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func printSyncStatus(status *strava.SyncStatus) {
+	const layout = "2006-01-02 15:04:05"
+
+	switch {
+	case status.InProgress:
+		fmt.Printf("sync:            in progress since %s (%d pages saved)\n", status.StartedAt.Local().Format(layout), status.LastPage)
+	case !status.CompletedAt.IsZero():
+		fmt.Printf("sync:            last completed %s\n", status.CompletedAt.Local().Format(layout))
+	default:
+		fmt.Printf("sync:            never run\n")
+	}
+	if status.LastError != "" {
+		fmt.Printf("last error:      %s (%s)\n", status.LastError, status.LastErrorAt.Local().Format(layout))
+	}
+	if budget := status.RateBudget; !budget.UpdatedAt.IsZero() {
+		fmt.Printf("rate limit:      %s (as of %s)\n", budget, budget.UpdatedAt.Local().Format(layout))
+	}
+	fmt.Printf("missing laps:    %d activities\n", status.MissingLaps)
+	fmt.Printf("missing details: %d activities\n", status.MissingDetails)
+	fmt.Printf("missing streams: %d activities\n", status.MissingStreams)
+}
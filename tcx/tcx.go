@@ -0,0 +1,383 @@
+// Package tcx reads and writes Garmin Training Center (TCX) files, mapping
+// their laps to strava.ActivityLap and their trackpoints to streams.
+// Importing the package registers its decoder for ".tcx" files with
+// strava.DecodeFile.
+package tcx
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+)
+
+func init() {
+	strava.RegisterFileDecoder(".tcx", Decode)
+}
+
+// Element names are matched without their namespace, so the speed and run
+// cadence in Garmin's ActivityExtension v2 are found whatever prefix the
+// file uses
+type database struct {
+	Activities []activity `xml:"Activities>Activity"`
+}
+
+type activity struct {
+	Sport   string `xml:"Sport,attr"`
+	Id      string `xml:"Id"`
+	Laps    []lap  `xml:"Lap"`
+	Notes   string `xml:"Notes"`
+	Creator struct {
+		Name string `xml:"Name"`
+	} `xml:"Creator"`
+}
+
+type lap struct {
+	StartTime        time.Time    `xml:"StartTime,attr"`
+	TotalTimeSeconds float64      `xml:"TotalTimeSeconds"`
+	DistanceMeters   float64      `xml:"DistanceMeters"`
+	MaximumSpeed     float64      `xml:"MaximumSpeed"`
+	Calories         float64      `xml:"Calories"`
+	AverageHeartRate *float64     `xml:"AverageHeartRateBpm>Value"`
+	MaximumHeartRate *float64     `xml:"MaximumHeartRateBpm>Value"`
+	Cadence          *float64     `xml:"Cadence"`
+	AvgRunCadence    *float64     `xml:"Extensions>LX>AvgRunCadence"`
+	Trackpoints      []trackpoint `xml:"Track>Trackpoint"`
+}
+
+type trackpoint struct {
+	Time       time.Time `xml:"Time"`
+	Latitude   *float64  `xml:"Position>LatitudeDegrees"`
+	Longitude  *float64  `xml:"Position>LongitudeDegrees"`
+	Altitude   *float64  `xml:"AltitudeMeters"`
+	Distance   *float64  `xml:"DistanceMeters"`
+	HeartRate  *int32    `xml:"HeartRateBpm>Value"`
+	Cadence    *int32    `xml:"Cadence"`
+	RunCadence *int32    `xml:"Extensions>TPX>RunCadence"`
+	Speed      *float64  `xml:"Extensions>TPX>Speed"`
+}
+
+var sports = map[string]string{
+	"Running": "Run",
+	"Biking":  "Ride",
+}
+
+// Decode reads the first activity of a TCX file.  Each <Lap> becomes an
+// ActivityLap whose start and end index refer to the streams, which hold
+// the trackpoints of every lap in order.  Times are in UTC, since TCX
+// doesn't record the local time zone.
+func Decode(r io.Reader) (*strava.ActivityFile, error) {
+	var doc database
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Activities) == 0 {
+		return nil, fmt.Errorf("no activities")
+	}
+	src := doc.Activities[0]
+
+	file := &strava.ActivityFile{Streams: &strava.Streams{}}
+	a := &file.Activity
+	a.Type = "Workout"
+	if sport, ok := sports[src.Sport]; ok {
+		a.Type = sport
+	}
+	a.Description = strings.TrimSpace(src.Notes)
+	a.DeviceName = src.Creator.Name
+
+	start, err := time.Parse(time.RFC3339, strings.TrimSpace(src.Id))
+	if err != nil && len(src.Laps) > 0 {
+		start = src.Laps[0].StartTime
+	}
+	if start.IsZero() {
+		return nil, fmt.Errorf("no start time")
+	}
+	a.DateString = start.UTC().Format("2006-01-02T15:04:05Z")
+
+	var points []trackpoint
+	for i, l := range src.Laps {
+		lap := strava.ActivityLap{
+			Name:           fmt.Sprintf("Lap %d", i+1),
+			StartDate:      l.StartTime.UTC(),
+			StartDateLocal: l.StartTime.UTC(),
+			ElapsedTime:    int32(l.TotalTimeSeconds),
+			MovingTime:     int32(l.TotalTimeSeconds),
+			Distance:       l.DistanceMeters,
+			MaxSpeed:       l.MaximumSpeed,
+			Calories:       l.Calories,
+			StartIndex:     int32(len(points)),
+			EndIndex:       int32(len(points) + len(l.Trackpoints) - 1),
+			LapIndex:       int32(i + 1),
+			Split:          int32(i + 1),
+		}
+		if l.TotalTimeSeconds > 0 {
+			lap.AverageSpeed = l.DistanceMeters / l.TotalTimeSeconds
+		}
+		if l.AverageHeartRate != nil {
+			lap.AverageHeartrate = *l.AverageHeartRate
+		}
+		if l.MaximumHeartRate != nil {
+			lap.MaxHeartrate = *l.MaximumHeartRate
+		}
+		if l.Cadence != nil {
+			lap.AverageCadence = *l.Cadence
+		} else if l.AvgRunCadence != nil {
+			lap.AverageCadence = *l.AvgRunCadence
+		}
+		file.Laps = append(file.Laps, lap)
+		a.Calories += l.Calories
+		points = append(points, l.Trackpoints...)
+	}
+
+	if err := readTrackpoints(file.Streams, start, points); err != nil {
+		return nil, err
+	}
+
+	// A lap's climb includes the one from the previous lap's last point, so
+	// the laps add up to the activity's elevation gain
+	for i := range file.Laps {
+		lap := &file.Laps[i]
+		s := file.Streams
+		if len(s.Altitude) == 0 || int(lap.EndIndex) >= len(s.Altitude) {
+			continue
+		}
+		for j := lap.StartIndex; j <= lap.EndIndex; j++ {
+			if j == 0 {
+				continue
+			}
+			if gain := s.Altitude[j] - s.Altitude[j-1]; gain > 0 {
+				lap.TotalElevationGain += gain
+			}
+		}
+	}
+
+	file.Summarize()
+	return file, nil
+}
+
+// readTrackpoints fills in the streams from the trackpoints.  A stream is
+// present if any trackpoint has its value, and a trackpoint missing it
+// (e.g. during a GPS or heart rate dropout) repeats the previous one, or
+// the first one seen, so every stream has one entry per trackpoint.
+func readTrackpoints(s *strava.Streams, start time.Time, points []trackpoint) error {
+	var hasPosition, hasAltitude, hasDistance, hasHeartRate, hasCadence, hasSpeed bool
+	var position [2]float64
+	var altitude, distance, speed float64
+	var heartrate, cadence int32
+	for _, p := range points {
+		if p.Latitude != nil && p.Longitude != nil && !hasPosition {
+			hasPosition, position = true, [2]float64{*p.Latitude, *p.Longitude}
+		}
+		if p.Altitude != nil && !hasAltitude {
+			hasAltitude, altitude = true, *p.Altitude
+		}
+		if p.Distance != nil && !hasDistance {
+			hasDistance, distance = true, *p.Distance
+		}
+		if p.HeartRate != nil && !hasHeartRate {
+			hasHeartRate, heartrate = true, *p.HeartRate
+		}
+		if c := p.cadence(); c != nil && !hasCadence {
+			hasCadence, cadence = true, *c
+		}
+		if p.Speed != nil && !hasSpeed {
+			hasSpeed, speed = true, *p.Speed
+		}
+	}
+
+	for i, p := range points {
+		if p.Time.IsZero() {
+			return fmt.Errorf("trackpoint %d has no time", i+1)
+		}
+		s.Time = append(s.Time, int32(p.Time.Sub(start).Seconds()))
+		if hasPosition {
+			if p.Latitude != nil && p.Longitude != nil {
+				position = [2]float64{*p.Latitude, *p.Longitude}
+			}
+			s.LatLng = append(s.LatLng, position)
+		}
+		if hasAltitude {
+			if p.Altitude != nil {
+				altitude = *p.Altitude
+			}
+			s.Altitude = append(s.Altitude, altitude)
+		}
+		if hasDistance {
+			if p.Distance != nil {
+				distance = *p.Distance
+			}
+			s.Distance = append(s.Distance, distance)
+		}
+		if hasHeartRate {
+			if p.HeartRate != nil {
+				heartrate = *p.HeartRate
+			}
+			s.Heartrate = append(s.Heartrate, heartrate)
+		}
+		if hasCadence {
+			if c := p.cadence(); c != nil {
+				cadence = *c
+			}
+			s.Cadence = append(s.Cadence, cadence)
+		}
+		if hasSpeed {
+			if p.Speed != nil {
+				speed = *p.Speed
+			}
+			s.Velocity = append(s.Velocity, speed)
+		}
+	}
+	return nil
+}
+
+// cadence is the bike cadence or, for runs, Garmin's RunCadence extension.
+// Both are per leg, the same as Strava's cadence stream.
+func (p trackpoint) cadence() *int32 {
+	if p.Cadence != nil {
+		return p.Cadence
+	}
+	return p.RunCadence
+}
+
+// Encode writes an activity as a TCX file.  Each lap's trackpoints are the
+// points of the streams from its start to its end index; an activity
+// without laps is written as a single lap.
+func Encode(w io.Writer, file *strava.ActivityFile) error {
+	a, s := file.Activity, file.Streams
+	if s == nil {
+		s = &strava.Streams{}
+	}
+	// Trackpoints are timed from the UTC start, like the laps.  Activities
+	// stored without their UTC start take it from the first lap's.
+	start := a.StartTime()
+	if a.StartDate == "" && len(file.Laps) > 0 && !file.Laps[0].StartDate.IsZero() {
+		start = file.Laps[0].StartDate.UTC()
+		if i := int(file.Laps[0].StartIndex); i < len(s.Time) {
+			start = start.Add(-time.Duration(s.Time[i]) * time.Second)
+		}
+	}
+
+	laps := file.Laps
+	if len(laps) == 0 {
+		laps = []strava.ActivityLap{{
+			StartDate:   start,
+			ElapsedTime: int32(a.ElapsedTime),
+			MovingTime:  int32(a.MovingTime),
+			Distance:    a.Distance,
+			MaxSpeed:    a.MaxSpeed,
+			Calories:    a.Calories,
+			StartIndex:  0,
+			EndIndex:    int32(s.Len() - 1),
+		}}
+		if a.HasHeartrate {
+			laps[0].AverageHeartrate = a.AverageHeartrate
+			laps[0].MaxHeartrate = a.MaxHeartrate
+		}
+		laps[0].AverageCadence = a.AverageCadence
+	}
+
+	sport := "Other"
+	for name, activityType := range sports {
+		if activityType == a.Type {
+			sport = name
+		}
+	}
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "%s\n", xml.Header[:len(xml.Header)-1])
+	fmt.Fprintf(b, `<TrainingCenterDatabase xmlns="http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2" `+
+		`xmlns:ns3="http://www.garmin.com/xmlschemas/ActivityExtension/v2">`+"\n")
+	fmt.Fprintf(b, "  <Activities>\n    <Activity Sport=\"%s\">\n      <Id>%s</Id>\n", sport, start.Format(time.RFC3339))
+
+	for _, lap := range laps {
+		lapStart := lap.StartDate
+		if lapStart.IsZero() && int(lap.StartIndex) < len(s.Time) {
+			lapStart = start.Add(time.Duration(s.Time[lap.StartIndex]) * time.Second)
+		}
+		total := lap.MovingTime
+		if total == 0 {
+			total = lap.ElapsedTime
+		}
+		fmt.Fprintf(b, "      <Lap StartTime=\"%s\">\n", lapStart.UTC().Format(time.RFC3339))
+		fmt.Fprintf(b, "        <TotalTimeSeconds>%d</TotalTimeSeconds>\n", total)
+		fmt.Fprintf(b, "        <DistanceMeters>%s</DistanceMeters>\n", formatFloat(lap.Distance))
+		if lap.MaxSpeed > 0 {
+			fmt.Fprintf(b, "        <MaximumSpeed>%s</MaximumSpeed>\n", formatFloat(lap.MaxSpeed))
+		}
+		fmt.Fprintf(b, "        <Calories>%d</Calories>\n", int(lap.Calories))
+		if lap.AverageHeartrate > 0 {
+			fmt.Fprintf(b, "        <AverageHeartRateBpm><Value>%s</Value></AverageHeartRateBpm>\n", formatFloat(lap.AverageHeartrate))
+		}
+		if lap.MaxHeartrate > 0 {
+			fmt.Fprintf(b, "        <MaximumHeartRateBpm><Value>%s</Value></MaximumHeartRateBpm>\n", formatFloat(lap.MaxHeartrate))
+		}
+		fmt.Fprintf(b, "        <Intensity>Active</Intensity>\n")
+		if lap.AverageCadence > 0 {
+			fmt.Fprintf(b, "        <Cadence>%s</Cadence>\n", formatFloat(lap.AverageCadence))
+		}
+		fmt.Fprintf(b, "        <TriggerMethod>Manual</TriggerMethod>\n")
+
+		if s.Len() > 0 {
+			fmt.Fprintf(b, "        <Track>\n")
+			for i := int(lap.StartIndex); i <= int(lap.EndIndex) && i < s.Len(); i++ {
+				writeTrackpoint(b, s, start, i)
+			}
+			fmt.Fprintf(b, "        </Track>\n")
+		}
+		fmt.Fprintf(b, "      </Lap>\n")
+	}
+
+	if a.Description != "" {
+		fmt.Fprintf(b, "      <Notes>%s</Notes>\n", escape(a.Description))
+	}
+	if a.DeviceName != "" {
+		fmt.Fprintf(b, "      <Creator xsi:type=\"Device_t\" xmlns:xsi=\"http://www.w3.org/2001/XMLSchema-instance\">\n")
+		fmt.Fprintf(b, "        <Name>%s</Name>\n      </Creator>\n", escape(a.DeviceName))
+	}
+	fmt.Fprintf(b, "    </Activity>\n  </Activities>\n</TrainingCenterDatabase>\n")
+	return b.Flush()
+}
+
+func writeTrackpoint(b *bufio.Writer, s *strava.Streams, start time.Time, i int) {
+	fmt.Fprintf(b, "          <Trackpoint>\n")
+	fmt.Fprintf(b, "            <Time>%s</Time>\n", start.Add(time.Duration(s.Time[i])*time.Second).UTC().Format(time.RFC3339))
+	if i < len(s.LatLng) {
+		fmt.Fprintf(b, "            <Position>\n")
+		fmt.Fprintf(b, "              <LatitudeDegrees>%s</LatitudeDegrees>\n", formatFloat(s.LatLng[i][0]))
+		fmt.Fprintf(b, "              <LongitudeDegrees>%s</LongitudeDegrees>\n", formatFloat(s.LatLng[i][1]))
+		fmt.Fprintf(b, "            </Position>\n")
+	}
+	if i < len(s.Altitude) {
+		fmt.Fprintf(b, "            <AltitudeMeters>%s</AltitudeMeters>\n", formatFloat(s.Altitude[i]))
+	}
+	if i < len(s.Distance) {
+		fmt.Fprintf(b, "            <DistanceMeters>%s</DistanceMeters>\n", formatFloat(s.Distance[i]))
+	}
+	if i < len(s.Heartrate) {
+		fmt.Fprintf(b, "            <HeartRateBpm><Value>%d</Value></HeartRateBpm>\n", s.Heartrate[i])
+	}
+	if i < len(s.Cadence) {
+		fmt.Fprintf(b, "            <Cadence>%d</Cadence>\n", s.Cadence[i])
+	}
+	if i < len(s.Velocity) {
+		fmt.Fprintf(b, "            <Extensions><ns3:TPX><ns3:Speed>%s</ns3:Speed></ns3:TPX></Extensions>\n", formatFloat(s.Velocity[i]))
+	}
+	fmt.Fprintf(b, "          </Trackpoint>\n")
+}
+
+// formatFloat writes the shortest representation that parses back to the
+// same value, so files round-trip exactly
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
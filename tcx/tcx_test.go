@@ -0,0 +1,179 @@
+package tcx_test
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/scottfrazer/running/strava"
+	"github.com/scottfrazer/running/tcx"
+)
+
+func decodeFixture(t *testing.T, name string) *strava.ActivityFile {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	file, err := tcx.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestDecodeLaps(t *testing.T) {
+	file := decodeFixture(t, "run.tcx")
+
+	a := file.Activity
+	if a.Type != "Run" || a.DateString != "2022-05-03T10:15:00Z" || a.DeviceName != "Forerunner 955" || a.Description != "Reservoir strides" {
+		t.Errorf("unexpected activity: %+v", a.SummaryActivity)
+	}
+	if a.Distance != 199.7 || a.ElapsedTime != 60 || a.Calories != 17 || a.MaxHeartrate != 144 {
+		t.Errorf("unexpected summary: distance=%v elapsed=%v calories=%v max hr=%v", a.Distance, a.ElapsedTime, a.Calories, a.MaxHeartrate)
+	}
+	if a.Map.Polyline == "" {
+		t.Error("expected a polyline")
+	}
+
+	if len(file.Laps) != 2 {
+		t.Fatalf("expected 2 laps, got %d", len(file.Laps))
+	}
+	lap := file.Laps[1]
+	want := strava.ActivityLap{
+		Name:             "Lap 2",
+		StartDate:        time.Date(2022, 5, 3, 10, 15, 30, 0, time.UTC),
+		StartDateLocal:   time.Date(2022, 5, 3, 10, 15, 30, 0, time.UTC),
+		ElapsedTime:      30,
+		MovingTime:       30,
+		Distance:         98.2,
+		StartIndex:       3,
+		EndIndex:         4,
+		AverageSpeed:     98.2 / 30,
+		MaxSpeed:         3.401,
+		AverageCadence:   87,
+		AverageHeartrate: 141,
+		MaxHeartrate:     144,
+		Calories:         8,
+		LapIndex:         2,
+		Split:            2,
+	}
+	want.TotalElevationGain = lap.TotalElevationGain
+	if !reflect.DeepEqual(lap, want) {
+		t.Errorf("unexpected lap:\n got %+v\nwant %+v", lap, want)
+	}
+	if gain := lap.TotalElevationGain; gain < 1.59 || gain > 1.61 {
+		t.Errorf("expected 1.6 m of elevation gain in lap 2, got %v", gain)
+	}
+
+	s := file.Streams
+	if s.Len() != 5 || len(s.LatLng) != 5 || len(s.Heartrate) != 5 || len(s.Cadence) != 5 || len(s.Velocity) != 5 {
+		t.Fatalf("expected 5 points in every stream, got %+v", s)
+	}
+	if s.Time[4] != 60 || s.Cadence[4] != 88 || s.Heartrate[0] != 124 {
+		t.Errorf("unexpected streams: %+v", s)
+	}
+	// The last trackpoint has no position and repeats the previous one
+	if s.LatLng[4] != s.LatLng[3] {
+		t.Errorf("expected a missing position to repeat the previous one, got %v", s.LatLng[4])
+	}
+}
+
+func TestDecodeWithoutPosition(t *testing.T) {
+	file := decodeFixture(t, "treadmill.tcx")
+	if len(file.Streams.LatLng) != 0 || file.Activity.Map.Polyline != "" {
+		t.Errorf("expected no route for a treadmill run, got %v", file.Streams.LatLng)
+	}
+	if file.Activity.Distance != 400 || file.Activity.MovingTime != 120 || file.Laps[0].AverageCadence != 85 {
+		t.Errorf("unexpected activity: %+v, laps %+v", file.Activity.SummaryActivity, file.Laps)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, name := range []string{"run.tcx", "treadmill.tcx"} {
+		t.Run(name, func(t *testing.T) {
+			file := decodeFixture(t, name)
+
+			var encoded bytes.Buffer
+			if err := tcx.Encode(&encoded, file); err != nil {
+				t.Fatal(err)
+			}
+			again, err := tcx.Decode(bytes.NewReader(encoded.Bytes()))
+			if err != nil {
+				t.Fatalf("%v\n%s", err, encoded.String())
+			}
+
+			if !reflect.DeepEqual(again.Activity, file.Activity) {
+				t.Errorf("activity changed:\n got %+v\nwant %+v", again.Activity, file.Activity)
+			}
+			if !reflect.DeepEqual(again.Laps, file.Laps) {
+				t.Errorf("laps changed:\n got %+v\nwant %+v", again.Laps, file.Laps)
+			}
+			if !reflect.DeepEqual(again.Streams, file.Streams) {
+				t.Errorf("streams changed:\n got %+v\nwant %+v", again.Streams, file.Streams)
+			}
+
+			var reencoded bytes.Buffer
+			if err := tcx.Encode(&reencoded, again); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(reencoded.Bytes(), encoded.Bytes()) {
+				t.Errorf("encoding isn't stable:\n%s\n---\n%s", encoded.String(), reencoded.String())
+			}
+		})
+	}
+}
+
+func TestEncodeWithoutLaps(t *testing.T) {
+	file := decodeFixture(t, "run.tcx")
+	file.Laps = nil
+
+	var encoded bytes.Buffer
+	if err := tcx.Encode(&encoded, file); err != nil {
+		t.Fatal(err)
+	}
+	again, err := tcx.Decode(&encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Laps) != 1 || again.Laps[0].EndIndex != 4 || !reflect.DeepEqual(again.Streams, file.Streams) {
+		t.Errorf("expected a single lap with every point, got %+v", again.Laps)
+	}
+}
+
+// TestRoundTripFromLocalTime encodes a run synced from Strava, whose local
+// start time is four hours behind UTC and whose laps start in UTC
+func TestRoundTripFromLocalTime(t *testing.T) {
+	for _, stored := range []string{"2022-05-03T10:15:00Z", ""} {
+		file := decodeFixture(t, "run.tcx")
+		file.Activity.DateString = "2022-05-03T06:15:00Z"
+		file.Activity.StartDate = stored
+		for i := range file.Laps {
+			file.Laps[i].StartDateLocal = file.Laps[i].StartDate.Add(-4 * time.Hour)
+		}
+
+		var encoded bytes.Buffer
+		if err := tcx.Encode(&encoded, file); err != nil {
+			t.Fatal(err)
+		}
+		again, err := tcx.Decode(&encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Activity.DateString != "2022-05-03T10:15:00Z" {
+			t.Errorf("start_date %q: expected the activity to start at 10:15 UTC, got %s", stored, again.Activity.DateString)
+		}
+		// Decoded laps are in UTC, and their trackpoints must agree
+		for i, lap := range again.Laps {
+			if !lap.StartDate.Equal(file.Laps[i].StartDate) || lap.StartIndex != file.Laps[i].StartIndex {
+				t.Errorf("start_date %q: lap %d starts at %s (point %d), want %s (point %d)", stored, i+1, lap.StartDate, lap.StartIndex, file.Laps[i].StartDate, file.Laps[i].StartIndex)
+			}
+		}
+		if !reflect.DeepEqual(again.Streams, file.Streams) {
+			t.Errorf("start_date %q: streams changed:\n got %+v\nwant %+v", stored, again.Streams, file.Streams)
+		}
+	}
+}
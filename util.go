@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 func check(e error) {
@@ -31,6 +33,38 @@ func CreateDirectoryIfNotExists(dirName string) error {
 	return nil
 }
 
+// findFiles expands directories in paths to the files under them whose
+// names end with one of the extensions, ignoring case.  Files named
+// directly are kept whatever their extension.
+func findFiles(paths []string, extensions ...string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(p, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if name == p {
+				files = append(files, name)
+				return nil
+			}
+			for _, ext := range extensions {
+				if strings.HasSuffix(strings.ToLower(name), ext) {
+					files = append(files, name)
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
 // open opens the specified URL in the default browser of the user.
 func open(url string) error {
 	var cmd string